@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"backend/linkpreview"
+)
+
+// InitLinkPreviews initializes the fetcher of link previews. It returns nil if link previews
+// are disabled.
+func InitLinkPreviews() (*linkpreview.Fetcher, error) {
+	// Get link preview details from environment variables
+	if getEnv("LINK_PREVIEWS", "true") != "true" {
+		return nil, nil
+	}
+
+	timeout, err := time.ParseDuration(getEnv("LINK_PREVIEW_TIMEOUT", "5s"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid LINK_PREVIEW_TIMEOUT: %q", getEnv("LINK_PREVIEW_TIMEOUT", ""))
+	}
+	maxKB, err := strconv.ParseInt(getEnv("LINK_PREVIEW_MAX_KB", "512"), 10, 64)
+	if err != nil || maxKB <= 0 {
+		return nil, fmt.Errorf("invalid LINK_PREVIEW_MAX_KB: %q", getEnv("LINK_PREVIEW_MAX_KB", ""))
+	}
+
+	return linkpreview.NewFetcher(linkpreview.Options{
+		Timeout:   timeout,
+		MaxBytes:  maxKB << 10,
+		UserAgent: getEnv("LINK_PREVIEW_USER_AGENT", "ChatAppLinkPreview/1.0"),
+	}), nil
+}
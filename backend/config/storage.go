@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"backend/models"
+	"backend/scanner"
+	"backend/storage"
+	"backend/urlsign"
+)
+
+// InitStorage initializes the object storage used for attachments
+func InitStorage() (storage.Storage, error) {
+	// Get storage details from environment variables
+	driver := getEnv("STORAGE_DRIVER", "local")
+
+	switch driver {
+	case "local":
+		return storage.NewLocalStorage(getEnv("STORAGE_LOCAL_PATH", "./uploads"))
+	case "s3":
+		return storage.NewS3Storage(storage.S3Config{
+			Endpoint:  getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Bucket:    getEnv("S3_BUCKET", ""),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+			PathStyle: getEnv("S3_PATH_STYLE", "false") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// minURLSecretLength is the shortest accepted secret for signing file URLs, in bytes
+const minURLSecretLength = 32
+
+// InitURLSigner initializes the signer of file URLs that are served without authentication.
+// Anyone knowing the secret can forge links to every file, so it must be set, and it is not
+// shared with the login tokens.
+func InitURLSigner() (*urlsign.Signer, error) {
+	// Get signing details from environment variables
+	secret := os.Getenv("FILE_URL_SECRET")
+	if len(secret) < minURLSecretLength {
+		return nil, fmt.Errorf("FILE_URL_SECRET must be set to at least %d random bytes", minURLSecretLength)
+	}
+	if secret == os.Getenv("JWT_SECRET") {
+		return nil, fmt.Errorf("FILE_URL_SECRET must differ from JWT_SECRET")
+	}
+	baseURL := getEnv("FILE_URL_BASE", "")
+
+	ttl, err := time.ParseDuration(getEnv("FILE_URL_TTL", "15m"))
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid FILE_URL_TTL: %q", getEnv("FILE_URL_TTL", ""))
+	}
+
+	return urlsign.NewSigner(secret, baseURL, ttl), nil
+}
+
+// InitQuotas configures the default storage quotas, given in megabytes
+func InitQuotas() error {
+	// Get quota details from environment variables
+	userMB, err := strconv.ParseInt(getEnv("USER_STORAGE_QUOTA_MB", "1024"), 10, 64)
+	if err != nil || userMB <= 0 {
+		return fmt.Errorf("invalid USER_STORAGE_QUOTA_MB: %q", getEnv("USER_STORAGE_QUOTA_MB", ""))
+	}
+	groupMB, err := strconv.ParseInt(getEnv("GROUP_STORAGE_QUOTA_MB", "5120"), 10, 64)
+	if err != nil || groupMB <= 0 {
+		return fmt.Errorf("invalid GROUP_STORAGE_QUOTA_MB: %q", getEnv("GROUP_STORAGE_QUOTA_MB", ""))
+	}
+
+	models.Quotas = models.QuotaSettings{UserBytes: userMB << 20, GroupBytes: groupMB << 20}
+	return nil
+}
+
+// InitScanner initializes the malware scanner for uploaded files. It returns nil if scanning
+// is disabled.
+func InitScanner() (scanner.Scanner, error) {
+	// Get scanner details from environment variables
+	driver := getEnv("MALWARE_SCANNER", "none")
+
+	switch driver {
+	case "none":
+		return nil, nil
+	case "clamd":
+		timeout, err := time.ParseDuration(getEnv("CLAMD_TIMEOUT", "2m"))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid CLAMD_TIMEOUT: %q", getEnv("CLAMD_TIMEOUT", ""))
+		}
+		return scanner.NewClamd(getEnv("CLAMD_ADDRESS", "tcp://localhost:3310"), timeout)
+	case "fake":
+		return scanner.NewFake(), nil
+	default:
+		return nil, fmt.Errorf("unknown malware scanner %q", driver)
+	}
+}
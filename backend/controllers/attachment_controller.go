@@ -0,0 +1,606 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backend/media"
+	"backend/models"
+	"backend/storage"
+	"backend/urlsign"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxAttachmentSize is the largest file that can be uploaded, in bytes
+const MaxAttachmentSize = 25 << 20
+
+// allowedAttachmentTypes are the content types that can be uploaded besides images, video and audio.
+// Only images whose metadata can be stripped are accepted (see media.CanProcess).
+var allowedAttachmentTypes = map[string]bool{
+	"application/pdf":               true,
+	"application/zip":               true,
+	"application/ogg":               true,
+	"application/json":              true,
+	"text/plain":                    true,
+	"text/csv":                      true,
+	"application/msword":            true,
+	"application/vnd.ms-excel":      true,
+	"application/vnd.ms-powerpoint": true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+}
+
+// AttachmentController handles file uploads and downloads
+type AttachmentController struct {
+	db      *gorm.DB
+	storage storage.Storage
+	signer  *urlsign.Signer
+	// wakeProcessor starts processing new uploads without waiting for the next poll
+	wakeProcessor func()
+	// scanUploads holds every upload back until the processor scanned it for malware
+	scanUploads bool
+}
+
+// NewAttachmentController creates a new attachment controller
+func NewAttachmentController(db *gorm.DB, store storage.Storage, signer *urlsign.Signer, wakeProcessor func(), scanUploads bool) *AttachmentController {
+	return &AttachmentController{db: db, storage: store, signer: signer, wakeProcessor: wakeProcessor, scanUploads: scanUploads}
+}
+
+// UploadAttachment stores an uploaded file. The returned attachment is sent by putting its ID
+// in the attachment_id metadata field of an image or file message.
+func (ac *AttachmentController) UploadAttachment(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Leave room for the multipart headers around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxAttachmentSize+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files must be at most %d MB", MaxAttachmentSize>>20)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return
+	}
+	if fileHeader.Size > MaxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files must be at most %d MB", MaxAttachmentSize>>20)})
+		return
+	}
+	if fileHeader.Size == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+		return
+	}
+	if !checkUserQuota(c, ac.db, userID.(string), fileHeader.Size) {
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	// Detect the content type from the file itself rather than trusting the client
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	fileName := sanitizeFileName(fileHeader.Filename)
+	contentType := detectContentType(head[:n], fileName)
+	if !isAllowedAttachmentType(contentType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("Files of type %s cannot be uploaded", contentType)})
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	attachment := ac.newAttachment(userID.(string), fileName, contentType, fileHeader.Size)
+
+	// Hash the file while it is stored
+	hash := sha256.New()
+	if err := ac.storage.Put(c.Request.Context(), attachment.StorageKey, io.TeeReader(file, hash), attachment.Size, contentType); err != nil {
+		log.Printf("Failed to store attachment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return
+	}
+	attachment.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	// The quota is checked again as the attachment is saved, as other uploads may have finished meanwhile
+	err = ac.saveAttachment(c.Request.Context(), attachment, func(tx *gorm.DB) error {
+		return models.CheckUserQuota(tx, attachment.UploaderID, attachment.Size)
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		respondQuotaExceeded(c, quotaErr)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// newAttachment creates an attachment for a file that is about to be stored
+func (ac *AttachmentController) newAttachment(uploaderID, fileName, contentType string, size int64) *models.Attachment {
+	now := time.Now()
+	attachment := &models.Attachment{
+		ID:          uuid.New().String(),
+		UploaderID:  uploaderID,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        size,
+		Status:      models.AttachmentReady,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	attachment.StorageKey = "attachments/" + attachment.ID
+
+	// Files are scanned, images get their metadata stripped and thumbnails generated, and audio
+	// gets its duration and waveform read in the background
+	if ac.scanUploads || media.CanProcess(contentType) || media.IsAudio(contentType) {
+		attachment.Status = models.AttachmentPending
+	}
+
+	return attachment
+}
+
+// saveAttachment saves an attachment whose file has been stored, deleting the file if that fails.
+// reserve runs in the same transaction first: it checks the uploader's quota, or for files whose
+// size was reserved when their upload started, hands the reservation over to the attachment.
+func (ac *AttachmentController) saveAttachment(ctx context.Context, attachment *models.Attachment, reserve func(tx *gorm.DB) error) error {
+	err := ac.db.Transaction(func(tx *gorm.DB) error {
+		if err := reserve(tx); err != nil {
+			return err
+		}
+		return tx.Create(attachment).Error
+	})
+	if err != nil {
+		ac.storage.Delete(ctx, attachment.StorageKey)
+		return err
+	}
+
+	if attachment.Status == models.AttachmentPending {
+		ac.wakeProcessor()
+	}
+	return nil
+}
+
+// GetAttachment returns the details of an attachment
+func (ac *AttachmentController) GetAttachment(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	attachment, ok := ac.loadAccessibleAttachment(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, attachment)
+}
+
+// DownloadAttachment streams the file of an attachment. The size query parameter selects
+// a thumbnail of an image; the image itself is returned if it is smaller than the thumbnail.
+func (ac *AttachmentController) DownloadAttachment(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	attachment, ok := ac.loadAccessibleAttachment(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	ac.serveAttachment(c, attachment, userID.(string), c.Query("size"), "private, max-age=86400")
+}
+
+// AttachmentURL is a signed URL that downloads an attachment without authentication
+type AttachmentURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetAttachmentURL returns a short-lived signed URL for an attachment, which can be loaded
+// without an Authorization header and cached by a CDN
+func (ac *AttachmentController) GetAttachmentURL(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	size := c.Query("size")
+	if size != "" && !isThumbnailSize(size) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid thumbnail size"})
+		return
+	}
+
+	attachment, ok := ac.loadAccessibleAttachment(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, ac.signAttachmentURL(attachment.ID, userID.(string), size))
+}
+
+// AttachmentURLsRequest represents the request body for signing the URLs of several attachments
+type AttachmentURLsRequest struct {
+	AttachmentIDs []string `json:"attachment_ids" binding:"required,min=1,max=100"`
+	Size          string   `json:"size"`
+}
+
+// GetAttachmentURLs returns signed URLs for several attachments, e.g. all images of a page of
+// messages. Attachments the user cannot access are left out.
+func (ac *AttachmentController) GetAttachmentURLs(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req AttachmentURLsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size != "" && !isThumbnailSize(req.Size) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid thumbnail size"})
+		return
+	}
+
+	var attachments []models.Attachment
+	if err := ac.db.Where("id IN ? AND detached_at IS NULL", req.AttachmentIDs).Find(&attachments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attachments"})
+		return
+	}
+
+	urls := make(map[string]AttachmentURL)
+	for i := range attachments {
+		if ac.canAccessAttachment(&attachments[i], userID.(string)) {
+			urls[attachments[i].ID] = ac.signAttachmentURL(attachments[i].ID, userID.(string), req.Size)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"urls": urls})
+}
+
+// ServeSignedAttachment streams an attachment for a signed URL. Access is checked again for the
+// user the URL was signed for, so URLs stop working when the message is deleted or the user
+// leaves the group, even before they expire.
+func (ac *AttachmentController) ServeSignedAttachment(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if err := ac.signer.Verify(c.Request.URL.Path, query, time.Now()); err != nil {
+		if errors.Is(err, urlsign.ErrExpired) {
+			c.JSON(http.StatusGone, gin.H{"error": "Link has expired"})
+			return
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid link"})
+		return
+	}
+
+	userID := query.Get("u")
+	attachment, ok := ac.loadAccessibleAttachment(c, c.Param("id"), userID)
+	if !ok {
+		return
+	}
+
+	// Shared caches may keep the file until the link expires, but not long enough to
+	// delay revocation by much
+	maxAge := urlsign.Remaining(query, time.Now())
+	if maxAge > maxSignedCacheAge {
+		maxAge = maxSignedCacheAge
+	}
+	ac.serveAttachment(c, attachment, userID, query.Get("size"), fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+}
+
+// maxSignedCacheAge is the longest time shared caches may keep a file served for a signed URL
+const maxSignedCacheAge = 5 * time.Minute
+
+// signAttachmentURL signs the URL of an attachment for a user
+func (ac *AttachmentController) signAttachmentURL(attachmentID, userID, size string) AttachmentURL {
+	params := url.Values{"u": {userID}}
+	if size != "" {
+		params.Set("size", size)
+	}
+	signed, expiresAt := ac.signer.Sign("/files/attachments/"+attachmentID, params, time.Now())
+	return AttachmentURL{URL: signed, ExpiresAt: expiresAt}
+}
+
+// serveAttachment streams the file of an attachment, or of one of its thumbnails, to a user allowed to access it
+func (ac *AttachmentController) serveAttachment(c *gin.Context, attachment *models.Attachment, userID, sizeName, cacheControl string) {
+	// Nobody can download malware, not even the uploader
+	if attachment.Status == models.AttachmentQuarantined {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Attachment was quarantined because it contains malware"})
+		return
+	}
+
+	// Until a file is processed it may not be scanned yet, and images may still contain location data
+	if attachment.UploaderID != userID {
+		switch attachment.Status {
+		case models.AttachmentPending, models.AttachmentProcessing:
+			c.JSON(http.StatusConflict, gin.H{"error": "Attachment is still being processed"})
+			return
+		case models.AttachmentFailed:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Attachment could not be processed"})
+			return
+		}
+	}
+
+	key, size, contentType := attachment.StorageKey, attachment.Size, attachment.ContentType
+	etag := attachment.Checksum
+	if sizeName != "" {
+		if !isThumbnailSize(sizeName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid thumbnail size"})
+			return
+		}
+		if thumbnail := attachment.Thumbnail(sizeName); thumbnail != nil {
+			key, size, contentType = thumbnail.StorageKey, thumbnail.Size, thumbnail.ContentType
+			etag += "-" + sizeName
+		}
+	}
+
+	reader, _, err := ac.storage.Get(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+		log.Printf("Failed to open attachment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	defer reader.Close()
+
+	// Only images are shown inline, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	c.DataFromReader(http.StatusOK, size, contentType, reader, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          cacheControl,
+		"ETag":                   `"` + etag + `"`,
+	})
+}
+
+// DeleteAttachment deletes an attachment that has not been sent yet
+func (ac *AttachmentController) DeleteAttachment(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var attachment models.Attachment
+	if err := ac.db.First(&attachment, "id = ? AND uploader_id = ?", c.Param("id"), userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	// Sent attachments go away with their message
+	result := ac.db.Where("id = ? AND message_id IS NULL", attachment.ID).Delete(&models.Attachment{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Attachment has been sent in a message"})
+		return
+	}
+
+	for _, key := range attachment.StorageKeys() {
+		if err := ac.storage.Delete(c.Request.Context(), key); err != nil {
+			log.Printf("Failed to delete attachment file %s: %v", key, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment deleted"})
+}
+
+// loadAccessibleAttachment loads an attachment the user uploaded or can see through the message
+// it was sent in, writing the error response if there is none
+func (ac *AttachmentController) loadAccessibleAttachment(c *gin.Context, attachmentID, userID string) (*models.Attachment, bool) {
+	var attachment models.Attachment
+	if err := ac.db.First(&attachment, "id = ? AND detached_at IS NULL", attachmentID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return nil, false
+	}
+
+	if ac.canAccessAttachment(&attachment, userID) {
+		return &attachment, true
+	}
+
+	// Don't reveal attachments of other chats
+	c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+	return nil, false
+}
+
+// canAccessAttachment checks if a user uploaded an attachment or is a participant of the chat it was sent to
+func (ac *AttachmentController) canAccessAttachment(attachment *models.Attachment, userID string) bool {
+	if attachment.UploaderID == userID {
+		return true
+	}
+	if attachment.MessageID == nil {
+		return false
+	}
+
+	var message models.Message
+	if err := ac.db.First(&message, "id = ?", *attachment.MessageID).Error; err != nil {
+		return false
+	}
+	return canAccessMessage(ac.db, &message, userID)
+}
+
+// checkAttachment checks that the attachment a message references was uploaded by its
+// sender and fits the message type, and returns it. Its details are filled in when it is claimed.
+func checkAttachment(db *gorm.DB, senderID string, body messageBody) (*models.Attachment, error) {
+	attachmentID, ok := body.Metadata["attachment_id"].(string)
+	if !ok {
+		return nil, nil
+	}
+
+	var attachment models.Attachment
+	if err := db.First(&attachment, "id = ? AND uploader_id = ? AND detached_at IS NULL", attachmentID, senderID).Error; err != nil {
+		return nil, &models.MessageValidationError{Reason: "Attachment not found"}
+	}
+
+	if attachment.Status == models.AttachmentQuarantined {
+		return nil, &models.MessageValidationError{Reason: "Attachment was quarantined because it contains malware"}
+	}
+
+	if body.Type == models.ImageMessage && !strings.HasPrefix(attachment.ContentType, "image/") {
+		return nil, &models.MessageValidationError{Reason: "Attachment is not an image"}
+	}
+	if body.Type == models.AudioMessage && !media.IsAudio(attachment.ContentType) {
+		return nil, &models.MessageValidationError{Reason: "Voice notes must be Ogg, WebM, MP4, MP3 or WAV audio"}
+	}
+	if body.Type == models.AudioMessage && attachment.Status == models.AttachmentFailed {
+		return nil, &models.MessageValidationError{Reason: "Attachment could not be processed"}
+	}
+
+	return &attachment, nil
+}
+
+// respondQuotaExceeded writes the response for a file that does not fit in a storage quota
+func respondQuotaExceeded(c *gin.Context, err *models.QuotaExceededError) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{
+		"error": err.Error(),
+		"code":  err.Code,
+		"used":  err.Used,
+		"quota": err.Quota,
+	})
+}
+
+// checkUserQuota checks that a user can store a file, writing the error response if not
+func checkUserQuota(c *gin.Context, db *gorm.DB, userID string, size int64) bool {
+	err := models.CheckUserQuota(db, userID, size)
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		respondQuotaExceeded(c, quotaErr)
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return false
+	}
+	return true
+}
+
+// refinedContentTypes are the types a file's extension may narrow a sniffed content type down to,
+// e.g. office documents are sniffed as zip files and CSV as plain text
+var refinedContentTypes = map[string][]string{
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	},
+	"text/plain":               {"text/csv", "application/json"},
+	"application/octet-stream": {"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint"},
+}
+
+// detectContentType sniffs the content type of a file, using its extension only to narrow
+// down generic types
+func detectContentType(head []byte, fileName string) string {
+	// Audio is sniffed as its container at best, e.g. Ogg as application/ogg
+	if audioType := media.SniffAudio(head); audioType != "" {
+		return audioType
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+
+	byExtension, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName))))
+	if err == nil {
+		for _, refined := range refinedContentTypes[contentType] {
+			if byExtension == refined {
+				return refined
+			}
+		}
+	}
+
+	return contentType
+}
+
+// isThumbnailSize reports whether a name is one of the generated thumbnail sizes
+func isThumbnailSize(name string) bool {
+	for _, size := range media.ThumbnailSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedAttachmentType reports whether files of a content type can be uploaded
+func isAllowedAttachmentType(contentType string) bool {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		// Other formats, such as WebP, could carry EXIF with the location the photo was taken at.
+		// SVG can carry scripts.
+		return media.CanProcess(contentType)
+	case strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"):
+		return true
+	default:
+		return allowedAttachmentTypes[contentType]
+	}
+}
+
+// sanitizeFileName strips directories and control characters from an uploaded file name
+func sanitizeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if len([]rune(name)) > 255 {
+		name = string([]rune(name)[:255])
+	}
+	return name
+}
@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/media"
+	"backend/models"
+	"backend/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxAvatarSize is the largest avatar image that can be uploaded, in bytes
+const MaxAvatarSize = 10 << 20
+
+// avatarDimensions are the widths and heights of the stored avatar sizes
+var avatarDimensions = map[string]int{
+	"small":  64,
+	"medium": 256,
+	"large":  512,
+}
+
+// AvatarController handles avatar uploads of users and groups
+type AvatarController struct {
+	db      *gorm.DB
+	storage storage.Storage
+}
+
+// NewAvatarController creates a new avatar controller
+func NewAvatarController(db *gorm.DB, store storage.Storage) *AvatarController {
+	return &AvatarController{db: db, storage: store}
+}
+
+// UploadUserAvatar replaces the avatar of the authenticated user with an uploaded image
+func (ac *AvatarController) UploadUserAvatar(c *gin.Context) {
+	userID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the authenticated user is updating their own profile
+	if authUserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only update your own profile"})
+		return
+	}
+
+	var user models.User
+	if err := ac.db.First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	avatarKey, ok := ac.storeAvatar(c, "avatars/users/"+userID)
+	if !ok {
+		return
+	}
+
+	if !ac.replaceAvatar(c, &models.User{}, userID, user.AvatarKey, &avatarKey) {
+		return
+	}
+
+	ac.db.First(&user, "id = ?", userID)
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteUserAvatar removes the avatar of the authenticated user
+func (ac *AvatarController) DeleteUserAvatar(c *gin.Context) {
+	userID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the authenticated user is updating their own profile
+	if authUserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only update your own profile"})
+		return
+	}
+
+	var user models.User
+	if err := ac.db.First(&user, "id = ?", userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !ac.replaceAvatar(c, &models.User{}, userID, user.AvatarKey, nil) {
+		return
+	}
+
+	ac.db.First(&user, "id = ?", userID)
+	c.JSON(http.StatusOK, user)
+}
+
+// UploadGroupAvatar replaces the avatar of a group with an uploaded image (admins only)
+func (ac *AvatarController) UploadGroupAvatar(c *gin.Context) {
+	group, ok := ac.loadAdministeredGroup(c)
+	if !ok {
+		return
+	}
+
+	avatarKey, ok := ac.storeAvatar(c, "avatars/groups/"+group.ID)
+	if !ok {
+		return
+	}
+
+	if !ac.replaceAvatar(c, &models.Group{}, group.ID, group.AvatarKey, &avatarKey) {
+		return
+	}
+
+	ac.db.First(group, "id = ?", group.ID)
+	c.JSON(http.StatusOK, group)
+}
+
+// DeleteGroupAvatar removes the avatar of a group (admins only)
+func (ac *AvatarController) DeleteGroupAvatar(c *gin.Context) {
+	group, ok := ac.loadAdministeredGroup(c)
+	if !ok {
+		return
+	}
+
+	if !ac.replaceAvatar(c, &models.Group{}, group.ID, group.AvatarKey, nil) {
+		return
+	}
+
+	ac.db.First(group, "id = ?", group.ID)
+	c.JSON(http.StatusOK, group)
+}
+
+// loadAdministeredGroup loads the group of the request if the authenticated user is one of its
+// admins, writing the error response otherwise
+func (ac *AvatarController) loadAdministeredGroup(c *gin.Context) (*models.Group, bool) {
+	groupID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	// Check if the group exists
+	var group models.Group
+	if err := ac.db.First(&group, "id = ?", groupID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return nil, false
+	}
+
+	// Check if the user is an admin of the group
+	if !isGroupAdmin(ac.db, groupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You must be an admin to update the group"})
+		return nil, false
+	}
+
+	return &group, true
+}
+
+// storeAvatar crops the uploaded image and stores its sizes under a new key with the given
+// prefix, writing the error response if that fails. A new key per upload lets caches keep
+// avatars until their links expire.
+func (ac *AvatarController) storeAvatar(c *gin.Context, prefix string) (string, bool) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxAvatarSize+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatars must be at most %d MB", MaxAvatarSize>>20)})
+			return "", false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return "", false
+	}
+	if fileHeader.Size > MaxAvatarSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatars must be at most %d MB", MaxAvatarSize>>20)})
+		return "", false
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return "", false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return "", false
+	}
+
+	// Detect the content type from the file itself rather than trusting the client
+	contentType := http.DetectContentType(data)
+	if !media.CanProcess(contentType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Avatars must be JPEG, PNG or GIF images"})
+		return "", false
+	}
+
+	sizes := make([]media.ThumbnailSize, 0, len(models.AvatarSizes))
+	for _, name := range models.AvatarSizes {
+		sizes = append(sizes, media.ThumbnailSize{Name: name, MaxDimension: avatarDimensions[name]})
+	}
+
+	avatars, err := media.MakeAvatar(data, contentType, sizes)
+	if err != nil {
+		if errors.Is(err, media.ErrAvatarTooSmall) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Avatars must be at least %dx%d pixels", media.MinAvatarDimension, media.MinAvatarDimension)})
+			return "", false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image"})
+		return "", false
+	}
+
+	avatarKey := prefix + "/" + uuid.New().String()
+	for _, avatar := range avatars {
+		key := models.AvatarFileKey(avatarKey, avatar.Name)
+		if err := ac.storage.Put(c.Request.Context(), key, bytes.NewReader(avatar.Data), int64(len(avatar.Data)), avatar.ContentType); err != nil {
+			log.Printf("Failed to store avatar: %v", err)
+			ac.deleteAvatarFiles(c.Request.Context(), avatarKey)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+			return "", false
+		}
+	}
+
+	return avatarKey, true
+}
+
+// replaceAvatar sets the avatar key of a user or group and deletes the files of the old avatar,
+// writing the error response if that fails
+func (ac *AvatarController) replaceAvatar(c *gin.Context, model interface{}, id string, oldKey, newKey *string) bool {
+	result := ac.db.Model(model).Where("id = ?", id).Updates(map[string]interface{}{
+		"avatar_key": newKey,
+		"updated_at": time.Now(),
+	})
+	if result.Error != nil {
+		if newKey != nil {
+			ac.deleteAvatarFiles(c.Request.Context(), *newKey)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update avatar"})
+		return false
+	}
+
+	if oldKey != nil {
+		ac.deleteAvatarFiles(c.Request.Context(), *oldKey)
+	}
+	return true
+}
+
+// deleteAvatarFiles deletes all sizes of an avatar
+func (ac *AvatarController) deleteAvatarFiles(ctx context.Context, avatarKey string) {
+	for _, size := range models.AvatarSizes {
+		key := models.AvatarFileKey(avatarKey, size)
+		if err := ac.storage.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete avatar file %s: %v", key, err)
+		}
+	}
+}
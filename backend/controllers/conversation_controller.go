@@ -0,0 +1,501 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ConversationController handles conversation-centric requests for direct chats and groups
+type ConversationController struct {
+	db       *gorm.DB
+	messages *MessageController
+}
+
+// NewConversationController creates a new conversation controller.
+// Messages are sent through the message controller so both APIs share the same send path.
+func NewConversationController(db *gorm.DB, messages *MessageController) *ConversationController {
+	return &ConversationController{db: db, messages: messages}
+}
+
+// CreateDirectConversationRequest represents the request body for opening a direct conversation
+type CreateDirectConversationRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+// SendConversationMessageRequest represents the request body for sending a message to a conversation
+type SendConversationMessageRequest struct {
+	Content         string                 `json:"content"`
+	Type            string                 `json:"type" binding:"required"`
+	Metadata        models.MessageMetadata `json:"metadata"`
+	ClientMessageID *string                `json:"client_message_id"`
+}
+
+// UpdateConversationSettingsRequest represents the request body for changing a user's conversation settings.
+// Fields that are left out keep their current value.
+type UpdateConversationSettingsRequest struct {
+	Mute       *string `json:"mute" binding:"omitempty,oneof=off 8h 1w forever"`
+	IsArchived *bool   `json:"is_archived"`
+	IsPinned   *bool   `json:"is_pinned"`
+}
+
+// ConversationSettings represents the authenticated user's settings for a conversation
+type ConversationSettings struct {
+	IsMuted      bool       `json:"is_muted"`
+	MutedUntil   *time.Time `json:"muted_until"`
+	MutedForever bool       `json:"muted_forever"`
+	IsArchived   bool       `json:"is_archived"`
+	IsPinned     bool       `json:"is_pinned"`
+}
+
+// ConversationDetails represents a conversation with the authenticated user's settings
+type ConversationDetails struct {
+	models.Conversation
+	Settings ConversationSettings `json:"settings"`
+}
+
+// ConversationsPage represents a page of conversations
+type ConversationsPage struct {
+	Items      []ConversationDetails `json:"items"`
+	NextCursor *string               `json:"next_cursor"`
+}
+
+// MessageRange represents the messages of a conversation in a range of sequence numbers.
+// Numbers in the range with neither are not used yet, or belong to messages deleted
+// longer ago than the tombstone retention.
+type MessageRange struct {
+	Messages []models.Message          `json:"messages"`
+	Deleted  []models.MessageTombstone `json:"deleted"`
+	LastSeq  int64                     `json:"last_seq"`
+}
+
+// maxMessageRange is the largest number of sequence numbers fetched at once
+const maxMessageRange = 500
+
+// conversationActivity orders conversations by their latest message, or by creation when they have none
+const conversationActivity = "COALESCE(conversations.last_message_at, conversations.created_at)"
+
+// GetConversations lists the conversations of the authenticated user, most recently active first.
+// Paginated with cursor and limit.
+func (cc *ConversationController) GetConversations(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	limit := parseLimit(c.Query("limit"), 30, 100)
+
+	query := cc.db.
+		Preload("Participants.User").
+		Preload("LastMessage.Sender").
+		Preload("Group").
+		Where("conversations.id IN (SELECT conversation_id FROM conversation_participants WHERE user_id = ?)", userID)
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		cursor, err := decodeCursor(cursorParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.Where(fmt.Sprintf("(%s, conversations.id) < (?, ?)", conversationActivity), cursor.Time, cursor.ID)
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	var conversations []models.Conversation
+	result := query.
+		Order(fmt.Sprintf("%s DESC, conversations.id DESC", conversationActivity)).
+		Limit(limit + 1).
+		Find(&conversations)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversations"})
+		return
+	}
+
+	page := ConversationsPage{}
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		last := conversations[limit-1]
+		activity := last.CreatedAt
+		if last.LastMessageAt != nil {
+			activity = *last.LastMessageAt
+		}
+		next := encodeCursor(activity, last.ID)
+		page.NextCursor = &next
+	}
+
+	items, err := cc.withSettings(userID.(string), conversations)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversations"})
+		return
+	}
+	page.Items = items
+
+	c.JSON(http.StatusOK, page)
+}
+
+// GetConversation gets a conversation with its participants and the authenticated user's settings
+func (cc *ConversationController) GetConversation(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conversation, ok := cc.loadConversation(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	items, err := cc.withSettings(userID.(string), []models.Conversation{*conversation})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items[0])
+}
+
+// CreateDirectConversation gets or creates the direct conversation between the authenticated user and another user
+func (cc *ConversationController) CreateDirectConversation(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req CreateDirectConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if the other user exists
+	var user models.User
+	result := cc.db.First(&user, "id = ?", req.UserID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	conversation, err := models.EnsureDirectConversation(cc.db, userID.(string), req.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+
+	conversation, ok := cc.loadConversation(c, conversation.ID, userID.(string))
+	if !ok {
+		return
+	}
+
+	items, err := cc.withSettings(userID.(string), []models.Conversation{*conversation})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items[0])
+}
+
+// GetConversationMessages gets the messages of a conversation.
+// Supports limit/offset pagination, or cursor pagination when a "before" or "after" query parameter is present.
+func (cc *ConversationController) GetConversationMessages(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conversation, ok := cc.loadConversation(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	// Get pagination parameters
+	limit := 50
+	offset := 0
+	if limitParam := c.Query("limit"); limitParam != "" {
+		if _, err := fmt.Sscanf(limitParam, "%d", &limit); err != nil {
+			limit = 50
+		}
+	}
+	if offsetParam := c.Query("offset"); offsetParam != "" {
+		if _, err := fmt.Sscanf(offsetParam, "%d", &offset); err != nil {
+			offset = 0
+		}
+	}
+
+	query := cc.db.Preload("Sender").Where("conversation_id = ?", conversation.ID)
+
+	if isCursorRequest(c) {
+		respondMessagePage(c, cc.db, query, limit)
+		return
+	}
+
+	var messages []models.Message
+	result := query.Order("seq DESC").Limit(limit).Offset(offset).Find(&messages)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	// Load the polls of poll messages
+	if err := attachPolls(cc.db, userID.(string), messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, messages)
+}
+
+// GetConversationMessageRange gets the messages of a conversation with sequence numbers from
+// "from" to "to" (inclusive), oldest first, so clients that noticed a gap can fetch what they
+// missed. Deleted messages in the range are returned as tombstones.
+func (cc *ConversationController) GetConversationMessageRange(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	from, err := strconv.ParseInt(c.Query("from"), 10, 64)
+	if err != nil || from < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from sequence number"})
+		return
+	}
+	to, err := strconv.ParseInt(c.Query("to"), 10, 64)
+	if err != nil || to < from {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to sequence number"})
+		return
+	}
+	if to-from >= maxMessageRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d messages can be fetched at once", maxMessageRange)})
+		return
+	}
+
+	conversation, ok := cc.loadConversation(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	response := MessageRange{
+		Messages: []models.Message{},
+		Deleted:  []models.MessageTombstone{},
+		LastSeq:  conversation.LastSeq,
+	}
+
+	result := cc.db.Preload("Sender").
+		Where("conversation_id = ? AND seq BETWEEN ? AND ?", conversation.ID, from, to).
+		Order("seq ASC").
+		Find(&response.Messages)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	// Load the polls of poll messages
+	if err := attachPolls(cc.db, userID.(string), response.Messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	result = cc.db.
+		Where("conversation_id = ? AND seq BETWEEN ? AND ?", conversation.ID, from, to).
+		Order("seq ASC").
+		Find(&response.Deleted)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// SendConversationMessage sends a message to a conversation
+func (cc *ConversationController) SendConversationMessage(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req SendConversationMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conversation, ok := cc.loadConversation(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	key, ok := idempotencyKey(c, req.ClientMessageID)
+	if !ok {
+		return
+	}
+
+	body := messageBody{Content: req.Content, Type: models.MessageType(req.Type), Metadata: req.Metadata}
+
+	var message *models.Message
+	var replayed bool
+	var err error
+	if conversation.Type == models.GroupConversation {
+		message, replayed, err = cc.messages.createGroupMessage(userID.(string), *conversation.GroupID, body, key)
+	} else {
+		message, replayed, err = cc.messages.createDirectMessage(userID.(string), directPeer(conversation, userID.(string)), body, key)
+	}
+	if err != nil {
+		respondSendError(c, err)
+		return
+	}
+
+	// Clients publish sent messages to MQTT themselves, as with the direct and group routes
+
+	respondSentMessage(c, message, replayed)
+}
+
+// UpdateConversationSettings mutes, archives or pins a conversation for the authenticated user
+func (cc *ConversationController) UpdateConversationSettings(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req UpdateConversationSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conversation, ok := cc.loadConversation(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	// Load the current settings, if any
+	now := time.Now()
+	preference := models.ChatPreference{UserID: userID.(string), ChatKey: conversation.Key, CreatedAt: now}
+	result := cc.db.Where("user_id = ? AND chat_key = ?", userID, conversation.Key).Limit(1).Find(&preference)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update conversation settings"})
+		return
+	}
+
+	if req.Mute != nil {
+		preference.Mute(models.MuteDuration(*req.Mute), now)
+	}
+	if req.IsArchived != nil {
+		preference.IsArchived = *req.IsArchived
+	}
+	if req.IsPinned != nil && *req.IsPinned != preference.IsPinned {
+		preference.IsPinned = *req.IsPinned
+		preference.PinnedAt = nil
+		if preference.IsPinned {
+			preference.PinnedAt = &now
+		}
+	}
+	preference.UpdatedAt = now
+
+	if err := cc.db.Save(&preference).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update conversation settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationSettings(&preference, now))
+}
+
+// loadConversation loads a conversation the user takes part in, writing the error response if there is none
+func (cc *ConversationController) loadConversation(c *gin.Context, conversationID, userID string) (*models.Conversation, bool) {
+	var conversation models.Conversation
+	result := cc.db.
+		Preload("Participants.User").
+		Preload("LastMessage.Sender").
+		Preload("Group").
+		First(&conversation, "id = ?", conversationID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return nil, false
+	}
+
+	for _, participant := range conversation.Participants {
+		if participant.UserID == userID {
+			return &conversation, true
+		}
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{"error": "You are not a participant of this conversation"})
+	return nil, false
+}
+
+// withSettings attaches the user's settings to each conversation
+func (cc *ConversationController) withSettings(userID string, conversations []models.Conversation) ([]ConversationDetails, error) {
+	items := make([]ConversationDetails, 0, len(conversations))
+	if len(conversations) == 0 {
+		return items, nil
+	}
+
+	keys := make([]string, len(conversations))
+	for i, conversation := range conversations {
+		keys[i] = conversation.Key
+	}
+
+	var preferences []models.ChatPreference
+	if err := cc.db.Where("user_id = ? AND chat_key IN ?", userID, keys).Find(&preferences).Error; err != nil {
+		return nil, err
+	}
+	preferenceMap := make(map[string]models.ChatPreference)
+	for _, p := range preferences {
+		preferenceMap[p.ChatKey] = p
+	}
+
+	now := time.Now()
+	for _, conversation := range conversations {
+		item := ConversationDetails{Conversation: conversation}
+		if p, ok := preferenceMap[conversation.Key]; ok {
+			item.Settings = newConversationSettings(&p, now)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// newConversationSettings builds the settings shown to a user from their chat preference
+func newConversationSettings(p *models.ChatPreference, now time.Time) ConversationSettings {
+	return ConversationSettings{
+		IsMuted:      p.IsMuted(now),
+		MutedUntil:   p.MutedUntil,
+		MutedForever: p.MutedForever,
+		IsArchived:   p.IsArchived,
+		IsPinned:     p.IsPinned,
+	}
+}
+
+// directPeer gets the other participant of a direct conversation; a conversation with oneself has only one participant
+func directPeer(conversation *models.Conversation, userID string) string {
+	for _, participant := range conversation.Participants {
+		if participant.UserID != userID {
+			return participant.UserID
+		}
+	}
+	return userID
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor points at a row in a list ordered by time and then by ID
+type Cursor struct {
+	Time time.Time
+	ID   string
+}
+
+// errInvalidCursor is returned when a cursor cannot be decoded
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor encodes a cursor into an opaque string for clients
+func encodeCursor(t time.Time, id string) string {
+	raw := fmt.Sprintf("%d|%s", t.UnixNano(), id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor decodes an opaque cursor string produced by encodeCursor
+func decodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	return &Cursor{Time: time.Unix(0, nanos), ID: parts[1]}, nil
+}
+
+// encodeSeqCursor encodes a cursor pointing at a message by its sequence number in its conversation
+func encodeSeqCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("seq|" + strconv.FormatInt(seq, 10)))
+}
+
+// decodeSeqCursor decodes a cursor produced by encodeSeqCursor
+func decodeSeqCursor(s string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+
+	value, ok := strings.CutPrefix(string(raw), "seq|")
+	if !ok {
+		return 0, errInvalidCursor
+	}
+
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+
+	return seq, nil
+}
+
+// parseLimit parses a page size query parameter, falling back to a default and capping at a maximum
+func parseLimit(param string, defaultLimit, maxLimit int) int {
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit <= 0 {
+		return defaultLimit
+	}
+	if limit > maxLimit {
+		return maxLimit
+	}
+	return limit
+}
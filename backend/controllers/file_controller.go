@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"backend/storage"
+	"backend/urlsign"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FileController serves stored files for signed URLs, without authentication.
+// Attachments are served by the AttachmentController, which also checks access.
+type FileController struct {
+	storage storage.Storage
+	signer  *urlsign.Signer
+}
+
+// NewFileController creates a new file controller
+func NewFileController(store storage.Storage, signer *urlsign.Signer) *FileController {
+	return &FileController{storage: store, signer: signer}
+}
+
+// ServeSignedAvatar streams an avatar image for a signed URL. Avatars are visible to every
+// user, and a new avatar gets a new key, so they can be cached until the link expires.
+func (fc *FileController) ServeSignedAvatar(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if err := fc.signer.Verify(c.Request.URL.Path, query, time.Now()); err != nil {
+		if errors.Is(err, urlsign.ErrExpired) {
+			c.JSON(http.StatusGone, gin.H{"error": "Link has expired"})
+			return
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid link"})
+		return
+	}
+
+	key := "avatars/" + strings.TrimPrefix(c.Param("key"), "/")
+	reader, info, err := fc.storage.Get(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+			return
+		}
+		log.Printf("Failed to open avatar: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read avatar"})
+		return
+	}
+	defer reader.Close()
+
+	// Local storage does not keep content types, so fall back to the extension
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	maxAge := urlsign.Remaining(query, time.Now())
+	c.DataFromReader(http.StatusOK, info.Size, contentType, reader, map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())),
+	})
+}
+
+// AvatarURL signs the URL of a stored avatar file
+func (fc *FileController) AvatarURL(key string) string {
+	signed, _ := fc.signer.Sign("/files/"+key, nil, time.Now())
+	return signed
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"log"
 	"net/http"
 	"time"
 
@@ -122,6 +123,13 @@ func (gc *GroupController) CreateGroup(c *gin.Context) {
 		}
 	}
 
+	// Create the group's conversation with its initial members
+	if _, err := models.EnsureGroupConversation(tx, groupID); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group conversation"})
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit().Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
@@ -175,10 +183,15 @@ func (gc *GroupController) GetGroup(c *gin.Context) {
 	gc.db.Preload("User").Where("group_id = ?", groupID).Find(&groupUsers)
 	group.Members = groupUsers
 
+	// Load pinned messages
+	group.PinnedMessages, _ = loadPinnedMessages(gc.db, models.GroupChatKey(groupID))
+
 	c.JSON(http.StatusOK, group)
 }
 
-// UpdateGroupRequest represents the request body for updating a group
+// UpdateGroupRequest represents the request body for updating a group.
+// Avatars are uploaded through UploadGroupAvatar; an avatar_url is accepted only
+// when it is null or the current avatar, as sent back by clients updating other fields.
 type UpdateGroupRequest struct {
 	Name        *string `json:"name"`
 	Description *string `json:"description"`
@@ -223,6 +236,11 @@ func (gc *GroupController) UpdateGroup(c *gin.Context) {
 		return
 	}
 
+	if req.AvatarURL != nil && !models.IsCurrentAvatarURL(group.AvatarKey, *req.AvatarURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatars can only be changed by uploading an image"})
+		return
+	}
+
 	// Update group fields if provided
 	if req.Name != nil {
 		group.Name = *req.Name
@@ -232,10 +250,6 @@ func (gc *GroupController) UpdateGroup(c *gin.Context) {
 		group.Description = req.Description
 	}
 
-	if req.AvatarURL != nil {
-		group.AvatarURL = req.AvatarURL
-	}
-
 	// Update timestamp
 	group.UpdatedAt = time.Now()
 
@@ -333,6 +347,12 @@ func (gc *GroupController) AddMember(c *gin.Context) {
 		return
 	}
 
+	// Add user to the group's conversation
+	if err := models.AddConversationParticipant(gc.db, groupID, req.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add user to group"})
+		return
+	}
+
 	// Send system message to group
 	systemMessage := models.Message{
 		ID:        uuid.New().String(),
@@ -401,11 +421,16 @@ func (gc *GroupController) RemoveMember(c *gin.Context) {
 	}
 
 	// Remove user from group
-	result = gc.db.Delete(&groupUser)
-	if result.Error != nil {
+	endedLocations, err := models.RemoveGroupMember(gc.db, groupID, userID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove user from group"})
 		return
 	}
+	for i := range endedLocations {
+		if err := gc.mqttClient.PublishMessageUpdated(&endedLocations[i]); err != nil {
+			log.Printf("Failed to publish message update to MQTT: %v", err)
+		}
+	}
 
 	// Get user details for system message
 	var user models.User
@@ -459,15 +484,8 @@ func (gc *GroupController) DeleteGroup(c *gin.Context) {
 		return
 	}
 
-	// Delete all group users (memberships)
-	gc.db.Where("group_id = ?", groupID).Delete(&models.GroupUser{})
-
-	// Delete all group messages
-	gc.db.Where("group_id = ?", groupID).Delete(&models.Message{})
-
-	// Delete the group itself
-	result = gc.db.Delete(&group)
-	if result.Error != nil {
+	// Delete the group with its messages and memberships
+	if err := models.DeleteGroup(gc.db, groupID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
 		return
 	}
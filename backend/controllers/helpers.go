@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"log"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// isGroupMember checks if a user is a member of a group
+func isGroupMember(db *gorm.DB, groupID, userID string) bool {
+	var groupUser models.GroupUser
+	result := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&groupUser)
+	return result.Error == nil
+}
+
+// isGroupAdmin checks if a user is an admin of a group
+func isGroupAdmin(db *gorm.DB, groupID, userID string) bool {
+	var groupUser models.GroupUser
+	result := db.Where("group_id = ? AND user_id = ? AND is_admin = ?", groupID, userID, true).First(&groupUser)
+	return result.Error == nil
+}
+
+// canAccessMessage checks if a user is a participant of the chat a message belongs to
+func canAccessMessage(db *gorm.DB, message *models.Message, userID string) bool {
+	if message.GroupID != nil {
+		return isGroupMember(db, *message.GroupID, userID)
+	}
+	if message.SenderID == userID {
+		return true
+	}
+	return message.ReceiverID != nil && *message.ReceiverID == userID
+}
+
+// sendSystemMessage saves a system message to a direct chat (receiverID) or a group (groupID) and publishes it
+func sendSystemMessage(db *gorm.DB, mqttClient *mqtt.MQTTClient, senderID string, receiverID, groupID *string, content string) {
+	now := time.Now()
+	systemMessage := models.Message{
+		ID:         uuid.New().String(),
+		SenderID:   senderID,
+		ReceiverID: receiverID,
+		GroupID:    groupID,
+		Content:    content,
+		Type:       models.SystemMessage,
+		Timestamp:  now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	if err := db.Create(&systemMessage).Error; err != nil {
+		log.Printf("Failed to save system message: %v", err)
+		return
+	}
+
+	var err error
+	if groupID != nil {
+		err = mqttClient.PublishGroupMessage(&systemMessage)
+	} else {
+		err = mqttClient.PublishDirectMessage(&systemMessage)
+	}
+	if err != nil {
+		log.Printf("Failed to publish message to MQTT: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// InboxController handles the combined list of a user's direct chats and groups
+type InboxController struct {
+	db *gorm.DB
+}
+
+// NewInboxController creates a new inbox controller
+func NewInboxController(db *gorm.DB) *InboxController {
+	return &InboxController{db: db}
+}
+
+// InboxItem represents one direct chat or group in a user's inbox
+type InboxItem struct {
+	ChatKey        string          `json:"chat_key"`
+	Type           string          `json:"type"`
+	User           *models.User    `json:"user,omitempty"`
+	Group          *models.Group   `json:"group,omitempty"`
+	LastMessage    *models.Message `json:"last_message"`
+	LastActivityAt time.Time       `json:"last_activity_at"`
+	UnreadCount    int64           `json:"unread_count"`
+	MentionCount   int64           `json:"mention_count"`
+	IsMuted        bool            `json:"is_muted"`
+	MutedUntil     *time.Time      `json:"muted_until"`
+	IsArchived     bool            `json:"is_archived"`
+	IsPinned       bool            `json:"is_pinned"`
+}
+
+// InboxPage represents a page of the inbox
+type InboxPage struct {
+	Items      []InboxItem `json:"items"`
+	NextCursor *string     `json:"next_cursor"`
+}
+
+// inboxRow is a chat in the inbox as returned by the inbox query
+type inboxRow struct {
+	ChatKey       string
+	Kind          string
+	TargetID      string
+	LastMessageID *string
+	LastActivity  time.Time
+	Pinned        int
+}
+
+// inboxQuery lists the user's conversations with their latest message. Direct conversations
+// only show up once they have messages; groups show up from the moment the user joined.
+const inboxQuery = `
+	SELECT c.chat_key, c.kind, c.target_id, c.last_message_id, c.last_activity,
+		CASE WHEN COALESCE(p.is_pinned, false) THEN 1 ELSE 0 END AS pinned
+	FROM (
+		SELECT conv.key AS chat_key, conv.type AS kind,
+			COALESCE(conv.group_id, peer.user_id, me.user_id) AS target_id,
+			conv.last_message_id, COALESCE(conv.last_message_at, me.joined_at) AS last_activity
+		FROM conversation_participants me
+		JOIN conversations conv ON conv.id = me.conversation_id
+		LEFT JOIN conversation_participants peer ON conv.type = 'direct'
+			AND peer.conversation_id = conv.id AND peer.user_id <> me.user_id
+		WHERE me.user_id = @user AND (conv.type = 'group' OR conv.last_message_id IS NOT NULL)
+	) c
+	LEFT JOIN chat_preferences p ON p.chat_key = c.chat_key AND p.user_id = @user
+	WHERE %s
+	ORDER BY pinned DESC, c.last_activity DESC, c.chat_key DESC
+	LIMIT @limit`
+
+// GetInbox lists the authenticated user's direct chats and groups with the last message,
+// unread and mention counts and per-user flags. Pinned chats come first, then the most
+// recently active. Archived chats are hidden unless "archived" is "true" (only archived)
+// or "all". Paginated with cursor and limit.
+func (ic *InboxController) GetInbox(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := authUserID.(string)
+
+	limit := parseLimit(c.Query("limit"), 30, 100)
+	args := map[string]interface{}{"user": userID, "limit": limit + 1}
+
+	var conditions []string
+	switch c.DefaultQuery("archived", "false") {
+	case "true":
+		conditions = append(conditions, "COALESCE(p.is_archived, false)")
+	case "all":
+	default:
+		conditions = append(conditions, "NOT COALESCE(p.is_archived, false)")
+	}
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		pinned, activity, chatKey, err := decodeInboxCursor(cursorParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		conditions = append(conditions,
+			"(CASE WHEN COALESCE(p.is_pinned, false) THEN 1 ELSE 0 END, c.last_activity, c.chat_key) < (@cursor_pinned, @cursor_activity, @cursor_key)")
+		args["cursor_pinned"] = pinned
+		args["cursor_activity"] = activity
+		args["cursor_key"] = chatKey
+	}
+
+	where := "true"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	var rows []inboxRow
+	if err := ic.db.Raw(fmt.Sprintf(inboxQuery, where), args).Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get inbox"})
+		return
+	}
+
+	page := InboxPage{Items: []InboxItem{}}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[limit-1]
+		next := encodeInboxCursor(last)
+		page.NextCursor = &next
+	}
+
+	items, err := ic.buildItems(userID, rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get inbox"})
+		return
+	}
+	page.Items = items
+
+	c.JSON(http.StatusOK, page)
+}
+
+// buildItems loads everything shown for a page of inbox rows using one query per kind of data
+func (ic *InboxController) buildItems(userID string, rows []inboxRow) ([]InboxItem, error) {
+	items := make([]InboxItem, 0, len(rows))
+	if len(rows) == 0 {
+		return items, nil
+	}
+
+	var peerIDs, groupIDs, messageIDs, chatKeys []string
+	for _, row := range rows {
+		if row.Kind == "group" {
+			groupIDs = append(groupIDs, row.TargetID)
+		} else {
+			peerIDs = append(peerIDs, row.TargetID)
+		}
+		if row.LastMessageID != nil {
+			messageIDs = append(messageIDs, *row.LastMessageID)
+		}
+		chatKeys = append(chatKeys, row.ChatKey)
+	}
+
+	// Peers of direct chats
+	users := make(map[string]models.User)
+	if len(peerIDs) > 0 {
+		var list []models.User
+		if err := ic.db.Where("id IN ?", peerIDs).Find(&list).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range list {
+			users[u.ID] = u
+		}
+	}
+
+	// Groups
+	groups := make(map[string]models.Group)
+	if len(groupIDs) > 0 {
+		var list []models.Group
+		if err := ic.db.Where("id IN ?", groupIDs).Find(&list).Error; err != nil {
+			return nil, err
+		}
+		for _, g := range list {
+			groups[g.ID] = g
+		}
+	}
+
+	// Last messages
+	messages := make(map[string]models.Message)
+	if len(messageIDs) > 0 {
+		var list []models.Message
+		if err := ic.db.Preload("Sender").Where("id IN ?", messageIDs).Find(&list).Error; err != nil {
+			return nil, err
+		}
+		for _, m := range list {
+			messages[m.ID] = m
+		}
+	}
+
+	// Per-user flags
+	preferences := make(map[string]models.ChatPreference)
+	var prefList []models.ChatPreference
+	if err := ic.db.Where("user_id = ? AND chat_key IN ?", userID, chatKeys).Find(&prefList).Error; err != nil {
+		return nil, err
+	}
+	for _, p := range prefList {
+		preferences[p.ChatKey] = p
+	}
+
+	type keyCount struct {
+		Key   string
+		Count int64
+	}
+
+	// Unread direct messages per peer
+	directUnread := make(map[string]int64)
+	if len(peerIDs) > 0 {
+		var counts []keyCount
+		err := ic.db.Model(&models.Message{}).
+			Select("sender_id AS key, COUNT(*) AS count").
+			Where("receiver_id = ? AND is_read = ? AND sender_id IN ?", userID, false, peerIDs).
+			Group("sender_id").
+			Scan(&counts).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, kc := range counts {
+			directUnread[kc.Key] = kc.Count
+		}
+	}
+
+	// Unread group messages after each group's read pointer, and unread mentions per group
+	groupUnread := make(map[string]int64)
+	mentionCounts := make(map[string]int64)
+	if len(groupIDs) > 0 {
+		var counts []keyCount
+		err := ic.db.Raw(`
+			SELECT m.group_id AS key, COUNT(*) AS count
+			FROM messages m
+			LEFT JOIN read_states rs ON rs.chat_key = 'group:' || m.group_id AND rs.user_id = ?
+			WHERE m.group_id IN ? AND m.sender_id <> ?
+				AND (rs.user_id IS NULL OR m.seq > rs.last_read_seq)
+			GROUP BY m.group_id`, userID, groupIDs, userID).
+			Scan(&counts).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, kc := range counts {
+			groupUnread[kc.Key] = kc.Count
+		}
+
+		counts = nil
+		err = ic.db.Model(&models.Mention{}).
+			Select("group_id AS key, COUNT(*) AS count").
+			Where("user_id = ? AND is_read = ? AND group_id IN ?", userID, false, groupIDs).
+			Group("group_id").
+			Scan(&counts).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, kc := range counts {
+			mentionCounts[kc.Key] = kc.Count
+		}
+	}
+
+	now := time.Now()
+	for _, row := range rows {
+		item := InboxItem{
+			ChatKey:        row.ChatKey,
+			Type:           row.Kind,
+			LastActivityAt: row.LastActivity,
+		}
+
+		if row.Kind == "group" {
+			group, ok := groups[row.TargetID]
+			if !ok {
+				continue
+			}
+			item.Group = &group
+			item.UnreadCount = groupUnread[row.TargetID]
+			item.MentionCount = mentionCounts[row.TargetID]
+		} else {
+			user, ok := users[row.TargetID]
+			if !ok {
+				continue
+			}
+			item.User = &user
+			item.UnreadCount = directUnread[row.TargetID]
+		}
+
+		if row.LastMessageID != nil {
+			if m, ok := messages[*row.LastMessageID]; ok {
+				item.LastMessage = &m
+			}
+		}
+
+		if p, ok := preferences[row.ChatKey]; ok {
+			item.IsMuted = p.IsMuted(now)
+			item.MutedUntil = p.MutedUntil
+			item.IsArchived = p.IsArchived
+			item.IsPinned = p.IsPinned
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// encodeInboxCursor encodes the position after an inbox row
+func encodeInboxCursor(row inboxRow) string {
+	return encodeCursor(row.LastActivity, strconv.Itoa(row.Pinned)+"|"+row.ChatKey)
+}
+
+// decodeInboxCursor decodes a cursor produced by encodeInboxCursor
+func decodeInboxCursor(s string) (int, time.Time, string, error) {
+	cursor, err := decodeCursor(s)
+	if err != nil {
+		return 0, time.Time{}, "", err
+	}
+
+	parts := strings.SplitN(cursor.ID, "|", 2)
+	if len(parts) != 2 {
+		return 0, time.Time{}, "", errInvalidCursor
+	}
+
+	pinned, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, time.Time{}, "", errInvalidCursor
+	}
+
+	return pinned, cursor.Time, parts[1], nil
+}
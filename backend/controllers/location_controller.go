@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// LocationController handles live location sharing
+type LocationController struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+}
+
+// NewLocationController creates a new location controller
+func NewLocationController(db *gorm.DB, mqttClient *mqtt.MQTTClient) *LocationController {
+	return &LocationController{db: db, mqttClient: mqttClient}
+}
+
+// UpdateLiveLocation posts a new position to a live location message of the authenticated user.
+// Participants of the chat receive it as an event; only the latest position is kept.
+func (lc *LocationController) UpdateLiveLocation(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var position models.MessageMetadata
+	if err := c.ShouldBindJSON(&position); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.LiveLocationUpdateSchema.Validate(position); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, ok := lc.loadOwnLocation(c, userID.(string))
+	if !ok {
+		return
+	}
+
+	updated, err := models.UpdateLiveLocation(lc.db, message.ID, position)
+	if errors.Is(err, models.ErrLiveLocationEnded) {
+		c.JSON(http.StatusGone, gin.H{"error": "Live location sharing has ended"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update live location"})
+		return
+	}
+
+	if err := lc.mqttClient.PublishLocationUpdated(updated); err != nil {
+		log.Printf("Failed to publish location update to MQTT: %v", err)
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// StopLiveLocation stops sharing a live location of the authenticated user before it expires
+func (lc *LocationController) StopLiveLocation(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	message, ok := lc.loadOwnLocation(c, userID.(string))
+	if !ok {
+		return
+	}
+
+	ended, err := models.EndLiveLocation(lc.db, message.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop live location"})
+		return
+	}
+	if ended == nil {
+		c.JSON(http.StatusGone, gin.H{"error": "Live location sharing has ended"})
+		return
+	}
+
+	if err := lc.mqttClient.PublishMessageUpdated(ended); err != nil {
+		log.Printf("Failed to publish message update to MQTT: %v", err)
+	}
+
+	c.JSON(http.StatusOK, ended)
+}
+
+// loadOwnLocation loads the location message of the request if the user sent it, writing
+// the error response otherwise
+func (lc *LocationController) loadOwnLocation(c *gin.Context, userID string) (*models.Message, bool) {
+	// Check if the message exists
+	var message models.Message
+	if err := lc.db.First(&message, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, false
+	}
+
+	// Senders who left the group can no longer share their location in it
+	if !canAccessMessage(lc.db, &message, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a participant of this chat"})
+		return nil, false
+	}
+
+	// Only the sender shares their location
+	if message.SenderID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can update a live location"})
+		return nil, false
+	}
+
+	if message.Type != models.LocationMessage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message is not a location"})
+		return nil, false
+	}
+
+	return &message, true
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// mentionPattern matches @username tokens that are not part of a longer word (e.g. an email address)
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([\w.\-]+)`)
+
+// MentionController handles the mentions feed of users
+type MentionController struct {
+	db *gorm.DB
+}
+
+// NewMentionController creates a new mention controller
+func NewMentionController(db *gorm.DB) *MentionController {
+	return &MentionController{db: db}
+}
+
+// MentionsPage represents a page of mentions
+type MentionsPage struct {
+	Items      []models.Mention `json:"items"`
+	NextCursor *string          `json:"next_cursor"`
+}
+
+// MarkMentionsAsReadRequest represents the request body for marking mentions as read.
+// Either specific messages or a whole group can be marked; with neither, all mentions are marked.
+type MarkMentionsAsReadRequest struct {
+	MessageIDs []string `json:"message_ids"`
+	GroupID    *string  `json:"group_id"`
+}
+
+// GetMentions lists the mentions of the authenticated user, newest first.
+// Supports "unread=true" and "group_id" filters and cursor pagination.
+func (mc *MentionController) GetMentions(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	limit := parseLimit(c.Query("limit"), 50, 100)
+
+	query := mc.db.Preload("Message.Sender").Preload("MentionedBy").Where("user_id = ?", userID)
+
+	if c.Query("unread") == "true" {
+		query = query.Where("is_read = ?", false)
+	}
+
+	if groupID := c.Query("group_id"); groupID != "" {
+		query = query.Where("group_id = ?", groupID)
+	}
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		cursor, err := decodeCursor(cursorParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.Where("(created_at, id) < (?, ?)", cursor.Time, cursor.ID)
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	var mentions []models.Mention
+	result := query.Order("created_at DESC, id DESC").Limit(limit + 1).Find(&mentions)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get mentions"})
+		return
+	}
+
+	page := MentionsPage{Items: mentions}
+	if len(mentions) > limit {
+		page.Items = mentions[:limit]
+		last := page.Items[limit-1]
+		next := encodeCursor(last.CreatedAt, last.ID)
+		page.NextCursor = &next
+	}
+	if page.Items == nil {
+		page.Items = []models.Mention{}
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// GetUnreadMentionCounts gets the number of unread mentions of the authenticated user, in total and per group
+func (mc *MentionController) GetUnreadMentionCounts(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	type groupCount struct {
+		GroupID string
+		Count   int64
+	}
+	var counts []groupCount
+
+	result := mc.db.Model(&models.Mention{}).
+		Select("group_id, COUNT(*) AS count").
+		Where("user_id = ? AND is_read = ?", userID, false).
+		Group("group_id").
+		Scan(&counts)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count mentions"})
+		return
+	}
+
+	var total int64
+	groups := make(map[string]int64)
+	for _, gc := range counts {
+		groups[gc.GroupID] = gc.Count
+		total += gc.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"unread_count": total, "groups": groups})
+}
+
+// MarkMentionsAsRead marks mentions of the authenticated user as read
+func (mc *MentionController) MarkMentionsAsRead(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req MarkMentionsAsReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := mc.db.Model(&models.Mention{}).Where("user_id = ? AND is_read = ?", userID, false)
+	if len(req.MessageIDs) > 0 {
+		query = query.Where("message_id IN ?", req.MessageIDs)
+	}
+	if req.GroupID != nil {
+		query = query.Where("group_id = ?", *req.GroupID)
+	}
+
+	result := query.Update("is_read", true)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark mentions as read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"updated": result.RowsAffected})
+}
+
+// parseMentions extracts the mentioned usernames (lowercased) from message content
+// and reports whether @all was used
+func parseMentions(content string) (map[string]bool, bool) {
+	usernames := make(map[string]bool)
+	all := false
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// Allow punctuation right after a mention, e.g. "thanks @bob."
+		username := strings.ToLower(strings.TrimRight(match[1], ".-"))
+		if username == "" {
+			continue
+		}
+		if username == "all" {
+			all = true
+			continue
+		}
+		usernames[username] = true
+	}
+
+	return usernames, all
+}
+
+// recordMentions stores the mentions in a group message and notifies each mentioned member.
+// Mention notifications are always delivered, even to members who muted the group.
+func recordMentions(db *gorm.DB, mqttClient *mqtt.MQTTClient, message *models.Message) {
+	if message.GroupID == nil || message.Type == models.SystemMessage {
+		return
+	}
+
+	usernames, all := parseMentions(message.Content)
+	if len(usernames) == 0 && !all {
+		return
+	}
+
+	// Resolve mentions against the group's members
+	type member struct {
+		UserID   string
+		Username string
+	}
+	var members []member
+	result := db.Model(&models.GroupUser{}).
+		Select("group_users.user_id, users.username").
+		Joins("JOIN users ON users.id = group_users.user_id").
+		Where("group_users.group_id = ?", *message.GroupID).
+		Scan(&members)
+	if result.Error != nil {
+		log.Printf("Failed to load group members for mentions: %v", result.Error)
+		return
+	}
+
+	now := time.Now()
+	var mentions []models.Mention
+	for _, m := range members {
+		if m.UserID == message.SenderID {
+			continue
+		}
+
+		named := usernames[strings.ToLower(m.Username)]
+		if !named && !all {
+			continue
+		}
+
+		mentions = append(mentions, models.Mention{
+			ID:            uuid.New().String(),
+			MessageID:     message.ID,
+			UserID:        m.UserID,
+			GroupID:       *message.GroupID,
+			MentionedByID: message.SenderID,
+			IsAll:         !named,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+	}
+
+	if len(mentions) == 0 {
+		return
+	}
+
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&mentions).Error; err != nil {
+		log.Printf("Failed to save mentions: %v", err)
+		return
+	}
+
+	for _, mention := range mentions {
+		if err := mqttClient.PublishMention(mention.UserID, message); err != nil {
+			log.Printf("Failed to publish mention to MQTT: %v", err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -11,34 +13,51 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // MessageController handles message-related requests
 type MessageController struct {
 	db         *gorm.DB
 	mqttClient *mqtt.MQTTClient
+	// notifyRecipients queues a new message to notify its recipients of
+	notifyRecipients func(message *models.Message)
+	// previewLinks queues a new message to get the preview of a link in it attached
+	previewLinks func(message *models.Message)
 }
 
 // NewMessageController creates a new message controller
-func NewMessageController(db *gorm.DB, mqttClient *mqtt.MQTTClient) *MessageController {
-	return &MessageController{db: db, mqttClient: mqttClient}
+func NewMessageController(db *gorm.DB, mqttClient *mqtt.MQTTClient, notifyRecipients, previewLinks func(message *models.Message)) *MessageController {
+	return &MessageController{db: db, mqttClient: mqttClient, notifyRecipients: notifyRecipients, previewLinks: previewLinks}
 }
 
 // SendDirectMessageRequest represents the request body for sending a direct message
 type SendDirectMessageRequest struct {
-	ReceiverID string `json:"receiver_id" binding:"required"`
-	Content    string `json:"content" binding:"required"`
-	Type       string `json:"type" binding:"required"`
+	ReceiverID      string                 `json:"receiver_id" binding:"required"`
+	Content         string                 `json:"content"`
+	Type            string                 `json:"type" binding:"required"`
+	Metadata        models.MessageMetadata `json:"metadata"`
+	ClientMessageID *string                `json:"client_message_id"`
 }
 
 // SendGroupMessageRequest represents the request body for sending a group message
 type SendGroupMessageRequest struct {
-	GroupID string `json:"group_id" binding:"required"`
-	Content string `json:"content" binding:"required"`
-	Type    string `json:"type" binding:"required"`
+	GroupID         string                 `json:"group_id" binding:"required"`
+	Content         string                 `json:"content"`
+	Type            string                 `json:"type" binding:"required"`
+	Metadata        models.MessageMetadata `json:"metadata"`
+	ClientMessageID *string                `json:"client_message_id"`
 }
 
-// GetDirectMessages gets direct messages between two users
+// messageBody is what a user sends as a message, checked against the message type registry
+type messageBody struct {
+	Content  string
+	Type     models.MessageType
+	Metadata models.MessageMetadata
+}
+
+// GetDirectMessages gets direct messages between two users.
+// Supports limit/offset pagination, or cursor pagination when a "before" or "after" query parameter is present.
 func (mc *MessageController) GetDirectMessages(c *gin.Context) {
 	userID := c.Param("userId")
 	otherUserID := c.Param("otherUserId")
@@ -71,10 +90,17 @@ func (mc *MessageController) GetDirectMessages(c *gin.Context) {
 	}
 
 	// Get messages between the two users
+	query := mc.db.Preload("Sender").Where("conversation_id = (?)",
+		mc.db.Model(&models.Conversation{}).Select("id").Where("key = ?", models.DirectChatKey(userID, otherUserID)),
+	)
+
+	if isCursorRequest(c) {
+		respondMessagePage(c, mc.db, query, limit)
+		return
+	}
+
 	var messages []models.Message
-	result := mc.db.Preload("Sender").Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
-		userID, otherUserID, otherUserID, userID,
-	).Order("timestamp DESC").Limit(limit).Offset(offset).Find(&messages)
+	result := query.Order("seq DESC").Limit(limit).Offset(offset).Find(&messages)
 
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
@@ -163,50 +189,34 @@ func (mc *MessageController) SendDirectMessage(c *gin.Context) {
 		return
 	}
 
-	// Check if receiver exists
-	var receiver models.User
-	result := mc.db.First(&receiver, "id = ?", req.ReceiverID)
-	if result.Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Receiver not found"})
+	key, ok := idempotencyKey(c, req.ClientMessageID)
+	if !ok {
 		return
 	}
 
-	// Create message
-	now := time.Now()
-	messageID := uuid.New().String()
-	message := models.Message{
-		ID:         messageID,
-		SenderID:   senderID.(string),
-		ReceiverID: &req.ReceiverID,
-		Content:    req.Content,
-		Type:       models.MessageType(req.Type),
-		Timestamp:  now,
-		CreatedAt:  now,
-		UpdatedAt:  now,
-	}
-
-	// Save message to database
-	result = mc.db.Create(&message)
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save message"})
+	message, replayed, err := mc.createDirectMessage(senderID.(string), req.ReceiverID, messageBody{
+		Content:  req.Content,
+		Type:     models.MessageType(req.Type),
+		Metadata: req.Metadata,
+	}, key)
+	if err != nil {
+		respondSendError(c, err)
 		return
 	}
 
 	// Publish message to MQTT
 	//I am stopping it because we have already publishing from frontend
-	//err := mc.mqttClient.PublishDirectMessage(&message)
+	//err := mc.mqttClient.PublishDirectMessage(message)
 	//if err != nil {
 	// Log error but don't fail the request
 	//log.Printf("Failed to publish message to MQTT: %v", err)
 	//}
 
-	// Load sender details
-	mc.db.First(&message.Sender, "id = ?", message.SenderID)
-
-	c.JSON(http.StatusCreated, message)
+	respondSentMessage(c, message, replayed)
 }
 
-// GetGroupMessages gets messages for a group
+// GetGroupMessages gets messages for a group.
+// Supports limit/offset pagination, or cursor pagination when a "before" or "after" query parameter is present.
 func (mc *MessageController) GetGroupMessages(c *gin.Context) {
 	groupID := c.Param("groupId")
 
@@ -248,13 +258,26 @@ func (mc *MessageController) GetGroupMessages(c *gin.Context) {
 	}
 
 	// Get messages for the group
+	query := mc.db.Preload("Sender").Where("group_id = ?", groupID)
+
+	if isCursorRequest(c) {
+		respondMessagePage(c, mc.db, query, limit)
+		return
+	}
+
 	var messages []models.Message
-	result = mc.db.Preload("Sender").Where("group_id = ?", groupID).Order("timestamp DESC").Limit(limit).Offset(offset).Find(&messages)
+	result = query.Order("seq DESC").Limit(limit).Offset(offset).Find(&messages)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
 		return
 	}
 
+	// Load the polls of poll messages
+	if err := attachPolls(mc.db, authUserID.(string), messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
 	c.JSON(http.StatusOK, messages)
 }
 
@@ -274,54 +297,383 @@ func (mc *MessageController) SendGroupMessage(c *gin.Context) {
 		return
 	}
 
+	key, ok := idempotencyKey(c, req.ClientMessageID)
+	if !ok {
+		return
+	}
+
+	message, replayed, err := mc.createGroupMessage(senderID.(string), req.GroupID, messageBody{
+		Content:  req.Content,
+		Type:     models.MessageType(req.Type),
+		Metadata: req.Metadata,
+	}, key)
+	if err != nil {
+		respondSendError(c, err)
+		return
+	}
+
+	// Publish message to MQTT
+	//Commenting because we already did from frontend
+	//err := mc.mqttClient.PublishGroupMessage(message)
+	//if err != nil {
+	// Log error but don't fail the request
+	//	log.Printf("Failed to publish message to MQTT: %v", err)
+	//}
+
+	respondSentMessage(c, message, replayed)
+}
+
+// DeliverScheduledMessage sends a scheduled message through the regular send path.
+// Permissions are checked again at delivery time, and since no client is around to
+// publish it, the message is published to MQTT by the server.
+func (mc *MessageController) DeliverScheduledMessage(scheduled *models.ScheduledMessage) (*models.Message, error) {
+	var message *models.Message
+	var replayed bool
+	var err error
+
+	// The scheduled message ID keeps a retried delivery from sending the message twice
+	key := "scheduled:" + scheduled.ID
+	body := messageBody{Content: scheduled.Content, Type: scheduled.Type, Metadata: scheduled.Metadata}
+
+	if scheduled.GroupID != nil {
+		message, replayed, err = mc.createGroupMessage(scheduled.SenderID, *scheduled.GroupID, body, key)
+	} else if scheduled.ReceiverID != nil {
+		message, replayed, err = mc.createDirectMessage(scheduled.SenderID, *scheduled.ReceiverID, body, key)
+	} else {
+		return nil, errors.New("scheduled message has no receiver or group")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		return message, nil
+	}
+
+	if message.GroupID != nil {
+		err = mc.mqttClient.PublishGroupMessage(message)
+	} else {
+		err = mc.mqttClient.PublishDirectMessage(message)
+	}
+	if err != nil {
+		// Log error but don't fail the delivery
+		log.Printf("Failed to publish message to MQTT: %v", err)
+	}
+
+	return message, nil
+}
+
+// Errors returned by the message send path
+var (
+	errReceiverNotFound = errors.New("receiver not found")
+	errGroupNotFound    = errors.New("group not found")
+	errNotGroupMember   = errors.New("you are not a member of this group")
+
+	errDuplicateMessageDeleted = errors.New("the message sent earlier with this idempotency key was deleted")
+	errIdempotencyKeyReused    = errors.New("the idempotency key was used for a different message")
+	errAttachmentUnavailable   = errors.New("attachment is already attached to a message")
+)
+
+// createDirectMessage validates and saves a direct message from sender to receiver.
+// A non-empty idempotency key returns the message saved earlier with the same key, if any,
+// and reports it as replayed.
+func (mc *MessageController) createDirectMessage(senderID, receiverID string, body messageBody, idempotencyKey string) (*models.Message, bool, error) {
+	// Check the message against its type
+	if err := models.ValidateUserMessage(body.Type, body.Content, body.Metadata); err != nil {
+		return nil, false, err
+	}
+
+	// Check the uploaded attachment the message references
+	if _, err := checkAttachment(mc.db, senderID, body); err != nil {
+		return nil, false, err
+	}
+
+	// Check if receiver exists
+	var receiver models.User
+	result := mc.db.First(&receiver, "id = ?", receiverID)
+	if result.Error != nil {
+		return nil, false, errReceiverNotFound
+	}
+
+	// Create message
+	now := time.Now()
+	message := models.Message{
+		ID:         uuid.New().String(),
+		SenderID:   senderID,
+		ReceiverID: &receiverID,
+		Content:    body.Content,
+		Type:       body.Type,
+		Metadata:   body.Metadata,
+		Timestamp:  now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	return mc.saveMessage(&message, idempotencyKey)
+}
+
+// createGroupMessage validates and saves a message from sender to a group.
+// Idempotency keys work as in createDirectMessage.
+func (mc *MessageController) createGroupMessage(senderID, groupID string, body messageBody, idempotencyKey string) (*models.Message, bool, error) {
+	// Check the message against its type
+	if err := models.ValidateUserMessage(body.Type, body.Content, body.Metadata); err != nil {
+		return nil, false, err
+	}
+
+	// Check the uploaded attachment the message references
+	if _, err := checkAttachment(mc.db, senderID, body); err != nil {
+		return nil, false, err
+	}
+
 	// Check if the group exists
 	var group models.Group
-	result := mc.db.First(&group, "id = ?", req.GroupID)
+	result := mc.db.First(&group, "id = ?", groupID)
 	if result.Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
+		return nil, false, errGroupNotFound
 	}
 
 	// Check if the user is a member of the group
-	var groupUser models.GroupUser
-	result = mc.db.Where("group_id = ? AND user_id = ?", req.GroupID, senderID).First(&groupUser)
-	if result.Error != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
-		return
+	if !isGroupMember(mc.db, groupID, senderID) {
+		return nil, false, errNotGroupMember
 	}
 
 	// Create message
 	now := time.Now()
-	messageID := uuid.New().String()
 	message := models.Message{
-		ID:        messageID,
-		SenderID:  senderID.(string),
-		GroupID:   &req.GroupID,
-		Content:   req.Content,
-		Type:      models.MessageType(req.Type),
+		ID:        uuid.New().String(),
+		SenderID:  senderID,
+		GroupID:   &groupID,
+		Content:   body.Content,
+		Type:      body.Type,
+		Metadata:  body.Metadata,
 		Timestamp: now,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
 
-	// Save message to database
-	result = mc.db.Create(&message)
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save message"})
-		return
+	saved, replayed, err := mc.saveMessage(&message, idempotencyKey)
+	if err != nil || replayed {
+		return saved, replayed, err
 	}
 
-	// Publish message to MQTT
-	//Commenting because we already did from frontend
-	//err := mc.mqttClient.PublishGroupMessage(&message)
-	//if err != nil {
-	// Log error but don't fail the request
-	//	log.Printf("Failed to publish message to MQTT: %v", err)
-	//}
+	// Record and notify @mentions
+	recordMentions(mc.db, mc.mqttClient, saved)
+
+	return saved, false, nil
+}
+
+// saveMessage saves a new message and loads its sender details.
+// With an idempotency key, a message saved earlier with the same key within the
+// idempotency window is returned instead and reported as replayed.
+func (mc *MessageController) saveMessage(message *models.Message, idempotencyKey string) (*models.Message, bool, error) {
+	var expired []models.Message
+	if idempotencyKey == "" {
+		// Save message to database
+		err := mc.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			expired, err = insertMessage(tx, message)
+			return err
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		original, expiredOnce, err := mc.saveMessageOnce(message, idempotencyKey)
+		if err != nil {
+			return nil, false, err
+		}
+		if original != nil {
+			mc.db.First(&original.Sender, "id = ?", original.SenderID)
+			return original, true, nil
+		}
+		expired = expiredOnce
+	}
+
+	// Media expired to make room in the group's quota is only reported once the send committed
+	for i := range expired {
+		if err := mc.mqttClient.PublishMessageUpdated(&expired[i]); err != nil {
+			log.Printf("Failed to publish message update to MQTT: %v", err)
+		}
+	}
 
 	// Load sender details
 	mc.db.First(&message.Sender, "id = ?", message.SenderID)
 
+	// Unarchive the chat for its recipients and notify those who have not muted it
+	mc.notifyRecipients(message)
+
+	// Previews of links are attached once fetched
+	mc.previewLinks(message)
+
+	return message, false, nil
+}
+
+// saveMessageOnce saves a message under an idempotency key of its sender, or returns the
+// message already saved under the key. Concurrent sends with the same key wait for each
+// other on the key's row, so only one of them saves a message. A key reused for a message
+// to another chat or with other content is rejected. Messages whose media expired to make
+// room for the new message are returned with it.
+func (mc *MessageController) saveMessageOnce(message *models.Message, idempotencyKey string) (*models.Message, []models.Message, error) {
+	var original *models.Message
+	var expired []models.Message
+
+	// The fingerprint is taken before saving fills in details of attachments and live locations
+	fingerprint := message.Fingerprint()
+
+	err := mc.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		record := models.MessageIdempotencyKey{
+			SenderID:    message.SenderID,
+			Key:         idempotencyKey,
+			MessageID:   message.ID,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			var existing models.MessageIdempotencyKey
+			if err := tx.Where("sender_id = ? AND key = ?", message.SenderID, idempotencyKey).First(&existing).Error; err != nil {
+				return err
+			}
+
+			if existing.CreatedAt.After(now.Add(-models.IdempotencyWindow)) {
+				// Keys saved before fingerprints were recorded have none to compare
+				if existing.Fingerprint != "" && existing.Fingerprint != fingerprint {
+					return errIdempotencyKeyReused
+				}
+
+				var found models.Message
+				result := tx.Where("id = ?", existing.MessageID).Limit(1).Find(&found)
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					return errDuplicateMessageDeleted
+				}
+				original = &found
+				return nil
+			}
+
+			// The key has left its window, so it is reused for the new message
+			result = tx.Model(&existing).Updates(map[string]interface{}{"message_id": message.ID, "fingerprint": fingerprint, "created_at": now})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		var err error
+		expired, err = insertMessage(tx, message)
+		return err
+	})
+
+	return original, expired, err
+}
+
+// insertMessage creates a message, claiming the attachment it references first.
+// The attachment is read after claiming it so details from processing that finished
+// in the meantime are not lost. Media sent to a group is checked against the group's
+// quota in the same transaction, and the messages whose media expired to make room are
+// returned for publishing after the commit.
+func insertMessage(tx *gorm.DB, message *models.Message) ([]models.Message, error) {
+	var expired []models.Message
+	if attachmentID, ok := message.Metadata["attachment_id"].(string); ok {
+		claimed, err := models.ClaimAttachment(tx, attachmentID, message.SenderID, message.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			return nil, errAttachmentUnavailable
+		}
+
+		var attachment models.Attachment
+		if err := tx.First(&attachment, "id = ?", attachmentID).Error; err != nil {
+			return nil, err
+		}
+		message.Metadata = attachment.ApplyToMetadata(message.Metadata, message.Type)
+
+		// The message is not created yet, so its attachment is not counted in the group's usage
+		if message.GroupID != nil {
+			expired, err = models.MakeGroupRoom(tx, *message.GroupID, attachment.Size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := models.StartLiveLocation(tx, message); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(message).Error; err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// respondSendError writes the HTTP response for an error returned by the send path
+func respondSendError(c *gin.Context, err error) {
+	var validationErr *models.MessageValidationError
+	var quotaErr *models.QuotaExceededError
+
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Reason})
+	case errors.As(err, &quotaErr):
+		respondQuotaExceeded(c, quotaErr)
+	case errors.Is(err, errReceiverNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receiver not found"})
+	case errors.Is(err, errGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	case errors.Is(err, errNotGroupMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+	case errors.Is(err, errDuplicateMessageDeleted):
+		c.JSON(http.StatusConflict, gin.H{"error": "The message sent earlier with this idempotency key was deleted"})
+	case errors.Is(err, errIdempotencyKeyReused):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The idempotency key was already used for a different message"})
+	case errors.Is(err, errAttachmentUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": "Attachment is already attached to a message"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save message"})
+	}
+}
+
+// maxIdempotencyKeyLength is the longest accepted client message ID
+const maxIdempotencyKeyLength = 255
+
+// idempotencyKey gets the client message ID of a send request from the Idempotency-Key header
+// or the request body, writing the error response if it is invalid. Sends without one are
+// not deduplicated.
+func idempotencyKey(c *gin.Context, clientMessageID *string) (string, bool) {
+	key := c.GetHeader("Idempotency-Key")
+	if clientMessageID != nil {
+		if key != "" && key != *clientMessageID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key header and client_message_id do not match"})
+			return "", false
+		}
+		key = *clientMessageID
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Idempotency key must be at most %d characters", maxIdempotencyKeyLength)})
+		return "", false
+	}
+
+	return key, true
+}
+
+// respondSentMessage writes the response for a sent message. A replayed send gets the
+// original message with 200 instead of 201.
+func respondSentMessage(c *gin.Context, message *models.Message, replayed bool) {
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(http.StatusOK, message)
+		return
+	}
+
 	c.JSON(http.StatusCreated, message)
 }
 
@@ -330,7 +682,8 @@ type MarkMessagesAsReadRequest struct {
 	MessageIDs []string `json:"message_ids" binding:"required"`
 }
 
-// MarkMessagesAsRead marks one or more messages as read by the receiver
+// MarkMessagesAsRead marks one or more messages as read by the receiver.
+// Group messages move the user's read pointer in the group instead.
 func (mc *MessageController) MarkMessagesAsRead(c *gin.Context) {
 	// Get the authenticated user ID from the context
 	userID, exists := c.Get("user_id")
@@ -356,6 +709,17 @@ func (mc *MessageController) MarkMessagesAsRead(c *gin.Context) {
 		return
 	}
 
+	// Move the user's per-chat read pointers, covering group messages as well
+	var readMessages []models.Message
+	mc.db.Where("id IN ?", req.MessageIDs).
+		Where("receiver_id = ? OR group_id IN (SELECT group_id FROM group_users WHERE user_id = ?)", userID, userID).
+		Find(&readMessages)
+
+	if _, err := markChatsRead(mc.db, mc.mqttClient, userID.(string), readMessages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark messages as read"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"updated": result.RowsAffected})
 }
 
@@ -388,12 +752,106 @@ func (gc *MessageController) DeleteMessage(c *gin.Context) {
 		return
 	}
 
-	// Delete the messageID
-	result = gc.db.Delete(&message)
-	if result.Error != nil {
+	// Delete the message along with its pins and saved references
+	if err := models.DeleteMessages(gc.db, []string{message.ID}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "message deleted successfully"})
 }
+
+// MessagesPage represents a page of messages fetched with cursors.
+// Messages are ordered newest first; BeforeCursor points at the oldest message
+// in the page and AfterCursor at the newest one.
+type MessagesPage struct {
+	Messages     []models.Message `json:"messages"`
+	BeforeCursor *string          `json:"before_cursor"`
+	AfterCursor  *string          `json:"after_cursor"`
+	HasMore      bool             `json:"has_more"`
+}
+
+// isCursorRequest checks if the client asked for cursor pagination
+func isCursorRequest(c *gin.Context) bool {
+	_, hasBefore := c.GetQuery("before")
+	_, hasAfter := c.GetQuery("after")
+	return hasBefore || hasAfter
+}
+
+// respondMessagePage writes a page of messages of one conversation from the query using the
+// "before" or "after" cursor. Cursors point at sequence numbers, so pages follow the same order
+// as offset pagination. An empty "before" starts from the newest message.
+func respondMessagePage(c *gin.Context, db, query *gorm.DB, limit int) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	afterParam, isAfter := c.GetQuery("after")
+	cursorParam := c.Query("before")
+	if isAfter {
+		cursorParam = afterParam
+	}
+
+	if cursorParam != "" {
+		seq, err := decodeSeqCursor(cursorParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if isAfter {
+			query = query.Where("seq > ?", seq)
+		} else {
+			query = query.Where("seq < ?", seq)
+		}
+	}
+
+	if isAfter {
+		query = query.Order("seq ASC")
+	} else {
+		query = query.Order("seq DESC")
+	}
+
+	// Fetch one extra row to know whether there are more messages
+	var messages []models.Message
+	if err := query.Limit(limit + 1).Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	page := MessagesPage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		page.HasMore = true
+	}
+
+	// Load the polls of poll messages
+	userID := c.GetString("user_id")
+	if err := attachPolls(db, userID, page.Messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get messages"})
+		return
+	}
+
+	// Always return messages newest first
+	if isAfter {
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+
+	if len(page.Messages) > 0 {
+		newest := page.Messages[0]
+		oldest := page.Messages[len(page.Messages)-1]
+		before := encodeSeqCursor(oldest.Seq)
+		after := encodeSeqCursor(newest.Seq)
+		page.BeforeCursor = &before
+		page.AfterCursor = &after
+	} else {
+		page.Messages = []models.Message{}
+		if isAfter && afterParam != "" {
+			// Nothing new yet, so the client keeps polling from the same place
+			page.AfterCursor = &afterParam
+		}
+	}
+
+	c.JSON(http.StatusOK, page)
+}
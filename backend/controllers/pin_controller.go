@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxPinnedMessages is the maximum number of messages that can be pinned in a single chat
+const MaxPinnedMessages = 5
+
+// PinController handles pinning and unpinning of messages
+type PinController struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+}
+
+// NewPinController creates a new pin controller
+func NewPinController(db *gorm.DB, mqttClient *mqtt.MQTTClient) *PinController {
+	return &PinController{db: db, mqttClient: mqttClient}
+}
+
+// canPin checks if a user may pin or unpin messages in the chat of the given message.
+// Group admins can pin in groups, and both participants can pin in a direct chat.
+func (pc *PinController) canPin(message *models.Message, userID string) bool {
+	if message.GroupID != nil {
+		return isGroupAdmin(pc.db, *message.GroupID, userID)
+	}
+	return canAccessMessage(pc.db, message, userID)
+}
+
+// errPinLimitReached is returned when a chat already has the maximum number of pinned messages
+var errPinLimitReached = errors.New("pin limit reached")
+
+// PinMessage pins a message to the top of its chat
+func (pc *PinController) PinMessage(c *gin.Context) {
+	messageID := c.Param("id")
+	if messageID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID is required"})
+		return
+	}
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the message exists
+	var message models.Message
+	result := pc.db.First(&message, "id = ?", messageID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	// Check if the user is allowed to pin in this chat
+	if !pc.canPin(&message, authUserID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to pin messages in this chat"})
+		return
+	}
+
+	// Check if the message is already pinned
+	var existingPin models.PinnedMessage
+	result = pc.db.Where("message_id = ?", messageID).First(&existingPin)
+	if result.Error == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message is already pinned"})
+		return
+	}
+
+	// Pin the message
+	chatKey := message.ChatKey()
+	now := time.Now()
+	pin := models.PinnedMessage{
+		ID:         uuid.New().String(),
+		MessageID:  message.ID,
+		ChatKey:    chatKey,
+		PinnedByID: authUserID.(string),
+		PinnedAt:   now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	// Count and insert under the conversation lock so concurrent pins cannot exceed the limit
+	err := pc.db.Transaction(func(tx *gorm.DB) error {
+		if err := models.LockConversation(tx, chatKey); err != nil {
+			return err
+		}
+
+		var pinCount int64
+		if err := tx.Model(&models.PinnedMessage{}).Where("chat_key = ?", chatKey).Count(&pinCount).Error; err != nil {
+			return err
+		}
+		if pinCount >= MaxPinnedMessages {
+			return errPinLimitReached
+		}
+
+		return tx.Create(&pin).Error
+	})
+	if errors.Is(err, errPinLimitReached) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Maximum number of pinned messages reached for this chat"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin message"})
+		return
+	}
+
+	// Get user details for system message
+	var user models.User
+	pc.db.First(&user, "id = ?", authUserID)
+	pc.sendSystemMessage(&message, authUserID.(string), user.Username+" pinned a message")
+
+	// Load pin details
+	pc.db.Preload("Message.Sender").Preload("PinnedBy").First(&pin, "id = ?", pin.ID)
+
+	c.JSON(http.StatusCreated, pin)
+}
+
+// UnpinMessage removes a pinned message from its chat
+func (pc *PinController) UnpinMessage(c *gin.Context) {
+	messageID := c.Param("id")
+	if messageID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID is required"})
+		return
+	}
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the message exists
+	var message models.Message
+	result := pc.db.First(&message, "id = ?", messageID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	// Check if the user is allowed to unpin in this chat
+	if !pc.canPin(&message, authUserID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to unpin messages in this chat"})
+		return
+	}
+
+	// Remove the pin
+	result = pc.db.Where("message_id = ?", messageID).Delete(&models.PinnedMessage{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unpin message"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message is not pinned"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message unpinned successfully"})
+}
+
+// GetDirectPins gets the pinned messages of a direct chat between two users
+func (pc *PinController) GetDirectPins(c *gin.Context) {
+	userID := c.Param("userId")
+	otherUserID := c.Param("otherUserId")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the authenticated user is one of the participants
+	if authUserID != userID && authUserID != otherUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only access your own messages"})
+		return
+	}
+
+	pins, err := loadPinnedMessages(pc.db, models.DirectChatKey(userID, otherUserID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get pinned messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pins)
+}
+
+// GetGroupPins gets the pinned messages of a group
+func (pc *PinController) GetGroupPins(c *gin.Context) {
+	groupID := c.Param("groupId")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the group exists
+	var group models.Group
+	result := pc.db.First(&group, "id = ?", groupID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(pc.db, groupID, authUserID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	pins, err := loadPinnedMessages(pc.db, models.GroupChatKey(groupID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get pinned messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pins)
+}
+
+// sendSystemMessage posts a system message into the chat of the given message
+func (pc *PinController) sendSystemMessage(message *models.Message, senderID, content string) {
+	if message.GroupID != nil {
+		sendSystemMessage(pc.db, pc.mqttClient, senderID, nil, message.GroupID, content)
+		return
+	}
+
+	// Address the system message to the other participant of the direct chat
+	receiverID := message.SenderID
+	if receiverID == senderID {
+		receiverID = *message.ReceiverID
+	}
+	sendSystemMessage(pc.db, pc.mqttClient, senderID, &receiverID, nil, content)
+}
+
+// loadPinnedMessages loads the pinned messages of a chat, most recently pinned first
+func loadPinnedMessages(db *gorm.DB, chatKey string) ([]models.PinnedMessage, error) {
+	pins := []models.PinnedMessage{}
+	result := db.Preload("Message.Sender").Preload("PinnedBy").
+		Where("chat_key = ?", chatKey).
+		Order("pinned_at DESC").
+		Find(&pins)
+	return pins, result.Error
+}
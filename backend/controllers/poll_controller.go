@@ -0,0 +1,519 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PollController handles polls in group chats
+type PollController struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+	// notifyRecipients queues a new message to notify its recipients of
+	notifyRecipients func(message *models.Message)
+}
+
+// NewPollController creates a new poll controller
+func NewPollController(db *gorm.DB, mqttClient *mqtt.MQTTClient, notifyRecipients func(message *models.Message)) *PollController {
+	return &PollController{db: db, mqttClient: mqttClient, notifyRecipients: notifyRecipients}
+}
+
+// CreatePollRequest represents the request body for posting a poll to a group
+type CreatePollRequest struct {
+	GroupID        string     `json:"group_id" binding:"required"`
+	Question       string     `json:"question" binding:"required"`
+	Options        []string   `json:"options" binding:"required,min=2,max=10,dive,required"`
+	MultipleChoice bool       `json:"multiple_choice"`
+	Anonymous      bool       `json:"anonymous"`
+	ClosesAt       *time.Time `json:"closes_at"`
+}
+
+// VotePollRequest represents the request body for voting in a poll.
+// A vote replaces any earlier vote of the user in the poll.
+type VotePollRequest struct {
+	OptionIDs []string `json:"option_ids" binding:"required,min=1"`
+}
+
+// Errors returned while voting
+var (
+	errPollClosed      = errors.New("poll is closed")
+	errInvalidPollVote = errors.New("invalid poll vote")
+)
+
+// CreatePoll posts a poll message to a group
+func (pc *PollController) CreatePoll(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req CreatePollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	question := strings.TrimSpace(req.Question)
+	if question == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Question is required"})
+		return
+	}
+
+	// Options must be distinct
+	seen := make(map[string]bool)
+	for i, option := range req.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || seen[strings.ToLower(option)] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Poll options must be distinct and not empty"})
+			return
+		}
+		seen[strings.ToLower(option)] = true
+		req.Options[i] = option
+	}
+
+	now := time.Now()
+	if req.ClosesAt != nil && !req.ClosesAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Close time must be in the future"})
+		return
+	}
+
+	// Check if the group exists
+	var group models.Group
+	result := pc.db.First(&group, "id = ?", req.GroupID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(pc.db, req.GroupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	message := models.Message{
+		ID:        uuid.New().String(),
+		SenderID:  userID.(string),
+		GroupID:   &req.GroupID,
+		Content:   question,
+		Type:      models.PollMessage,
+		Timestamp: now,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	poll := models.Poll{
+		ID:             uuid.New().String(),
+		MessageID:      message.ID,
+		GroupID:        req.GroupID,
+		CreatorID:      userID.(string),
+		Question:       question,
+		MultipleChoice: req.MultipleChoice,
+		Anonymous:      req.Anonymous,
+		ClosesAt:       req.ClosesAt,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	for i, text := range req.Options {
+		poll.Options = append(poll.Options, models.PollOption{
+			ID:        uuid.New().String(),
+			PollID:    poll.ID,
+			Position:  i,
+			Text:      text,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+	}
+
+	// Save the message and its poll together
+	err := pc.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		return tx.Create(&poll).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create poll"})
+		return
+	}
+
+	// Load sender details
+	pc.db.First(&message.Sender, "id = ?", message.SenderID)
+
+	// Unarchive the chat for its recipients and notify those who have not muted it
+	pc.notifyRecipients(&message)
+
+	messages := []models.Message{message}
+	if err := attachPolls(pc.db, userID.(string), messages); err != nil {
+		log.Printf("Failed to load poll: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, messages[0])
+}
+
+// GetPoll gets a poll with its current tallies
+func (pc *PollController) GetPoll(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	poll, ok := pc.loadPoll(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, poll)
+}
+
+// VotePoll casts the authenticated user's vote in a poll, replacing any earlier vote
+func (pc *PollController) VotePoll(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req VotePollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	poll, ok := pc.loadPoll(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	err := pc.changeVotes(poll.ID, userID.(string), func(tx *gorm.DB, locked *models.Poll) error {
+		// Drop duplicate options and check they belong to the poll
+		optionIDs := make([]string, 0, len(req.OptionIDs))
+		seen := make(map[string]bool)
+		for _, id := range req.OptionIDs {
+			if !seen[id] {
+				seen[id] = true
+				optionIDs = append(optionIDs, id)
+			}
+		}
+		if !locked.MultipleChoice && len(optionIDs) != 1 {
+			return errInvalidPollVote
+		}
+
+		var count int64
+		if err := tx.Model(&models.PollOption{}).Where("poll_id = ? AND id IN ?", locked.ID, optionIDs).Count(&count).Error; err != nil {
+			return err
+		}
+		if int(count) != len(optionIDs) {
+			return errInvalidPollVote
+		}
+
+		if err := tx.Where("poll_id = ? AND user_id = ?", locked.ID, userID).Delete(&models.PollVote{}).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		votes := make([]models.PollVote, len(optionIDs))
+		for i, optionID := range optionIDs {
+			votes[i] = models.PollVote{
+				ID:        uuid.New().String(),
+				PollID:    locked.ID,
+				OptionID:  optionID,
+				UserID:    userID.(string),
+				CreatedAt: now,
+			}
+		}
+		return tx.Create(&votes).Error
+	})
+	if !pc.respondVoteError(c, err) {
+		return
+	}
+
+	pc.respondPollChanged(c, poll.ID, userID.(string))
+}
+
+// RetractPollVote removes the authenticated user's vote from a poll
+func (pc *PollController) RetractPollVote(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	poll, ok := pc.loadPoll(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	err := pc.changeVotes(poll.ID, userID.(string), func(tx *gorm.DB, locked *models.Poll) error {
+		return tx.Where("poll_id = ? AND user_id = ?", locked.ID, userID).Delete(&models.PollVote{}).Error
+	})
+	if !pc.respondVoteError(c, err) {
+		return
+	}
+
+	pc.respondPollChanged(c, poll.ID, userID.(string))
+}
+
+// ClosePoll stops a poll from accepting votes. Only the poll creator or a group admin can close it.
+func (pc *PollController) ClosePoll(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	poll, ok := pc.loadPoll(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	if poll.CreatorID != userID.(string) && !isGroupAdmin(pc.db, poll.GroupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the poll creator or a group admin can close the poll"})
+		return
+	}
+
+	now := time.Now()
+	if poll.IsClosed(now) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Poll is already closed"})
+		return
+	}
+
+	if _, err := models.ClosePoll(pc.db, poll, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close poll"})
+		return
+	}
+
+	pc.respondPollChanged(c, poll.ID, userID.(string))
+}
+
+// loadPoll loads a poll with tallies for a member of its group, writing the error response if there is none
+func (pc *PollController) loadPoll(c *gin.Context, pollID, userID string) (*models.Poll, bool) {
+	var poll models.Poll
+	result := pc.db.First(&poll, "id = ?", pollID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poll not found"})
+		return nil, false
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(pc.db, poll.GroupID, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return nil, false
+	}
+
+	polls, err := loadPolls(pc.db, userID, "id = ?", pollID)
+	if err != nil || len(polls) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get poll"})
+		return nil, false
+	}
+
+	return polls[0], true
+}
+
+// changeVotes changes the votes of a user in an open poll while holding a lock on the poll,
+// so concurrent votes of the same user cannot end up with more than one single-choice vote
+func (pc *PollController) changeVotes(pollID, userID string, change func(tx *gorm.DB, poll *models.Poll) error) error {
+	now := time.Now()
+	var messageID string
+
+	err := pc.db.Transaction(func(tx *gorm.DB) error {
+		var poll models.Poll
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&poll, "id = ?", pollID).Error; err != nil {
+			return err
+		}
+		if poll.IsClosed(now) {
+			return errPollClosed
+		}
+		messageID = poll.MessageID
+
+		return change(tx, &poll)
+	})
+	if err != nil {
+		return err
+	}
+
+	pc.touchMessage(messageID, now)
+	return nil
+}
+
+// touchMessage bumps the update time of a poll message so syncing clients pick up the new tallies
+func (pc *PollController) touchMessage(messageID string, at time.Time) {
+	pc.db.Model(&models.Message{}).Where("id = ?", messageID).UpdateColumn("updated_at", at)
+}
+
+// respondVoteError writes the HTTP response for an error returned while voting and reports whether there was none
+func (pc *PollController) respondVoteError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errPollClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": "Poll is closed"})
+	case errors.Is(err, errInvalidPollVote):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid poll options"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update vote"})
+	}
+	return false
+}
+
+// respondPollChanged publishes the new tallies of a poll to its group and returns them to the user
+func (pc *PollController) respondPollChanged(c *gin.Context, pollID, userID string) {
+	polls, err := loadPolls(pc.db, userID, "id = ?", pollID)
+	if err != nil || len(polls) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get poll"})
+		return
+	}
+	poll := polls[0]
+
+	// Votes of the requesting user are personal, so they are left out of the broadcast
+	update := *poll
+	update.MyVotes = nil
+	if err := pc.mqttClient.PublishPollUpdated(&update); err != nil {
+		log.Printf("Failed to publish poll update to MQTT: %v", err)
+	}
+
+	c.JSON(http.StatusOK, poll)
+}
+
+// PublishPollClosed publishes the final tallies of a poll closed by the message reaper to its group
+func (pc *PollController) PublishPollClosed(pollID string) {
+	polls, err := loadPolls(pc.db, "", "id = ?", pollID)
+	if err != nil || len(polls) == 0 {
+		log.Printf("Failed to load closed poll %s: %v", pollID, err)
+		return
+	}
+
+	if err := pc.mqttClient.PublishPollUpdated(polls[0]); err != nil {
+		log.Printf("Failed to publish poll update to MQTT: %v", err)
+	}
+}
+
+// attachPolls loads the polls of the poll messages among messages, with tallies for the user
+func attachPolls(db *gorm.DB, userID string, messages []models.Message) error {
+	var messageIDs []string
+	for _, message := range messages {
+		if message.Type == models.PollMessage {
+			messageIDs = append(messageIDs, message.ID)
+		}
+	}
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	polls, err := loadPolls(db, userID, "message_id IN ?", messageIDs)
+	if err != nil {
+		return err
+	}
+
+	pollMap := make(map[string]*models.Poll)
+	for _, poll := range polls {
+		pollMap[poll.MessageID] = poll
+	}
+	for i := range messages {
+		if poll, ok := pollMap[messages[i].ID]; ok {
+			messages[i].Poll = poll
+		}
+	}
+
+	return nil
+}
+
+// loadPolls loads the polls matching a condition with their options and tallies.
+// Voters are only listed for public polls; the user's own votes are always included.
+func loadPolls(db *gorm.DB, userID string, condition string, args ...interface{}) ([]*models.Poll, error) {
+	var polls []*models.Poll
+	result := db.
+		Preload("Options", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC") }).
+		Where(condition, args...).
+		Find(&polls)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(polls) == 0 {
+		return polls, nil
+	}
+
+	pollIDs := make([]string, len(polls))
+	for i, poll := range polls {
+		pollIDs[i] = poll.ID
+	}
+
+	var votes []models.PollVote
+	if err := db.Where("poll_id IN ?", pollIDs).Order("created_at ASC").Find(&votes).Error; err != nil {
+		return nil, err
+	}
+
+	// Load the voters of public polls
+	anonymous := make(map[string]bool)
+	for _, poll := range polls {
+		anonymous[poll.ID] = poll.Anonymous
+	}
+	var voterIDs []string
+	for _, vote := range votes {
+		if !anonymous[vote.PollID] {
+			voterIDs = append(voterIDs, vote.UserID)
+		}
+	}
+	users := make(map[string]models.User)
+	if len(voterIDs) > 0 {
+		var list []models.User
+		if err := db.Where("id IN ?", voterIDs).Find(&list).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range list {
+			users[u.ID] = u
+		}
+	}
+
+	type optionKey struct{ pollID, optionID string }
+	counts := make(map[optionKey]int64)
+	voters := make(map[optionKey][]models.User)
+	distinctVoters := make(map[string]map[string]bool)
+	myVotes := make(map[string][]string)
+	for _, vote := range votes {
+		key := optionKey{vote.PollID, vote.OptionID}
+		counts[key]++
+		if u, ok := users[vote.UserID]; ok && !anonymous[vote.PollID] {
+			voters[key] = append(voters[key], u)
+		}
+		if distinctVoters[vote.PollID] == nil {
+			distinctVoters[vote.PollID] = make(map[string]bool)
+		}
+		distinctVoters[vote.PollID][vote.UserID] = true
+		if vote.UserID == userID {
+			myVotes[vote.PollID] = append(myVotes[vote.PollID], vote.OptionID)
+		}
+	}
+
+	for _, poll := range polls {
+		poll.TotalVoters = int64(len(distinctVoters[poll.ID]))
+		poll.MyVotes = myVotes[poll.ID]
+		for i := range poll.Options {
+			key := optionKey{poll.ID, poll.Options[i].ID}
+			poll.Options[i].VoteCount = counts[key]
+			poll.Options[i].Voters = voters[key]
+		}
+	}
+
+	return polls, nil
+}
@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReadReceiptController handles per-member read state of chats
+type ReadReceiptController struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+}
+
+// NewReadReceiptController creates a new read receipt controller
+func NewReadReceiptController(db *gorm.DB, mqttClient *mqtt.MQTTClient) *ReadReceiptController {
+	return &ReadReceiptController{db: db, mqttClient: mqttClient}
+}
+
+// MarkGroupReadRequest represents the request body for marking a group as read up to a message
+type MarkGroupReadRequest struct {
+	MessageID string `json:"message_id" binding:"required"`
+}
+
+// MessageReader represents a member who has read a message.
+// Only the latest read pointer of a member is stored, so LastActiveAt is when the member last
+// marked the chat read, which may be later than when they read this message.
+type MessageReader struct {
+	User         models.User `json:"user"`
+	LastActiveAt time.Time   `json:"last_active_at"`
+}
+
+// MarkGroupRead moves the authenticated user's read pointer in a group forward to a message
+func (rc *ReadReceiptController) MarkGroupRead(c *gin.Context) {
+	groupID := c.Param("groupId")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req MarkGroupReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(rc.db, groupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	// Check if the message exists in the group
+	var message models.Message
+	result := rc.db.Where("id = ? AND group_id = ?", req.MessageID, groupID).First(&message)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	if _, err := markChatsRead(rc.db, rc.mqttClient, userID.(string), []models.Message{message}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark group as read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group marked as read"})
+}
+
+// GetMessageReaders lists the group members who have read a group message
+func (rc *ReadReceiptController) GetMessageReaders(c *gin.Context) {
+	messageID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the message exists
+	var message models.Message
+	result := rc.db.First(&message, "id = ?", messageID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	if message.GroupID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Read receipts are only available for group messages"})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(rc.db, *message.GroupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	// Members whose read pointer is at or past the message have read it
+	var states []models.ReadState
+	result = rc.db.
+		Where("chat_key = ? AND user_id <> ?", message.ChatKey(), message.SenderID).
+		Where("last_read_seq >= ?", message.Seq).
+		Where("user_id IN (SELECT user_id FROM group_users WHERE group_id = ?)", *message.GroupID).
+		Order("updated_at ASC").
+		Find(&states)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get message readers"})
+		return
+	}
+
+	readerIDs := make([]string, len(states))
+	for i, state := range states {
+		readerIDs[i] = state.UserID
+	}
+
+	var users []models.User
+	if len(readerIDs) > 0 {
+		rc.db.Where("id IN ?", readerIDs).Find(&users)
+	}
+	userMap := make(map[string]models.User)
+	for _, u := range users {
+		userMap[u.ID] = u
+	}
+
+	readers := make([]MessageReader, 0, len(states))
+	for _, state := range states {
+		if u, ok := userMap[state.UserID]; ok {
+			readers = append(readers, MessageReader{User: u, LastActiveAt: state.UpdatedAt})
+		}
+	}
+
+	c.JSON(http.StatusOK, readers)
+}
+
+// MessagePlayer represents a recipient who has played a voice note
+type MessagePlayer struct {
+	User     models.User `json:"user"`
+	PlayedAt time.Time   `json:"played_at"`
+}
+
+// MarkPlayed records that the authenticated user played a voice note. Playing a voice note
+// also reads the chat up to it.
+func (rc *ReadReceiptController) MarkPlayed(c *gin.Context) {
+	messageID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the message exists
+	var message models.Message
+	result := rc.db.First(&message, "id = ?", messageID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	// Check if the user is a participant of the chat
+	if !canAccessMessage(rc.db, &message, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a participant of this chat"})
+		return
+	}
+
+	if message.Type != models.AudioMessage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only voice notes can be played"})
+		return
+	}
+	if message.SenderID == userID.(string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot mark your own voice note as played"})
+		return
+	}
+
+	// Only the first play is recorded
+	state := models.PlayedState{MessageID: message.ID, UserID: userID.(string), PlayedAt: time.Now()}
+	result = rc.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&state)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark voice note as played"})
+		return
+	}
+
+	if result.RowsAffected > 0 {
+		if err := rc.mqttClient.PublishPlayed(&state, &message); err != nil {
+			log.Printf("Failed to publish played event to MQTT: %v", err)
+		}
+	} else {
+		rc.db.First(&state, "message_id = ? AND user_id = ?", message.ID, userID)
+	}
+
+	if _, err := markChatsRead(rc.db, rc.mqttClient, userID.(string), []models.Message{message}); err != nil {
+		log.Printf("Failed to mark chat as read: %v", err)
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// GetMessagePlayers lists the recipients who have played a voice note
+func (rc *ReadReceiptController) GetMessagePlayers(c *gin.Context) {
+	messageID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the message exists
+	var message models.Message
+	result := rc.db.First(&message, "id = ?", messageID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	// Check if the user is a participant of the chat
+	if !canAccessMessage(rc.db, &message, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a participant of this chat"})
+		return
+	}
+
+	if message.Type != models.AudioMessage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only voice notes can be played"})
+		return
+	}
+
+	var states []models.PlayedState
+	result = rc.db.Where("message_id = ?", message.ID).Order("played_at ASC").Find(&states)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get message players"})
+		return
+	}
+
+	playerIDs := make([]string, len(states))
+	for i, state := range states {
+		playerIDs[i] = state.UserID
+	}
+
+	var users []models.User
+	if len(playerIDs) > 0 {
+		rc.db.Where("id IN ?", playerIDs).Find(&users)
+	}
+	userMap := make(map[string]models.User)
+	for _, u := range users {
+		userMap[u.ID] = u
+	}
+
+	players := make([]MessagePlayer, 0, len(states))
+	for _, state := range states {
+		if u, ok := userMap[state.UserID]; ok {
+			players = append(players, MessagePlayer{User: u, PlayedAt: state.PlayedAt})
+		}
+	}
+
+	c.JSON(http.StatusOK, players)
+}
+
+// GetGroupUnreadCount gets the number of unread messages in a group for the authenticated user
+func (rc *ReadReceiptController) GetGroupUnreadCount(c *gin.Context) {
+	groupID := c.Param("groupId")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(rc.db, groupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	count, err := countGroupUnread(rc.db, groupID, userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unseen messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"unseen_count": count})
+}
+
+// countGroupUnread counts the messages from others in a group after the user's read pointer
+func countGroupUnread(db *gorm.DB, groupID, userID string) (int64, error) {
+	query := db.Model(&models.Message{}).Where("group_id = ? AND sender_id <> ?", groupID, userID)
+
+	var state models.ReadState
+	result := db.Where("chat_key = ? AND user_id = ?", models.GroupChatKey(groupID), userID).Limit(1).Find(&state)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected > 0 {
+		query = query.Where("seq > ?", state.LastReadSeq)
+	}
+
+	var count int64
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// markChatsRead moves the user's read pointer forward to the newest of the given messages
+// in each of their chats, and publishes a read event for every chat that moved.
+// It returns the number of chats whose pointer moved.
+func markChatsRead(db *gorm.DB, mqttClient *mqtt.MQTTClient, userID string, messages []models.Message) (int, error) {
+	// Find the newest message per chat
+	newest := make(map[string]models.Message)
+	for _, message := range messages {
+		key := message.ChatKey()
+		current, ok := newest[key]
+		if !ok || message.Seq > current.Seq {
+			newest[key] = message
+		}
+	}
+
+	moved := 0
+	for key, message := range newest {
+		advanced, err := advanceReadState(db, key, userID, &message)
+		if err != nil {
+			return moved, err
+		}
+		if !advanced {
+			continue
+		}
+		moved++
+
+		if err := mqttClient.PublishRead(userID, &message); err != nil {
+			log.Printf("Failed to publish read event to MQTT: %v", err)
+		}
+	}
+
+	return moved, nil
+}
+
+// advanceReadState moves a user's read pointer in a chat to a message if it is newer than the current one
+func advanceReadState(db *gorm.DB, chatKey, userID string, message *models.Message) (bool, error) {
+	now := time.Now()
+	result := db.Exec(`
+		INSERT INTO read_states (chat_key, user_id, last_read_message_id, last_read_timestamp, last_read_seq, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_key, user_id) DO UPDATE
+		SET last_read_message_id = EXCLUDED.last_read_message_id,
+			last_read_timestamp = EXCLUDED.last_read_timestamp,
+			last_read_seq = EXCLUDED.last_read_seq,
+			updated_at = EXCLUDED.updated_at
+		WHERE read_states.last_read_seq < EXCLUDED.last_read_seq`,
+		chatKey, userID, message.ID, message.Timestamp, message.Seq, now, now,
+	)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RetentionController handles disappearing message timers of chats
+type RetentionController struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+}
+
+// NewRetentionController creates a new retention controller
+func NewRetentionController(db *gorm.DB, mqttClient *mqtt.MQTTClient) *RetentionController {
+	return &RetentionController{db: db, mqttClient: mqttClient}
+}
+
+// UpdateRetentionRequest represents the request body for changing a chat's retention timer
+type UpdateRetentionRequest struct {
+	Timer string `json:"timer" binding:"required,oneof=off 24h 7d 90d"`
+}
+
+// GetDirectRetention gets the retention timer of a direct chat
+func (rc *RetentionController) GetDirectRetention(c *gin.Context) {
+	userID := c.Param("userId")
+	otherUserID := c.Param("otherUserId")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the authenticated user is one of the participants
+	if authUserID != userID && authUserID != otherUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only access your own messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rc.loadSetting(models.DirectChatKey(userID, otherUserID)))
+}
+
+// UpdateDirectRetention changes the retention timer of a direct chat
+func (rc *RetentionController) UpdateDirectRetention(c *gin.Context) {
+	userID := c.Param("userId")
+	otherUserID := c.Param("otherUserId")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the authenticated user is one of the participants
+	if authUserID != userID && authUserID != otherUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only change your own chats"})
+		return
+	}
+
+	// Parse request body
+	var req UpdateRetentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if the other user exists
+	receiverID := otherUserID
+	if authUserID == otherUserID {
+		receiverID = userID
+	}
+	var receiver models.User
+	result := rc.db.First(&receiver, "id = ?", receiverID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	setting, changed, err := rc.saveSetting(models.DirectChatKey(userID, otherUserID), models.RetentionTimer(req.Timer), authUserID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention timer"})
+		return
+	}
+
+	if changed {
+		sendSystemMessage(rc.db, rc.mqttClient, authUserID.(string), &receiverID, nil, rc.timerChangedText(authUserID.(string), setting.Timer))
+	}
+
+	c.JSON(http.StatusOK, setting)
+}
+
+// GetGroupRetention gets the retention timer of a group
+func (rc *RetentionController) GetGroupRetention(c *gin.Context) {
+	groupID := c.Param("groupId")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(rc.db, groupID, authUserID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rc.loadSetting(models.GroupChatKey(groupID)))
+}
+
+// UpdateGroupRetention changes the retention timer of a group (admins only)
+func (rc *RetentionController) UpdateGroupRetention(c *gin.Context) {
+	groupID := c.Param("groupId")
+
+	// Get the authenticated user ID from the context
+	authUserID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req UpdateRetentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if the group exists
+	var group models.Group
+	result := rc.db.First(&group, "id = ?", groupID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	// Check if the user is an admin of the group
+	if !isGroupAdmin(rc.db, groupID, authUserID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You must be an admin to change the disappearing messages timer"})
+		return
+	}
+
+	setting, changed, err := rc.saveSetting(models.GroupChatKey(groupID), models.RetentionTimer(req.Timer), authUserID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention timer"})
+		return
+	}
+
+	if changed {
+		sendSystemMessage(rc.db, rc.mqttClient, authUserID.(string), nil, &groupID, rc.timerChangedText(authUserID.(string), setting.Timer))
+	}
+
+	c.JSON(http.StatusOK, setting)
+}
+
+// loadSetting loads the retention setting of a chat, defaulting to off
+func (rc *RetentionController) loadSetting(chatKey string) models.RetentionSetting {
+	setting := models.RetentionSetting{ChatKey: chatKey, Timer: models.RetentionOff}
+	rc.db.Where("chat_key = ?", chatKey).Limit(1).Find(&setting)
+	return setting
+}
+
+// saveSetting stores the retention timer of a chat and reports whether it changed
+func (rc *RetentionController) saveSetting(chatKey string, timer models.RetentionTimer, userID string) (models.RetentionSetting, bool, error) {
+	setting := rc.loadSetting(chatKey)
+	if setting.Timer == timer {
+		return setting, false, nil
+	}
+
+	now := time.Now()
+	if setting.CreatedAt.IsZero() {
+		setting.CreatedAt = now
+	}
+	setting.Timer = timer
+	setting.UpdatedByID = userID
+	setting.UpdatedAt = now
+
+	if err := rc.db.Save(&setting).Error; err != nil {
+		return setting, false, err
+	}
+
+	return setting, true, nil
+}
+
+// timerChangedText builds the system message announcing a new retention timer
+func (rc *RetentionController) timerChangedText(userID string, timer models.RetentionTimer) string {
+	var user models.User
+	rc.db.First(&user, "id = ?", userID)
+
+	if timer == models.RetentionOff {
+		return user.Username + " turned off disappearing messages"
+	}
+	return fmt.Sprintf("%s set disappearing messages to %s", user.Username, timer)
+}
@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SavedMessageController handles the saved (starred) messages of users
+type SavedMessageController struct {
+	db *gorm.DB
+}
+
+// NewSavedMessageController creates a new saved message controller
+func NewSavedMessageController(db *gorm.DB) *SavedMessageController {
+	return &SavedMessageController{db: db}
+}
+
+// SaveMessageRequest represents the request body for saving a message
+type SaveMessageRequest struct {
+	MessageID string   `json:"message_id" binding:"required"`
+	Note      *string  `json:"note" binding:"omitempty,max=1000"`
+	Tags      []string `json:"tags" binding:"omitempty,max=20,dive,min=1,max=50"`
+}
+
+// UpdateSavedMessageRequest represents the request body for updating a saved message
+type UpdateSavedMessageRequest struct {
+	Note *string   `json:"note" binding:"omitempty,max=1000"`
+	Tags *[]string `json:"tags" binding:"omitempty,max=20,dive,min=1,max=50"`
+}
+
+// SavedMessagesPage represents a page of saved messages
+type SavedMessagesPage struct {
+	Items      []models.SavedMessage `json:"items"`
+	NextCursor *string               `json:"next_cursor"`
+}
+
+// SaveMessage adds a message to the authenticated user's saved messages
+func (sc *SavedMessageController) SaveMessage(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req SaveMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if the message exists
+	var message models.Message
+	result := sc.db.First(&message, "id = ?", req.MessageID)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	// Check if the user can see the message
+	if !canAccessMessage(sc.db, &message, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this message"})
+		return
+	}
+
+	// Check if the message is already saved
+	var existing models.SavedMessage
+	result = sc.db.Where("user_id = ? AND message_id = ?", userID, req.MessageID).First(&existing)
+	if result.Error == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message is already saved"})
+		return
+	}
+
+	// Save the message
+	now := time.Now()
+	saved := models.SavedMessage{
+		ID:        uuid.New().String(),
+		UserID:    userID.(string),
+		MessageID: req.MessageID,
+		Note:      req.Note,
+		Tags:      req.Tags,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if saved.Tags == nil {
+		saved.Tags = []string{}
+	}
+
+	result = sc.db.Create(&saved)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save message"})
+		return
+	}
+
+	// Load message details
+	sc.db.Preload("Sender").First(&saved.Message, "id = ?", saved.MessageID)
+
+	c.JSON(http.StatusCreated, saved)
+}
+
+// UpdateSavedMessage updates the note or tags of a saved message
+func (sc *SavedMessageController) UpdateSavedMessage(c *gin.Context) {
+	messageID := c.Param("messageId")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req UpdateSavedMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Find the saved message
+	var saved models.SavedMessage
+	result := sc.db.Where("user_id = ? AND message_id = ?", userID, messageID).First(&saved)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Saved message not found"})
+		return
+	}
+
+	// Update fields if provided
+	if req.Note != nil {
+		saved.Note = req.Note
+	}
+
+	if req.Tags != nil {
+		saved.Tags = *req.Tags
+	}
+
+	saved.UpdatedAt = time.Now()
+
+	result = sc.db.Save(&saved)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update saved message"})
+		return
+	}
+
+	// Load message details
+	sc.db.Preload("Sender").First(&saved.Message, "id = ?", saved.MessageID)
+
+	c.JSON(http.StatusOK, saved)
+}
+
+// UnsaveMessage removes a message from the authenticated user's saved messages
+func (sc *SavedMessageController) UnsaveMessage(c *gin.Context) {
+	messageID := c.Param("messageId")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	result := sc.db.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&models.SavedMessage{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove saved message"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Saved message not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Saved message removed successfully"})
+}
+
+// GetSavedMessages lists the authenticated user's saved messages, most recently saved first.
+// Supports cursor pagination via the "cursor" and "limit" query parameters and filtering by "tag".
+func (sc *SavedMessageController) GetSavedMessages(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	limit := parseLimit(c.Query("limit"), 50, 100)
+
+	query := sc.db.Preload("Message.Sender").Where("user_id = ?", userID)
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		cursor, err := decodeCursor(cursorParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.Where("(created_at, id) < (?, ?)", cursor.Time, cursor.ID)
+	}
+
+	if tag := c.Query("tag"); tag != "" {
+		tagJSON, _ := json.Marshal([]string{tag})
+		query = query.Where("tags @> ?", string(tagJSON))
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	var saved []models.SavedMessage
+	result := query.Order("created_at DESC, id DESC").Limit(limit + 1).Find(&saved)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get saved messages"})
+		return
+	}
+
+	page := SavedMessagesPage{Items: saved}
+	if len(saved) > limit {
+		page.Items = saved[:limit]
+		last := page.Items[limit-1]
+		next := encodeCursor(last.CreatedAt, last.ID)
+		page.NextCursor = &next
+	}
+	if page.Items == nil {
+		page.Items = []models.SavedMessage{}
+	}
+
+	c.JSON(http.StatusOK, page)
+}
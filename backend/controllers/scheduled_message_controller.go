@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxScheduleAhead is how far in the future a message can be scheduled
+const MaxScheduleAhead = 365 * 24 * time.Hour
+
+// ScheduledMessageController handles messages scheduled to be sent later
+type ScheduledMessageController struct {
+	db *gorm.DB
+}
+
+// NewScheduledMessageController creates a new scheduled message controller
+func NewScheduledMessageController(db *gorm.DB) *ScheduledMessageController {
+	return &ScheduledMessageController{db: db}
+}
+
+// CreateScheduledMessageRequest represents the request body for scheduling a message.
+// Exactly one of ReceiverID and GroupID must be set.
+type CreateScheduledMessageRequest struct {
+	ReceiverID *string                `json:"receiver_id"`
+	GroupID    *string                `json:"group_id"`
+	Content    string                 `json:"content"`
+	Type       string                 `json:"type" binding:"required"`
+	Metadata   models.MessageMetadata `json:"metadata"`
+	SendAt     time.Time              `json:"send_at" binding:"required"`
+}
+
+// UpdateScheduledMessageRequest represents the request body for editing a scheduled message
+type UpdateScheduledMessageRequest struct {
+	Content  *string                `json:"content"`
+	Type     *string                `json:"type"`
+	Metadata models.MessageMetadata `json:"metadata"`
+	SendAt   *time.Time             `json:"send_at"`
+}
+
+// CreateScheduledMessage schedules a direct or group message
+func (sc *ScheduledMessageController) CreateScheduledMessage(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	senderID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req CreateScheduledMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if (req.ReceiverID == nil) == (req.GroupID == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exactly one of receiver_id and group_id is required"})
+		return
+	}
+
+	if !validSendAt(req.SendAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "send_at must be in the future and within one year"})
+		return
+	}
+
+	// Check the message against its type
+	if err := models.ValidateUserMessage(models.MessageType(req.Type), req.Content, req.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check that the message could be sent right now
+	if req.ReceiverID != nil {
+		var receiver models.User
+		result := sc.db.First(&receiver, "id = ?", *req.ReceiverID)
+		if result.Error != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Receiver not found"})
+			return
+		}
+	} else {
+		var group models.Group
+		result := sc.db.First(&group, "id = ?", *req.GroupID)
+		if result.Error != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+
+		if !isGroupMember(sc.db, *req.GroupID, senderID.(string)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+			return
+		}
+	}
+
+	// Create scheduled message
+	now := time.Now()
+	scheduled := models.ScheduledMessage{
+		ID:         uuid.New().String(),
+		SenderID:   senderID.(string),
+		ReceiverID: req.ReceiverID,
+		GroupID:    req.GroupID,
+		Content:    req.Content,
+		Type:       models.MessageType(req.Type),
+		Metadata:   req.Metadata,
+		SendAt:     req.SendAt,
+		Status:     models.ScheduledPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	result := sc.db.Create(&scheduled)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule message"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, scheduled)
+}
+
+// GetScheduledMessages lists the authenticated user's scheduled messages.
+// Only pending messages are returned unless a "status" query parameter is given.
+func (sc *ScheduledMessageController) GetScheduledMessages(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	senderID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	status := c.DefaultQuery("status", string(models.ScheduledPending))
+
+	scheduled := []models.ScheduledMessage{}
+	result := sc.db.Where("sender_id = ? AND status = ?", senderID, status).Order("send_at ASC").Find(&scheduled)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get scheduled messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, scheduled)
+}
+
+// UpdateScheduledMessage edits a pending scheduled message
+func (sc *ScheduledMessageController) UpdateScheduledMessage(c *gin.Context) {
+	scheduledID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	senderID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req UpdateScheduledMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Find the scheduled message
+	var scheduled models.ScheduledMessage
+	result := sc.db.Where("id = ? AND sender_id = ?", scheduledID, senderID).First(&scheduled)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled message not found"})
+		return
+	}
+
+	// Update fields if provided
+	if req.Content != nil {
+		scheduled.Content = *req.Content
+	}
+
+	if req.Type != nil {
+		// Metadata belongs to the type, so a new type starts without the old metadata
+		if models.MessageType(*req.Type) != scheduled.Type {
+			scheduled.Metadata = nil
+		}
+		scheduled.Type = models.MessageType(*req.Type)
+	}
+
+	if req.Metadata != nil {
+		scheduled.Metadata = req.Metadata
+	}
+
+	if req.SendAt != nil {
+		if !validSendAt(*req.SendAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "send_at must be in the future and within one year"})
+			return
+		}
+		scheduled.SendAt = *req.SendAt
+	}
+
+	// Check the edited message against its type
+	if err := models.ValidateUserMessage(scheduled.Type, scheduled.Content, scheduled.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	scheduled.UpdatedAt = time.Now()
+
+	// Only update while still pending so we never race with the scheduler
+	result = sc.db.Model(&models.ScheduledMessage{}).
+		Where("id = ? AND status = ?", scheduled.ID, models.ScheduledPending).
+		Select("content", "type", "metadata", "send_at", "updated_at").
+		Updates(&scheduled)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update scheduled message"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Scheduled message is no longer pending"})
+		return
+	}
+
+	sc.db.First(&scheduled, "id = ?", scheduled.ID)
+
+	c.JSON(http.StatusOK, scheduled)
+}
+
+// CancelScheduledMessage cancels a pending scheduled message
+func (sc *ScheduledMessageController) CancelScheduledMessage(c *gin.Context) {
+	scheduledID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	senderID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Find the scheduled message
+	var scheduled models.ScheduledMessage
+	result := sc.db.Where("id = ? AND sender_id = ?", scheduledID, senderID).First(&scheduled)
+	if result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled message not found"})
+		return
+	}
+
+	result = sc.db.Model(&models.ScheduledMessage{}).
+		Where("id = ? AND status = ?", scheduled.ID, models.ScheduledPending).
+		Updates(map[string]interface{}{"status": models.ScheduledCancelled, "updated_at": time.Now()})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled message"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Scheduled message is no longer pending"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled message cancelled successfully"})
+}
+
+// validSendAt checks that a send time is in the future and not too far ahead
+func validSendAt(sendAt time.Time) bool {
+	now := time.Now()
+	return sendAt.After(now) && sendAt.Before(now.Add(MaxScheduleAhead))
+}
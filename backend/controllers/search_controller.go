@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/models"
+	"backend/search"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SearchController handles message search requests
+type SearchController struct {
+	db    *gorm.DB
+	index search.Index
+}
+
+// NewSearchController creates a new search controller
+func NewSearchController(db *gorm.DB, index search.Index) *SearchController {
+	return &SearchController{db: db, index: index}
+}
+
+// MessageSearchHit represents a message matching a search with its highlighted snippet
+type MessageSearchHit struct {
+	Message models.Message `json:"message"`
+	Rank    float64        `json:"rank"`
+	Snippet string         `json:"snippet"`
+}
+
+// MessageSearchResponse represents a page of message search results
+type MessageSearchResponse struct {
+	Results    []MessageSearchHit `json:"results"`
+	NextCursor *string            `json:"next_cursor"`
+}
+
+// SearchMessages searches the content of messages the authenticated user can see.
+// Optional filters: sender_id, group_id, user_id (the other participant of a direct chat),
+// type, from and to (RFC 3339). Paginated with cursor and limit.
+func (sc *SearchController) SearchMessages(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+
+	query := search.Query{
+		UserID:      userID.(string),
+		Text:        text,
+		SenderID:    c.Query("sender_id"),
+		GroupID:     c.Query("group_id"),
+		OtherUserID: c.Query("user_id"),
+		Type:        c.Query("type"),
+		Cursor:      c.Query("cursor"),
+		Limit:       parseLimit(c.Query("limit"), 20, 50),
+	}
+
+	if fromParam := c.Query("from"); fromParam != "" {
+		from, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+		query.From = &from
+	}
+
+	if toParam := c.Query("to"); toParam != "" {
+		to, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+		query.To = &to
+	}
+
+	result, err := sc.index.Search(c.Request.Context(), query)
+	if errors.Is(err, search.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+
+	// Load the matching messages
+	messageIDs := make([]string, len(result.Hits))
+	for i, hit := range result.Hits {
+		messageIDs[i] = hit.MessageID
+	}
+
+	var messages []models.Message
+	if len(messageIDs) > 0 {
+		if err := sc.db.Preload("Sender").Where("id IN ?", messageIDs).Find(&messages).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load messages"})
+			return
+		}
+	}
+
+	messageMap := make(map[string]models.Message)
+	for _, m := range messages {
+		messageMap[m.ID] = m
+	}
+
+	// Keep the ranking order of the hits
+	response := MessageSearchResponse{Results: []MessageSearchHit{}, NextCursor: result.NextCursor}
+	for _, hit := range result.Hits {
+		if m, ok := messageMap[hit.MessageID]; ok {
+			response.Results = append(response.Results, MessageSearchHit{Message: m, Rank: hit.Rank, Snippet: hit.Snippet})
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
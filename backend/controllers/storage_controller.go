@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// StorageController reports storage usage and manages the storage quotas of groups
+type StorageController struct {
+	db *gorm.DB
+}
+
+// NewStorageController creates a new storage controller
+func NewStorageController(db *gorm.DB) *StorageController {
+	return &StorageController{db: db}
+}
+
+// StorageUsage represents the storage used against a quota
+type StorageUsage struct {
+	UsedBytes  int64              `json:"used_bytes"`
+	QuotaBytes int64              `json:"quota_bytes"`
+	Policy     models.QuotaPolicy `json:"policy,omitempty"`
+}
+
+// UpdateGroupStorageRequest represents the request body for changing a group's storage policy
+type UpdateGroupStorageRequest struct {
+	// QuotaBytes lowers the group's quota; null restores the default
+	QuotaBytes *int64             `json:"quota_bytes" binding:"omitempty,min=0"`
+	Policy     models.QuotaPolicy `json:"policy" binding:"required,oneof=block expire_oldest"`
+}
+
+// GetUsage gets the storage used by the authenticated user
+func (sc *StorageController) GetUsage(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	used, err := models.UserStorageUsage(sc.db, userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get storage usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, StorageUsage{UsedBytes: used, QuotaBytes: models.Quotas.UserBytes})
+}
+
+// GetGroupStorage gets the storage used by a group and its quota policy
+func (sc *StorageController) GetGroupStorage(c *gin.Context) {
+	groupID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Check if the user is a member of the group
+	if !isGroupMember(sc.db, groupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this group"})
+		return
+	}
+
+	sc.respondGroupStorage(c, groupID)
+}
+
+// UpdateGroupStorage changes the quota policy of a group (admins only). Admins can lower the
+// group's quota below the default, but not raise it.
+func (sc *StorageController) UpdateGroupStorage(c *gin.Context) {
+	groupID := c.Param("id")
+
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req UpdateGroupStorageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.QuotaBytes != nil && *req.QuotaBytes > models.Quotas.GroupBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quota cannot exceed the default group quota"})
+		return
+	}
+
+	// Check if the user is an admin of the group
+	if !isGroupAdmin(sc.db, groupID, userID.(string)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You must be an admin to change the group's storage policy"})
+		return
+	}
+
+	now := time.Now()
+	policy := models.LoadGroupStoragePolicy(sc.db, groupID)
+	if policy.CreatedAt.IsZero() {
+		policy.CreatedAt = now
+	}
+	policy.QuotaBytes = req.QuotaBytes
+	policy.Policy = req.Policy
+	policy.UpdatedByID = userID.(string)
+	policy.UpdatedAt = now
+
+	if err := sc.db.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update storage policy"})
+		return
+	}
+
+	sc.respondGroupStorage(c, groupID)
+}
+
+// respondGroupStorage writes the storage usage and policy of a group
+func (sc *StorageController) respondGroupStorage(c *gin.Context, groupID string) {
+	used, err := models.GroupStorageUsage(sc.db, groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get storage usage"})
+		return
+	}
+
+	policy := models.LoadGroupStoragePolicy(sc.db, groupID)
+	c.JSON(http.StatusOK, StorageUsage{UsedBytes: used, QuotaBytes: policy.Quota(), Policy: policy.Policy})
+}
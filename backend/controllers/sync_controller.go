@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SyncController handles catching up reconnecting clients
+type SyncController struct {
+	db *gorm.DB
+}
+
+// NewSyncController creates a new sync controller
+func NewSyncController(db *gorm.DB) *SyncController {
+	return &SyncController{db: db}
+}
+
+// SyncResponse represents the changes since a sync cursor
+type SyncResponse struct {
+	Messages      []models.Message          `json:"messages"`
+	Deleted       []models.MessageTombstone `json:"deleted"`
+	DeletedGroups []models.GroupTombstone   `json:"deleted_groups"`
+	NextCursor    string                    `json:"next_cursor"`
+	HasMore       bool                      `json:"has_more"`
+}
+
+// Sync returns all messages created or edited and all messages deleted since the "since"
+// cursor across the authenticated user's direct chats and groups, and the groups the user
+// was removed from or that were deleted.
+// Without a cursor only a starting cursor is returned. Clients keep calling with
+// next_cursor while has_more is true.
+func (sc *SyncController) Sync(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	now := time.Now()
+	response := SyncResponse{
+		Messages:      []models.Message{},
+		Deleted:       []models.MessageTombstone{},
+		DeletedGroups: []models.GroupTombstone{},
+	}
+
+	// Changes are read up to the oldest transaction still running, so ones that commit later are not skipped
+	horizon, err := models.SyncHorizon(sc.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync messages"})
+		return
+	}
+
+	sinceParam := c.Query("since")
+	if sinceParam == "" {
+		response.NextCursor = encodeSyncCursor(syncCursor{IssuedAt: now, TxID: horizon})
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	since, err := decodeSyncCursor(sinceParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+
+	// Deletions older than the tombstone retention cannot be replayed
+	if since.IssuedAt.Before(now.Add(-models.TombstoneRetention)) {
+		c.JSON(http.StatusGone, gin.H{"error": "Sync cursor has expired, reload conversations"})
+		return
+	}
+
+	limit := parseLimit(c.Query("limit"), 200, 500)
+
+	// Get new and edited messages in the user's chats
+	var messages []models.Message
+	result := sc.db.Preload("Sender").
+		Where(userChatsCondition, userID, userID, userID).
+		Where("(change_tx_id, id) > (?, ?) AND change_tx_id < ?", since.TxID, since.ID, horizon).
+		Order("change_tx_id ASC, id ASC").
+		Limit(limit + 1).
+		Find(&messages)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync messages"})
+		return
+	}
+
+	// Deletions are returned up to the point the messages were returned up to. A cursor in the
+	// middle of the changes keeps the time the sync started at, which bounds how old they are.
+	upTo := horizon
+	response.NextCursor = encodeSyncCursor(syncCursor{IssuedAt: now, TxID: horizon})
+	if len(messages) > limit {
+		messages = messages[:limit]
+		last := messages[limit-1]
+		upTo = last.ChangeTxID
+		response.NextCursor = encodeSyncCursor(syncCursor{IssuedAt: since.IssuedAt, TxID: last.ChangeTxID, ID: last.ID})
+		response.HasMore = true
+	}
+	if len(messages) > 0 {
+		response.Messages = messages
+	}
+
+	// Load the polls of poll messages
+	if err := attachPolls(sc.db, userID.(string), response.Messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync messages"})
+		return
+	}
+
+	// Get deleted messages in the user's chats
+	result = sc.db.
+		Where(userChatsCondition, userID, userID, userID).
+		Where("change_tx_id >= ? AND change_tx_id < ?", since.TxID, upTo).
+		Order("change_tx_id ASC, message_id ASC").
+		Find(&response.Deleted)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync deleted messages"})
+		return
+	}
+
+	// Get groups the user lost access to
+	result = sc.db.
+		Where("user_id = ? AND change_tx_id >= ? AND change_tx_id < ?", userID, since.TxID, upTo).
+		Order("change_tx_id ASC, group_id ASC").
+		Find(&response.DeletedGroups)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync deleted groups"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// userChatsCondition matches rows of the direct chats and groups a user takes part in.
+// It takes the user ID three times.
+const userChatsCondition = "(sender_id = ? AND receiver_id IS NOT NULL) OR receiver_id = ? OR group_id IN (SELECT group_id FROM group_users WHERE user_id = ?)"
+
+// syncCursor is a position in the changes to messages. Changes are ordered by the transaction
+// that made them (see models.SyncHorizon), IssuedAt is when the sync reading them started.
+type syncCursor struct {
+	IssuedAt time.Time
+	TxID     int64
+	ID       string
+}
+
+// encodeSyncCursor encodes a sync cursor into an opaque string for clients
+func encodeSyncCursor(cursor syncCursor) string {
+	return encodeCursor(cursor.IssuedAt, strconv.FormatInt(cursor.TxID, 10)+"|"+cursor.ID)
+}
+
+// decodeSyncCursor decodes a cursor produced by encodeSyncCursor
+func decodeSyncCursor(s string) (*syncCursor, error) {
+	cursor, err := decodeCursor(s)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(cursor.ID, "|", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+
+	txID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	return &syncCursor{IssuedAt: cursor.Time, TxID: txID, ID: parts[1]}, nil
+}
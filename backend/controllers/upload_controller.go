@@ -0,0 +1,546 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+	"backend/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxResumableUploadSize is the largest file that can be uploaded in chunks, in bytes
+	MaxResumableUploadSize = 1 << 30
+
+	// MaxUploadChunkSize is the largest chunk accepted per request, in bytes
+	MaxUploadChunkSize = 16 << 20
+
+	// uploadChunkContentType is the content type of chunk requests, as in the tus protocol
+	uploadChunkContentType = "application/offset+octet-stream"
+
+	// statusChecksumMismatch is the status the tus protocol uses for chunks that fail verification
+	statusChecksumMismatch = 460
+)
+
+// sha256Pattern matches a hex encoded SHA-256 checksum
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// UploadController handles resumable uploads. It follows the core of the tus protocol
+// (https://tus.io): chunks are sent with PATCH at the offset reported by HEAD, using the
+// Upload-Offset and Upload-Checksum headers.
+type UploadController struct {
+	db          *gorm.DB
+	storage     storage.Storage
+	attachments *AttachmentController
+}
+
+// NewUploadController creates a new upload controller
+func NewUploadController(db *gorm.DB, store storage.Storage, attachments *AttachmentController) *UploadController {
+	return &UploadController{db: db, storage: store, attachments: attachments}
+}
+
+// CreateUploadRequest represents the request body for starting a resumable upload
+type CreateUploadRequest struct {
+	FileName string `json:"file_name" binding:"required"`
+	Size     int64  `json:"size" binding:"required,min=1"`
+	// Checksum is the hex encoded SHA-256 of the whole file, verified when the upload completes
+	Checksum string `json:"checksum"`
+}
+
+// CreateUpload starts a resumable upload
+func (uc *UploadController) CreateUpload(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Parse request body
+	var req CreateUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Size > MaxResumableUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files must be at most %d MB", MaxResumableUploadSize>>20)})
+		return
+	}
+	checksum := strings.ToLower(req.Checksum)
+	if checksum != "" && !sha256Pattern.MatchString(checksum) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum must be a hex encoded SHA-256"})
+		return
+	}
+
+	now := time.Now()
+	upload := models.UploadSession{
+		ID:         uuid.New().String(),
+		UploaderID: userID.(string),
+		FileName:   sanitizeFileName(req.FileName),
+		Size:       req.Size,
+		Checksum:   checksum,
+		ExpiresAt:  now.Add(models.UploadSessionTTL),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	// The whole file is reserved against the quota until the upload completes or expires
+	err := uc.db.Transaction(func(tx *gorm.DB) error {
+		if err := models.CheckUserQuota(tx, upload.UploaderID, upload.Size); err != nil {
+			return err
+		}
+		return tx.Create(&upload).Error
+	})
+	var quotaErr *models.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		respondQuotaExceeded(c, quotaErr)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	c.Header("Location", "/api/uploads/"+upload.ID)
+	c.Header("Upload-Offset", "0")
+	c.JSON(http.StatusCreated, upload)
+}
+
+// GetUpload returns the details of a resumable upload
+func (uc *UploadController) GetUpload(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	upload, ok := uc.loadUpload(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.JSON(http.StatusOK, upload)
+}
+
+// GetUploadOffset reports how much of a resumable upload has been received, for resuming it
+func (uc *UploadController) GetUploadOffset(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	var upload models.UploadSession
+	if err := uc.db.First(&upload, "id = ? AND uploader_id = ? AND expires_at > ?", c.Param("id"), userID, time.Now()).Error; err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+}
+
+// UploadChunk appends a chunk to a resumable upload at the offset given in the Upload-Offset
+// header. The upload becomes an attachment when its last chunk arrives, and the attachment
+// is returned. Sending no data at the end of an upload retries completing it.
+func (uc *UploadController) UploadChunk(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	upload, ok := uc.loadUpload(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+
+	if c.ContentType() != uploadChunkContentType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Chunks must be sent as " + uploadChunkContentType})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+	if offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload is at offset %d", upload.Offset)})
+		return
+	}
+
+	// Chunks are stored as separate objects, which need their size up front
+	length := c.Request.ContentLength
+	if length < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length header is required"})
+		return
+	}
+	if length > MaxUploadChunkSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Chunks must be at most %d MB", MaxUploadChunkSize>>20)})
+		return
+	}
+	if offset+length > upload.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk extends past the end of the upload"})
+		return
+	}
+
+	expectedChecksum, err := parseUploadChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if length > 0 {
+		upload, ok = uc.appendChunk(c, upload, length, expectedChecksum)
+		if !ok {
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if !upload.IsComplete() {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	uc.completeUpload(c, upload)
+}
+
+// CancelUpload abandons a resumable upload and deletes the chunks received so far
+func (uc *UploadController) CancelUpload(c *gin.Context) {
+	// Get the authenticated user ID from the context
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	upload, ok := uc.loadUpload(c, c.Param("id"), userID.(string))
+	if !ok {
+		return
+	}
+	if upload.AttachmentID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload has been completed"})
+		return
+	}
+
+	if err := deleteUpload(c.Request.Context(), uc.db, uc.storage, upload.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel upload"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload cancelled"})
+}
+
+// loadUpload loads an unexpired upload of the user, writing the error response if there is none
+func (uc *UploadController) loadUpload(c *gin.Context, uploadID, userID string) (*models.UploadSession, bool) {
+	var upload models.UploadSession
+	if err := uc.db.First(&upload, "id = ? AND uploader_id = ?", uploadID, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	if !upload.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Upload has expired"})
+		return nil, false
+	}
+	return &upload, true
+}
+
+// appendChunk stores the request body as the next chunk of an upload, writing the error
+// response if that fails. It returns the updated upload.
+func (uc *UploadController) appendChunk(c *gin.Context, upload *models.UploadSession, length int64, expectedChecksum []byte) (*models.UploadSession, bool) {
+	ctx := c.Request.Context()
+
+	// Continue the checksum of the whole file from where the previous chunk left off
+	fileHash := sha256.New()
+	if len(upload.HashState) > 0 {
+		if err := fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resume upload"})
+			return nil, false
+		}
+	}
+	chunkHash := sha256.New()
+
+	// Concurrent requests for the same offset each store their own object; only one is kept
+	key := fmt.Sprintf("uploads/%s/%d-%s", upload.ID, upload.Offset, uuid.New().String())
+	body := io.TeeReader(io.LimitReader(c.Request.Body, length), io.MultiWriter(fileHash, chunkHash))
+	if err := uc.storage.Put(ctx, key, body, length, uploadChunkContentType); err != nil {
+		// Most likely the connection dropped; the client resumes from the current offset
+		uc.storage.Delete(ctx, key)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to receive chunk"})
+		return nil, false
+	}
+
+	if expectedChecksum != nil && !bytes.Equal(chunkHash.Sum(nil), expectedChecksum) {
+		uc.storage.Delete(ctx, key)
+		c.JSON(statusChecksumMismatch, gin.H{"error": "Chunk checksum does not match"})
+		return nil, false
+	}
+
+	hashState, err := fileHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		uc.storage.Delete(ctx, key)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
+		return nil, false
+	}
+
+	var updated models.UploadSession
+	err = uc.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&updated, "id = ?", upload.ID).Error; err != nil {
+			return err
+		}
+		if updated.Offset != upload.Offset {
+			return errUploadOffsetMoved
+		}
+
+		now := time.Now()
+		chunk := models.UploadChunk{UploadID: upload.ID, Offset: upload.Offset, Size: length, StorageKey: key, CreatedAt: now}
+		if err := tx.Create(&chunk).Error; err != nil {
+			return err
+		}
+
+		updated.Offset += length
+		updated.HashState = hashState
+		updated.ExpiresAt = now.Add(models.UploadSessionTTL)
+		updated.UpdatedAt = now
+		return tx.Model(&updated).Select("byte_offset", "hash_state", "expires_at", "updated_at").Updates(&updated).Error
+	})
+	if err != nil {
+		uc.storage.Delete(ctx, key)
+		if errors.Is(err, errUploadOffsetMoved) {
+			c.Header("Upload-Offset", strconv.FormatInt(updated.Offset, 10))
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload is at offset %d", updated.Offset)})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
+		return nil, false
+	}
+
+	return &updated, true
+}
+
+// Errors returned when another request changed an upload first
+var (
+	errUploadOffsetMoved = errors.New("upload offset moved")
+	errUploadCompleted   = errors.New("upload already completed")
+)
+
+// completeUpload joins the chunks of a complete upload into an attachment and responds with it
+func (uc *UploadController) completeUpload(c *gin.Context, upload *models.UploadSession) {
+	ctx := c.Request.Context()
+
+	// Completing is idempotent, so a client that missed the response can ask again
+	if upload.AttachmentID != nil {
+		var attachment models.Attachment
+		if err := uc.db.First(&attachment, "id = ?", *upload.AttachmentID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+		c.JSON(http.StatusOK, attachment)
+		return
+	}
+
+	// Verify the whole file against the checksum declared when the upload started
+	fileHash := sha256.New()
+	if err := fileHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	checksum := hex.EncodeToString(fileHash.Sum(nil))
+	if upload.Checksum != "" && checksum != upload.Checksum {
+		deleteUpload(ctx, uc.db, uc.storage, upload.ID)
+		c.JSON(statusChecksumMismatch, gin.H{"error": "File checksum does not match, upload it again"})
+		return
+	}
+
+	var chunks []models.UploadChunk
+	if err := uc.db.Where("upload_id = ?", upload.ID).Order("byte_offset ASC").Find(&chunks).Error; err != nil || len(chunks) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+
+	// Detect the content type from the file itself rather than trusting the client
+	head, err := uc.readHead(ctx, chunks[0])
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	contentType := detectContentType(head, upload.FileName)
+	if !isAllowedAttachmentType(contentType) {
+		deleteUpload(ctx, uc.db, uc.storage, upload.ID)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("Files of type %s cannot be uploaded", contentType)})
+		return
+	}
+
+	attachment := uc.attachments.newAttachment(upload.UploaderID, upload.FileName, contentType, upload.Size)
+	attachment.Checksum = checksum
+
+	keys := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		keys[i] = chunk.StorageKey
+	}
+	reader := &chunkReader{ctx: ctx, storage: uc.storage, keys: keys}
+	err = uc.storage.Put(ctx, attachment.StorageKey, reader, attachment.Size, contentType)
+	reader.Close()
+	if err != nil {
+		log.Printf("Failed to join upload %s: %v", upload.ID, err)
+		uc.storage.Delete(ctx, attachment.StorageKey)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	// Claim the upload when saving the attachment, so its reserved size moves to the attachment at
+	// once and concurrent completions do not create two attachments
+	err = uc.attachments.saveAttachment(ctx, attachment, func(tx *gorm.DB) error {
+		result := tx.Model(&models.UploadSession{}).
+			Where("id = ? AND attachment_id IS NULL", upload.ID).
+			Update("attachment_id", attachment.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errUploadCompleted
+		}
+		return nil
+	})
+	if errors.Is(err, errUploadCompleted) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is already being completed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+
+	// The chunks are no longer needed; the session is kept until it expires so retries find the attachment
+	if err := deleteUploadChunks(ctx, uc.db, uc.storage, upload.ID); err != nil {
+		log.Printf("Failed to delete chunks of upload %s: %v", upload.ID, err)
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// readHead reads the first bytes of a chunk for content type detection
+func (uc *UploadController) readHead(ctx context.Context, chunk models.UploadChunk) ([]byte, error) {
+	reader, _, err := uc.storage.Get(ctx, chunk.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// deleteUpload deletes an upload session and its chunks
+func deleteUpload(ctx context.Context, db *gorm.DB, store storage.Storage, uploadID string) error {
+	if err := deleteUploadChunks(ctx, db, store, uploadID); err != nil {
+		return err
+	}
+	return db.Where("id = ?", uploadID).Delete(&models.UploadSession{}).Error
+}
+
+// deleteUploadChunks deletes the stored chunks of an upload
+func deleteUploadChunks(ctx context.Context, db *gorm.DB, store storage.Storage, uploadID string) error {
+	var chunks []models.UploadChunk
+	if err := db.Where("upload_id = ?", uploadID).Find(&chunks).Error; err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := store.Delete(ctx, chunk.StorageKey); err != nil {
+			return err
+		}
+	}
+	return db.Where("upload_id = ?", uploadID).Delete(&models.UploadChunk{}).Error
+}
+
+// parseUploadChecksum parses an Upload-Checksum header of the form "sha256 <base64 digest>"
+func parseUploadChecksum(header string) ([]byte, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	algorithm, encoded, ok := strings.Cut(header, " ")
+	if !ok || algorithm != "sha256" {
+		return nil, errors.New("Upload-Checksum must be a sha256 checksum")
+	}
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, errors.New("Upload-Checksum must be a base64 encoded sha256 checksum")
+	}
+	return checksum, nil
+}
+
+// chunkReader reads stored chunks one after another, opening each only when it is reached
+type chunkReader struct {
+	ctx     context.Context
+	storage storage.Storage
+	keys    []string
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			reader, _, err := r.storage.Get(r.ctx, r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current = reader
+			r.keys = r.keys[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the chunk being read, if any
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
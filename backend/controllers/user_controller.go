@@ -72,7 +72,9 @@ func (uc *UserController) SearchUsers(c *gin.Context) {
 	c.JSON(http.StatusOK, users)
 }
 
-// UpdateUserRequest represents the request body for updating a user
+// UpdateUserRequest represents the request body for updating a user.
+// Avatars are uploaded through UploadUserAvatar; an avatar_url is accepted only
+// when it is null or the current avatar, as sent back by clients updating other fields.
 type UpdateUserRequest struct {
 	Username  *string `json:"username"`
 	AvatarURL *string `json:"avatar_url"`
@@ -114,6 +116,11 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	if req.AvatarURL != nil && !models.IsCurrentAvatarURL(user.AvatarKey, *req.AvatarURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatars can only be changed by uploading an image"})
+		return
+	}
+
 	// Update user fields if provided
 	if req.Username != nil {
 		// Check if username is already taken
@@ -127,10 +134,6 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 		user.Username = *req.Username
 	}
 
-	if req.AvatarURL != nil {
-		user.AvatarURL = req.AvatarURL
-	}
-
 	// Update last seen and updated at
 	user.LastSeen = time.Now()
 	user.UpdatedAt = time.Now()
@@ -154,7 +157,7 @@ func (uc *UserController) GetUserGroups(c *gin.Context) {
 	}
 
 	// Get the authenticated user ID from the context
-	_, exists := c.Get("user_id")
+	authUserID, exists := c.Get("user_id")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
@@ -168,9 +171,23 @@ func (uc *UserController) GetUserGroups(c *gin.Context) {
 		return
 	}
 
-	// Get all groups that the user is a member of
-	var groupUsers []models.GroupUser
-	result = uc.db.Where("user_id = ?", userID).Find(&groupUsers)
+	// Pinned and archived groups are personal, so they only affect the order of the user's own groups
+	preferenceUserID := ""
+	if authUserID == userID {
+		preferenceUserID = userID
+	}
+
+	// Get all groups that the user is a member of: pinned first, archived last, otherwise most recently active
+	var groupIDs []string
+	result = uc.db.Raw(`
+		SELECT gu.group_id
+		FROM group_users gu
+		LEFT JOIN conversations c ON c.group_id = gu.group_id
+		LEFT JOIN chat_preferences p ON p.chat_key = 'group:' || gu.group_id AND p.user_id = ?
+		WHERE gu.user_id = ?
+		ORDER BY COALESCE(p.is_pinned, false) DESC, p.pinned_at DESC NULLS LAST,
+			COALESCE(p.is_archived, false) ASC, COALESCE(c.last_message_at, gu.joined_at) DESC
+	`, preferenceUserID, userID).Scan(&groupIDs)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user groups"})
 		return
@@ -178,9 +195,9 @@ func (uc *UserController) GetUserGroups(c *gin.Context) {
 
 	// Get group details for each group
 	var groups []models.Group
-	for _, groupUser := range groupUsers {
+	for _, groupID := range groupIDs {
 		var group models.Group
-		result = uc.db.Preload("Creator").Preload("Members").First(&group, "id = ?", groupUser.GroupID)
+		result = uc.db.Preload("Creator").Preload("Members").First(&group, "id = ?", groupID)
 		if result.Error == nil {
 			groups = append(groups, group)
 		}
@@ -204,7 +221,8 @@ func (uc *UserController) GetRecentChats(c *gin.Context) {
 		return
 	}
 
-	// Use a subquery to get recent chat user IDs ordered by latest message timestamp
+	// Get the other participant of each of the user's direct conversations:
+	// pinned first, archived last, otherwise most recent first
 	type ChatUser struct {
 		UserID    string
 		LastMsgAt time.Time
@@ -212,18 +230,15 @@ func (uc *UserController) GetRecentChats(c *gin.Context) {
 	var chatUsers []ChatUser
 
 	uc.db.Raw(`
-		SELECT
-			CASE
-				WHEN sender_id = ? THEN receiver_id
-				WHEN receiver_id = ? THEN sender_id
-			END AS user_id,
-			MAX(timestamp) AS last_msg_at
-		FROM messages
-		WHERE (sender_id = ? OR receiver_id = ?)
-			AND receiver_id IS NOT NULL
-		GROUP BY user_id
-		ORDER BY last_msg_at DESC
-	`, userID, userID, userID, userID).Scan(&chatUsers)
+		SELECT COALESCE(peer.user_id, me.user_id) AS user_id, c.last_message_at AS last_msg_at
+		FROM conversation_participants me
+		JOIN conversations c ON c.id = me.conversation_id
+		LEFT JOIN conversation_participants peer ON peer.conversation_id = c.id AND peer.user_id <> me.user_id
+		LEFT JOIN chat_preferences p ON p.chat_key = c.key AND p.user_id = me.user_id
+		WHERE me.user_id = ? AND c.type = ? AND c.last_message_at IS NOT NULL
+		ORDER BY COALESCE(p.is_pinned, false) DESC, p.pinned_at DESC NULLS LAST,
+			COALESCE(p.is_archived, false) ASC, c.last_message_at DESC
+	`, userID, models.DirectConversation).Scan(&chatUsers)
 
 	if len(chatUsers) == 0 {
 		c.JSON(http.StatusOK, []interface{}{})
@@ -0,0 +1,148 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"backend/models"
+	"backend/storage"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// janitorInterval is how often orphaned attachments are looked for
+	janitorInterval = time.Hour
+
+	// janitorBatchSize is the maximum number of attachments deleted per batch
+	janitorBatchSize = 100
+)
+
+// AttachmentJanitor periodically deletes the files of attachments whose message was deleted,
+// of uploads that were never sent and of resumable uploads that were abandoned
+type AttachmentJanitor struct {
+	db      *gorm.DB
+	storage storage.Storage
+	stop    chan struct{}
+}
+
+// NewAttachmentJanitor creates a new attachment janitor
+func NewAttachmentJanitor(db *gorm.DB, store storage.Storage) *AttachmentJanitor {
+	return &AttachmentJanitor{db: db, storage: store, stop: make(chan struct{})}
+}
+
+// Start starts deleting orphaned attachments in the background
+func (j *AttachmentJanitor) Start() {
+	go func() {
+		j.clean()
+
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				j.clean()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the janitor
+func (j *AttachmentJanitor) Stop() {
+	close(j.stop)
+}
+
+// clean deletes orphaned attachments and abandoned uploads
+func (j *AttachmentJanitor) clean() {
+	j.cleanAttachments()
+	j.cleanUploads()
+}
+
+// cleanAttachments deletes orphaned attachments in batches until none are left
+func (j *AttachmentJanitor) cleanAttachments() {
+	// Attachments of scheduled messages that are yet to be sent are kept
+	scheduled := j.db.Model(&models.ScheduledMessage{}).
+		Select("metadata->>'attachment_id'").
+		Where("status IN ? AND metadata->>'attachment_id' IS NOT NULL", []models.ScheduledMessageStatus{models.ScheduledPending, models.ScheduledSending})
+
+	for {
+		var orphaned []models.Attachment
+		result := j.db.Where("message_id IS NULL AND (detached_at IS NOT NULL OR created_at < ?)", time.Now().Add(-models.UnattachedAttachmentTTL)).
+			Where("status <> ? AND id NOT IN (?)", models.AttachmentProcessing, scheduled).
+			Limit(janitorBatchSize).
+			Find(&orphaned)
+		if result.Error != nil {
+			log.Printf("Failed to load orphaned attachments: %v", result.Error)
+			return
+		}
+		if len(orphaned) == 0 {
+			return
+		}
+
+		for _, attachment := range orphaned {
+			// Keep the row if a file could not be deleted so it is retried
+			for _, key := range attachment.StorageKeys() {
+				if err := j.storage.Delete(context.Background(), key); err != nil {
+					log.Printf("Failed to delete attachment file %s: %v", key, err)
+					return
+				}
+			}
+			if err := j.db.Where("id = ? AND message_id IS NULL", attachment.ID).Delete(&models.Attachment{}).Error; err != nil {
+				log.Printf("Failed to delete attachment %s: %v", attachment.ID, err)
+				return
+			}
+		}
+
+		if len(orphaned) < janitorBatchSize {
+			return
+		}
+	}
+}
+
+// cleanUploads deletes expired upload sessions and their chunks in batches until none are left
+func (j *AttachmentJanitor) cleanUploads() {
+	for {
+		var expired []models.UploadSession
+		result := j.db.Where("expires_at <= ?", time.Now()).Limit(janitorBatchSize).Find(&expired)
+		if result.Error != nil {
+			log.Printf("Failed to load expired uploads: %v", result.Error)
+			return
+		}
+		if len(expired) == 0 {
+			return
+		}
+
+		for _, upload := range expired {
+			var chunks []models.UploadChunk
+			if err := j.db.Where("upload_id = ?", upload.ID).Find(&chunks).Error; err != nil {
+				log.Printf("Failed to load chunks of upload %s: %v", upload.ID, err)
+				return
+			}
+			for _, chunk := range chunks {
+				if err := j.storage.Delete(context.Background(), chunk.StorageKey); err != nil {
+					log.Printf("Failed to delete upload chunk %s: %v", chunk.StorageKey, err)
+					return
+				}
+			}
+
+			err := j.db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Where("upload_id = ?", upload.ID).Delete(&models.UploadChunk{}).Error; err != nil {
+					return err
+				}
+				return tx.Where("id = ?", upload.ID).Delete(&models.UploadSession{}).Error
+			})
+			if err != nil {
+				log.Printf("Failed to delete upload %s: %v", upload.ID, err)
+				return
+			}
+		}
+
+		if len(expired) < janitorBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"backend/linkpreview"
+	"backend/models"
+	"backend/mqtt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// linkPreviewWorkers is the number of previews fetched at the same time
+	linkPreviewWorkers = 4
+
+	// linkPreviewQueueSize is the number of messages waiting for previews in memory; messages
+	// that do not fit are picked up from the database by the next sweep
+	linkPreviewQueueSize = 256
+
+	// linkPreviewSweepInterval is how often pending previews left out of the queue are looked for
+	linkPreviewSweepInterval = time.Minute
+
+	// linkPreviewSweepBatchSize is the maximum number of pending previews queued per sweep
+	linkPreviewSweepBatchSize = linkPreviewQueueSize
+)
+
+// linkPreviewJob is a message waiting for the preview of the link in it
+type linkPreviewJob struct {
+	messageID string
+	link      string
+}
+
+// LinkPreviewer fetches previews of links in text messages in the background and attaches
+// them to the messages, so sends do not wait for other websites
+type LinkPreviewer struct {
+	db         *gorm.DB
+	fetcher    *linkpreview.Fetcher
+	mqttClient *mqtt.MQTTClient
+	queue      chan linkPreviewJob
+	stop       chan struct{}
+}
+
+// NewLinkPreviewer creates a new link previewer. Links are not previewed if the fetcher is nil.
+func NewLinkPreviewer(db *gorm.DB, fetcher *linkpreview.Fetcher, mqttClient *mqtt.MQTTClient) *LinkPreviewer {
+	return &LinkPreviewer{
+		db:         db,
+		fetcher:    fetcher,
+		mqttClient: mqttClient,
+		queue:      make(chan linkPreviewJob, linkPreviewQueueSize),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Start starts fetching previews in the background, beginning with those still pending from
+// before the start
+func (p *LinkPreviewer) Start() {
+	if p.fetcher == nil {
+		return
+	}
+
+	go func() {
+		p.sweep(time.Now())
+
+		ticker := time.NewTicker(linkPreviewSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// Pending previews newer than a sweep interval may still be in the queue
+				p.sweep(time.Now().Add(-linkPreviewSweepInterval))
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < linkPreviewWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-p.queue:
+					p.preview(job)
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops the previewer. Messages still waiting are previewed after the next start.
+func (p *LinkPreviewer) Stop() {
+	close(p.stop)
+}
+
+// Enqueue queues a message to get the preview of the first link in it. The message is
+// recorded as pending first, so it is previewed even if the queue is full or the server stops.
+func (p *LinkPreviewer) Enqueue(message *models.Message) {
+	if p.fetcher == nil || message.Type != models.TextMessage {
+		return
+	}
+	link := linkpreview.FirstURL(message.Content)
+	if link == "" {
+		return
+	}
+
+	pending := models.PendingLinkPreview{MessageID: message.ID, Link: link, CreatedAt: time.Now()}
+	if err := p.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&pending).Error; err != nil {
+		log.Printf("Failed to record pending link preview of message %s: %v", message.ID, err)
+	}
+
+	select {
+	case p.queue <- linkPreviewJob{messageID: message.ID, link: link}:
+	default:
+		log.Printf("Link preview queue is full, message %s is previewed later", message.ID)
+	}
+}
+
+// sweep queues the pending previews recorded before the given time, as many as fit in the queue
+func (p *LinkPreviewer) sweep(before time.Time) {
+	var pending []models.PendingLinkPreview
+	result := p.db.Where("created_at <= ?", before).
+		Order("created_at ASC").
+		Limit(linkPreviewSweepBatchSize).
+		Find(&pending)
+	if result.Error != nil {
+		log.Printf("Failed to load pending link previews: %v", result.Error)
+		return
+	}
+
+	for _, job := range pending {
+		select {
+		case p.queue <- linkPreviewJob{messageID: job.MessageID, link: job.Link}:
+		default:
+			return
+		}
+	}
+}
+
+// finish removes a message from the pending previews
+func (p *LinkPreviewer) finish(messageID string) {
+	if err := p.db.Where("message_id = ?", messageID).Delete(&models.PendingLinkPreview{}).Error; err != nil {
+		log.Printf("Failed to remove pending link preview of message %s: %v", messageID, err)
+	}
+}
+
+// preview attaches the preview of a link to a message, if the linked page has one.
+// Messages are left pending when the database fails, so a later sweep tries again.
+func (p *LinkPreviewer) preview(job linkPreviewJob) {
+	preview, err := p.lookup(job.link)
+	if err != nil {
+		log.Printf("Failed to look up link preview: %v", err)
+		return
+	}
+	if preview == nil {
+		p.finish(job.messageID)
+		return
+	}
+
+	var message models.Message
+	if err := p.db.Where("id = ?", job.messageID).Limit(1).Find(&message).Error; err != nil {
+		log.Printf("Failed to load message %s: %v", job.messageID, err)
+		return
+	}
+
+	// The message may have been deleted while the page was fetched, or have got its preview
+	// already if a sweep queued it again
+	if _, ok := message.Metadata["link_preview"]; message.ID == "" || ok {
+		p.finish(job.messageID)
+		return
+	}
+
+	metadata := message.Metadata.Clone()
+	metadata["link_preview"] = preview.Metadata()
+	message.Metadata = metadata
+	message.UpdatedAt = time.Now()
+	if err := p.db.Model(&message).Select("metadata", "updated_at").Updates(&message).Error; err != nil {
+		log.Printf("Failed to update message %s: %v", message.ID, err)
+		return
+	}
+	p.finish(message.ID)
+
+	if err := p.mqttClient.PublishMessageUpdated(&message); err != nil {
+		log.Printf("Failed to publish message update to MQTT: %v", err)
+	}
+}
+
+// lookup returns the cached preview of a link, fetching the page if it is not cached.
+// It returns nil if the page has no preview.
+func (p *LinkPreviewer) lookup(link string) (*models.LinkPreview, error) {
+	key, err := linkpreview.Normalize(link)
+	if err != nil {
+		return nil, nil
+	}
+
+	var cached models.LinkPreview
+	if err := p.db.Where("url = ? AND expires_at > ?", key, time.Now()).Limit(1).Find(&cached).Error; err != nil {
+		return nil, err
+	}
+	if cached.URL != "" {
+		if cached.Failed {
+			return nil, nil
+		}
+		return &cached, nil
+	}
+
+	now := time.Now()
+	record := models.LinkPreview{URL: key, FetchedAt: now, ExpiresAt: now.Add(models.LinkPreviewTTL)}
+	fetched, err := p.fetcher.Fetch(context.Background(), key)
+	if err != nil {
+		log.Printf("Failed to fetch link preview of %s: %v", key, err)
+		record.Failed = true
+		record.ExpiresAt = now.Add(models.FailedLinkPreviewTTL)
+	} else {
+		record.Title = fetched.Title
+		record.Description = fetched.Description
+		record.ImageURL = fetched.ImageURL
+		record.SiteName = fetched.SiteName
+	}
+
+	if err := p.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&record).Error; err != nil {
+		log.Printf("Failed to cache link preview of %s: %v", key, err)
+	}
+	if record.Failed {
+		return nil, nil
+	}
+	return &record, nil
+}
@@ -0,0 +1,373 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"backend/media"
+	"backend/models"
+	"backend/mqtt"
+	"backend/scanner"
+	"backend/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// processorInterval is how often pending attachments are looked for when no upload wakes the processor
+	processorInterval = 30 * time.Second
+
+	// processorBatchSize is the maximum number of attachments processed per run
+	processorBatchSize = 20
+
+	// staleProcessingTimeout is how long an attachment may stay in the processing state
+	// before it is considered abandoned
+	staleProcessingTimeout = 5 * time.Minute
+
+	// maxProcessedFileSize is the largest original file read into memory for processing
+	maxProcessedFileSize = 50 << 20
+
+	// maxScanAttempts is how often scanning a file is tried before the attachment fails
+	maxScanAttempts = 5
+)
+
+// MediaProcessor scans uploaded files for malware, strips the metadata of uploaded images
+// and generates their thumbnails and placeholders, and reads the duration and waveform of
+// uploaded audio in the background, so uploads and sends do not wait for it. Messages the files were sent in are updated when processing finishes.
+type MediaProcessor struct {
+	db         *gorm.DB
+	storage    storage.Storage
+	scanner    scanner.Scanner
+	mqttClient *mqtt.MQTTClient
+	wake       chan struct{}
+	stop       chan struct{}
+}
+
+// NewMediaProcessor creates a new media processor. Files are not scanned if the scanner is nil.
+func NewMediaProcessor(db *gorm.DB, store storage.Storage, fileScanner scanner.Scanner, mqttClient *mqtt.MQTTClient) *MediaProcessor {
+	return &MediaProcessor{
+		db:         db,
+		storage:    store,
+		scanner:    fileScanner,
+		mqttClient: mqttClient,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Scans reports whether uploaded files are scanned for malware
+func (p *MediaProcessor) Scans() bool {
+	return p.scanner != nil
+}
+
+// Start starts processing pending attachments in the background
+func (p *MediaProcessor) Start() {
+	go func() {
+		p.releaseStaleClaims()
+		p.runPending()
+
+		ticker := time.NewTicker(processorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.releaseStaleClaims()
+				p.runPending()
+			case <-p.wake:
+				p.runPending()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the processor
+func (p *MediaProcessor) Stop() {
+	close(p.stop)
+}
+
+// Wake makes the processor look for pending attachments now
+func (p *MediaProcessor) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// A run is already queued
+	}
+}
+
+// releaseStaleClaims puts attachments that were claimed but never finished back in the queue
+func (p *MediaProcessor) releaseStaleClaims() {
+	result := p.db.Model(&models.Attachment{}).
+		Where("status = ? AND claimed_at < ?", models.AttachmentProcessing, time.Now().Add(-staleProcessingTimeout)).
+		Updates(map[string]interface{}{"status": models.AttachmentPending, "claimed_at": nil})
+	if result.Error != nil {
+		log.Printf("Failed to release stale attachments: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Released %d stale attachments", result.RowsAffected)
+	}
+}
+
+// runPending processes pending attachments in batches until none are left
+func (p *MediaProcessor) runPending() {
+	for {
+		var pending []models.Attachment
+		result := p.db.Where("status = ? AND detached_at IS NULL", models.AttachmentPending).
+			Order("created_at ASC").
+			Limit(processorBatchSize).
+			Find(&pending)
+		if result.Error != nil {
+			log.Printf("Failed to load pending attachments: %v", result.Error)
+			return
+		}
+
+		for i := range pending {
+			if p.claim(&pending[i]) {
+				p.processOne(&pending[i])
+			}
+		}
+
+		if len(pending) < processorBatchSize {
+			return
+		}
+	}
+}
+
+// claim marks an attachment as processing. It returns false if another server instance got to it first.
+func (p *MediaProcessor) claim(attachment *models.Attachment) bool {
+	now := time.Now()
+	result := p.db.Model(&models.Attachment{}).
+		Where("id = ? AND status = ?", attachment.ID, models.AttachmentPending).
+		Updates(map[string]interface{}{"status": models.AttachmentProcessing, "claimed_at": now, "updated_at": now})
+	if result.Error != nil {
+		log.Printf("Failed to claim attachment %s: %v", attachment.ID, result.Error)
+		return false
+	}
+	return result.RowsAffected == 1
+}
+
+// processOne scans and processes a claimed attachment and records the outcome
+func (p *MediaProcessor) processOne(attachment *models.Attachment) {
+	columns := []string{"status", "claimed_at", "updated_at"}
+
+	if p.scanner != nil && attachment.ScannedAt == nil {
+		columns = append(columns, "scan_status", "scan_signature", "scan_attempts", "scanned_at")
+		if err := p.scan(attachment); err != nil {
+			log.Printf("Failed to scan attachment %s: %v", attachment.ID, err)
+			attachment.ScanAttempts++
+			if attachment.ScanAttempts < maxScanAttempts {
+				// The claim is kept, so the attachment is retried once it goes stale
+				attachment.UpdatedAt = time.Now()
+				if err := p.db.Model(attachment).Select("scan_attempts", "updated_at").Updates(attachment).Error; err != nil {
+					log.Printf("Failed to update attachment %s: %v", attachment.ID, err)
+				}
+				return
+			}
+			now := time.Now()
+			attachment.ScanStatus = models.ScanFailed
+			attachment.ScannedAt = &now
+		}
+	}
+
+	switch {
+	case attachment.ScanStatus == models.ScanFailed:
+		attachment.Status = models.AttachmentFailed
+	case attachment.ScanStatus == models.ScanInfected:
+		attachment.Status = models.AttachmentQuarantined
+	case media.CanProcess(attachment.ContentType):
+		if err := recoverProcessing(p.process, attachment); err != nil {
+			log.Printf("Failed to process attachment %s: %v", attachment.ID, err)
+			attachment.Status = models.AttachmentFailed
+		} else {
+			attachment.Status = models.AttachmentReady
+			columns = append(columns, "width", "height", "blurhash", "dominant_color", "thumbnails", "size", "checksum")
+		}
+	case media.IsAudio(attachment.ContentType):
+		if err := recoverProcessing(p.processAudio, attachment); err != nil {
+			log.Printf("Failed to process attachment %s: %v", attachment.ID, err)
+			attachment.Status = models.AttachmentFailed
+		} else {
+			attachment.Status = models.AttachmentReady
+			columns = append(columns, "duration", "waveform")
+		}
+	default:
+		attachment.Status = models.AttachmentReady
+	}
+	attachment.ClaimedAt = nil
+	attachment.UpdatedAt = time.Now()
+
+	// The row is locked so a message claiming the attachment concurrently either sees the
+	// processed details or is seen here and updated
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		var current models.Attachment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, "id = ?", attachment.ID).Error; err != nil {
+			return err
+		}
+		attachment.MessageID = current.MessageID
+		return tx.Model(attachment).Select(columns).Updates(attachment).Error
+	})
+	if err != nil {
+		log.Printf("Failed to update attachment %s: %v", attachment.ID, err)
+		return
+	}
+
+	if attachment.MessageID != nil && (attachment.Status == models.AttachmentReady || attachment.Status == models.AttachmentQuarantined) {
+		p.updateMessage(attachment)
+	}
+
+	if attachment.Status == models.AttachmentQuarantined {
+		log.Printf("Quarantined attachment %s of user %s: %s", attachment.ID, attachment.UploaderID, attachment.ScanSignature)
+		if err := p.mqttClient.PublishAttachmentQuarantined(attachment); err != nil {
+			log.Printf("Failed to publish quarantine to MQTT: %v", err)
+		}
+	}
+}
+
+// recoverProcessing runs a processing step, turning a panic into an error so a file that
+// trips a bug in a parser fails on its own instead of taking the server down
+func recoverProcessing(process func(attachment *models.Attachment) error, attachment *models.Attachment) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while processing: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return process(attachment)
+}
+
+// scan runs the malware scanner on the file of an attachment and records its verdict
+func (p *MediaProcessor) scan(attachment *models.Attachment) error {
+	ctx := context.Background()
+
+	reader, _, err := p.storage.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	result, err := p.scanner.Scan(ctx, reader)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	attachment.ScannedAt = &now
+	attachment.ScanStatus = models.ScanClean
+	if result.Infected {
+		attachment.ScanStatus = models.ScanInfected
+		attachment.ScanSignature = result.Signature
+	}
+	return nil
+}
+
+// process strips the metadata of an image and stores its thumbnails, filling in the attachment's details
+func (p *MediaProcessor) process(attachment *models.Attachment) error {
+	ctx := context.Background()
+
+	data, err := p.read(ctx, attachment)
+	if err != nil {
+		return err
+	}
+
+	processed, err := media.ProcessImage(data, attachment.ContentType)
+	if err != nil {
+		return err
+	}
+
+	thumbnails := make([]models.AttachmentThumbnail, 0, len(processed.Thumbnails))
+	for _, thumbnail := range processed.Thumbnails {
+		key := "thumbnails/" + attachment.ID + "/" + thumbnail.Name
+		if err := p.storage.Put(ctx, key, bytes.NewReader(thumbnail.Data), int64(len(thumbnail.Data)), thumbnail.ContentType); err != nil {
+			return err
+		}
+		thumbnails = append(thumbnails, models.AttachmentThumbnail{
+			Name:        thumbnail.Name,
+			Width:       thumbnail.Width,
+			Height:      thumbnail.Height,
+			ContentType: thumbnail.ContentType,
+			Size:        int64(len(thumbnail.Data)),
+			StorageKey:  key,
+		})
+	}
+
+	// Replace the original with the copy without metadata
+	if processed.Original != nil {
+		if err := p.storage.Put(ctx, attachment.StorageKey, bytes.NewReader(processed.Original), int64(len(processed.Original)), attachment.ContentType); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(processed.Original)
+		attachment.Size = int64(len(processed.Original))
+		attachment.Checksum = hex.EncodeToString(sum[:])
+	}
+
+	attachment.Width = &processed.Width
+	attachment.Height = &processed.Height
+	attachment.Blurhash = processed.Blurhash
+	attachment.DominantColor = processed.DominantColor
+	attachment.Thumbnails = thumbnails
+
+	return nil
+}
+
+// processAudio reads the duration of an audio file and computes its waveform
+func (p *MediaProcessor) processAudio(attachment *models.Attachment) error {
+	data, err := p.read(context.Background(), attachment)
+	if err != nil {
+		return err
+	}
+
+	info, err := media.ProbeAudio(data, attachment.ContentType)
+	if err != nil {
+		return err
+	}
+
+	attachment.Duration = &info.Duration
+	attachment.Waveform = info.Waveform
+	return nil
+}
+
+// read reads the file of an attachment into memory
+func (p *MediaProcessor) read(ctx context.Context, attachment *models.Attachment) ([]byte, error) {
+	reader, _, err := p.storage.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxProcessedFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxProcessedFileSize {
+		return nil, fmt.Errorf("file of %d bytes is too large to process", len(data))
+	}
+	return data, nil
+}
+
+// updateMessage fills the processed details into the message an attachment was sent in, or
+// removes its links if the attachment was quarantined
+func (p *MediaProcessor) updateMessage(attachment *models.Attachment) {
+	var message models.Message
+	if err := p.db.First(&message, "id = ?", *attachment.MessageID).Error; err != nil {
+		return
+	}
+
+	message.Metadata = attachment.ApplyToMetadata(message.Metadata, message.Type)
+	message.UpdatedAt = time.Now()
+	if err := p.db.Model(&message).Select("metadata", "updated_at").Updates(&message).Error; err != nil {
+		log.Printf("Failed to update message %s: %v", message.ID, err)
+		return
+	}
+
+	if err := p.mqttClient.PublishMessageUpdated(&message); err != nil {
+		log.Printf("Failed to publish message update to MQTT: %v", err)
+	}
+}
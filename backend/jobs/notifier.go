@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// notifierWorkers is the number of messages whose recipients are notified at the same time
+	notifierWorkers = 4
+
+	// notifierQueueSize is the number of messages waiting for notifications before new ones are skipped
+	notifierQueueSize = 1024
+)
+
+// Notifier brings chats back out of the archive of the recipients of new messages and sends
+// notifications to the recipients who have not muted them. It runs in the background so sends
+// to large groups do not wait for a publish per member.
+type Notifier struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+	queue      chan models.Message
+	stop       chan struct{}
+}
+
+// NewNotifier creates a new notifier
+func NewNotifier(db *gorm.DB, mqttClient *mqtt.MQTTClient) *Notifier {
+	return &Notifier{
+		db:         db,
+		mqttClient: mqttClient,
+		queue:      make(chan models.Message, notifierQueueSize),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Start starts notifying recipients in the background
+func (n *Notifier) Start() {
+	for i := 0; i < notifierWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case message := <-n.queue:
+					n.notify(&message)
+				case <-n.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops the notifier. Messages still waiting are not notified.
+func (n *Notifier) Stop() {
+	close(n.stop)
+}
+
+// Enqueue queues a new message to notify its recipients of. System messages are silent.
+func (n *Notifier) Enqueue(message *models.Message) {
+	if message.ConversationID == nil || message.Type == models.SystemMessage {
+		return
+	}
+
+	select {
+	case n.queue <- *message:
+	default:
+		log.Printf("Notification queue is full, skipping message %s", message.ID)
+	}
+}
+
+// notify unarchives the chat of a message for its recipients and notifies those who have not muted it
+func (n *Notifier) notify(message *models.Message) {
+	var recipientIDs []string
+	result := n.db.Model(&models.ConversationParticipant{}).
+		Where("conversation_id = ? AND user_id <> ?", *message.ConversationID, message.SenderID).
+		Pluck("user_id", &recipientIDs)
+	if result.Error != nil {
+		log.Printf("Failed to load message recipients: %v", result.Error)
+		return
+	}
+	if len(recipientIDs) == 0 {
+		return
+	}
+
+	now := time.Now()
+	chatKey := message.ChatKey()
+	if err := models.UnarchiveChat(n.db, chatKey, recipientIDs, now); err != nil {
+		log.Printf("Failed to unarchive chat: %v", err)
+	}
+
+	var preferences []models.ChatPreference
+	if err := n.db.Where("chat_key = ? AND user_id IN ?", chatKey, recipientIDs).Find(&preferences).Error; err != nil {
+		log.Printf("Failed to load chat preferences: %v", err)
+		return
+	}
+	muted := make(map[string]bool)
+	for _, p := range preferences {
+		if p.IsMuted(now) {
+			muted[p.UserID] = true
+		}
+	}
+
+	for _, recipientID := range recipientIDs {
+		if muted[recipientID] {
+			continue
+		}
+		if err := n.mqttClient.PublishNotification(recipientID, message); err != nil {
+			log.Printf("Failed to publish notification to MQTT: %v", err)
+		}
+	}
+}
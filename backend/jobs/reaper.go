@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"backend/models"
+	"backend/mqtt"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// reaperInterval is how often expired messages are looked for
+	reaperInterval = time.Minute
+
+	// reaperBatchSize is the maximum number of messages deleted per batch
+	reaperBatchSize = 500
+)
+
+// PollClosedFunc publishes the final tallies of a poll closed by the reaper
+type PollClosedFunc func(pollID string)
+
+// MessageReaper periodically deletes messages whose disappearing timer has run out
+type MessageReaper struct {
+	db         *gorm.DB
+	mqttClient *mqtt.MQTTClient
+	pollClosed PollClosedFunc
+	stop       chan struct{}
+}
+
+// NewMessageReaper creates a new message reaper
+func NewMessageReaper(db *gorm.DB, mqttClient *mqtt.MQTTClient, pollClosed PollClosedFunc) *MessageReaper {
+	return &MessageReaper{db: db, mqttClient: mqttClient, pollClosed: pollClosed, stop: make(chan struct{})}
+}
+
+// Start starts deleting expired messages in the background
+func (r *MessageReaper) Start() {
+	go func() {
+		r.reap()
+
+		ticker := time.NewTicker(reaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.reap()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the reaper
+func (r *MessageReaper) Stop() {
+	close(r.stop)
+}
+
+// reap deletes expired messages, old tombstones, idempotency keys that left their window and
+// expired link previews, ends live locations whose sharing period is over and closes polls
+// whose closing time has passed
+func (r *MessageReaper) reap() {
+	r.reapMessages()
+	r.endLiveLocations()
+	r.closeDuePolls()
+
+	result := r.db.Where("deleted_at < ?", time.Now().Add(-models.TombstoneRetention)).Delete(&models.MessageTombstone{})
+	if result.Error != nil {
+		log.Printf("Failed to delete old message tombstones: %v", result.Error)
+	}
+
+	result = r.db.Where("deleted_at < ?", time.Now().Add(-models.TombstoneRetention)).Delete(&models.GroupTombstone{})
+	if result.Error != nil {
+		log.Printf("Failed to delete old group tombstones: %v", result.Error)
+	}
+
+	result = r.db.Where("created_at < ?", time.Now().Add(-models.IdempotencyWindow)).Delete(&models.MessageIdempotencyKey{})
+	if result.Error != nil {
+		log.Printf("Failed to delete old idempotency keys: %v", result.Error)
+	}
+
+	result = r.db.Where("expires_at < ?", time.Now()).Delete(&models.LinkPreview{})
+	if result.Error != nil {
+		log.Printf("Failed to delete expired link previews: %v", result.Error)
+	}
+}
+
+// reapMessages deletes expired messages in batches until none are left
+func (r *MessageReaper) reapMessages() {
+	for {
+		var expired []models.Message
+		result := r.db.Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).
+			Limit(reaperBatchSize).
+			Find(&expired)
+		if result.Error != nil {
+			log.Printf("Failed to load expired messages: %v", result.Error)
+			return
+		}
+		if len(expired) == 0 {
+			return
+		}
+
+		ids := make([]string, len(expired))
+		for i, message := range expired {
+			ids[i] = message.ID
+		}
+
+		if err := models.DeleteMessages(r.db, ids); err != nil {
+			log.Printf("Failed to delete expired messages: %v", err)
+			return
+		}
+
+		for i := range expired {
+			if err := r.mqttClient.PublishMessageDeleted(&expired[i]); err != nil {
+				log.Printf("Failed to publish message deletion to MQTT: %v", err)
+			}
+		}
+
+		if len(expired) < reaperBatchSize {
+			return
+		}
+	}
+}
+
+// endLiveLocations ends the live locations whose sharing period is over
+func (r *MessageReaper) endLiveLocations() {
+	var expired []models.LiveLocation
+	result := r.db.Where("expires_at <= ?", time.Now()).Find(&expired)
+	if result.Error != nil {
+		log.Printf("Failed to load expired live locations: %v", result.Error)
+		return
+	}
+
+	for _, live := range expired {
+		message, err := models.EndLiveLocation(r.db, live.MessageID)
+		if err != nil {
+			log.Printf("Failed to end live location %s: %v", live.MessageID, err)
+			continue
+		}
+		if message == nil {
+			continue
+		}
+
+		if err := r.mqttClient.PublishMessageUpdated(message); err != nil {
+			log.Printf("Failed to publish message update to MQTT: %v", err)
+		}
+	}
+}
+
+// closeDuePolls closes the polls whose closing time has passed and publishes their final tallies
+func (r *MessageReaper) closeDuePolls() {
+	now := time.Now()
+	var due []models.Poll
+	result := r.db.Where("closed_at IS NULL AND closes_at <= ?", now).Find(&due)
+	if result.Error != nil {
+		log.Printf("Failed to load due polls: %v", result.Error)
+		return
+	}
+
+	for i := range due {
+		closed, err := models.ClosePoll(r.db, &due[i], now)
+		if err != nil {
+			log.Printf("Failed to close poll %s: %v", due[i].ID, err)
+			continue
+		}
+		if closed {
+			r.pollClosed(due[i].ID)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"backend/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// schedulerInterval is how often the scheduler looks for due messages
+	schedulerInterval = 10 * time.Second
+
+	// schedulerBatchSize is the maximum number of messages delivered per run
+	schedulerBatchSize = 100
+
+	// staleClaimTimeout is how long a claimed message may stay in the sending
+	// state before it is considered abandoned (e.g. the server crashed mid-send)
+	staleClaimTimeout = 5 * time.Minute
+)
+
+// DeliverFunc sends a scheduled message and returns the created message
+type DeliverFunc func(scheduled *models.ScheduledMessage) (*models.Message, error)
+
+// MessageScheduler periodically delivers scheduled messages that are due.
+// All state lives in the database so pending messages survive server restarts.
+type MessageScheduler struct {
+	db      *gorm.DB
+	deliver DeliverFunc
+	stop    chan struct{}
+}
+
+// NewMessageScheduler creates a new message scheduler
+func NewMessageScheduler(db *gorm.DB, deliver DeliverFunc) *MessageScheduler {
+	return &MessageScheduler{db: db, deliver: deliver, stop: make(chan struct{})}
+}
+
+// Start starts delivering due messages in the background
+func (s *MessageScheduler) Start() {
+	go func() {
+		s.releaseStaleClaims()
+		s.runDue()
+
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.releaseStaleClaims()
+				s.runDue()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler
+func (s *MessageScheduler) Stop() {
+	close(s.stop)
+}
+
+// releaseStaleClaims puts messages that were claimed but never finished back in the queue.
+// Deliveries are keyed by the scheduled message ID, so one that did finish is not sent twice.
+func (s *MessageScheduler) releaseStaleClaims() {
+	result := s.db.Model(&models.ScheduledMessage{}).
+		Where("status = ? AND claimed_at < ?", models.ScheduledSending, time.Now().Add(-staleClaimTimeout)).
+		Updates(map[string]interface{}{"status": models.ScheduledPending, "claimed_at": nil})
+	if result.Error != nil {
+		log.Printf("Failed to release stale scheduled messages: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Released %d stale scheduled messages", result.RowsAffected)
+	}
+}
+
+// runDue delivers all pending messages whose send time has passed
+func (s *MessageScheduler) runDue() {
+	var due []models.ScheduledMessage
+	result := s.db.Where("status = ? AND send_at <= ?", models.ScheduledPending, time.Now()).
+		Order("send_at ASC").
+		Limit(schedulerBatchSize).
+		Find(&due)
+	if result.Error != nil {
+		log.Printf("Failed to load scheduled messages: %v", result.Error)
+		return
+	}
+
+	for i := range due {
+		if s.claim(&due[i]) {
+			s.deliverOne(&due[i])
+		}
+	}
+}
+
+// claim marks a scheduled message as sending. It returns false if another
+// server instance or an edit/cancel got to the message first.
+func (s *MessageScheduler) claim(scheduled *models.ScheduledMessage) bool {
+	now := time.Now()
+	result := s.db.Model(&models.ScheduledMessage{}).
+		Where("id = ? AND status = ?", scheduled.ID, models.ScheduledPending).
+		Updates(map[string]interface{}{"status": models.ScheduledSending, "claimed_at": now, "updated_at": now})
+	if result.Error != nil {
+		log.Printf("Failed to claim scheduled message %s: %v", scheduled.ID, result.Error)
+		return false
+	}
+	return result.RowsAffected == 1
+}
+
+// deliverOne sends a claimed message and records the outcome
+func (s *MessageScheduler) deliverOne(scheduled *models.ScheduledMessage) {
+	updates := map[string]interface{}{"updated_at": time.Now()}
+
+	message, err := s.deliver(scheduled)
+	if err != nil {
+		log.Printf("Failed to deliver scheduled message %s: %v", scheduled.ID, err)
+		updates["status"] = models.ScheduledFailed
+		updates["error"] = err.Error()
+	} else {
+		updates["status"] = models.ScheduledSent
+		updates["message_id"] = message.ID
+	}
+
+	if err := s.db.Model(&models.ScheduledMessage{}).Where("id = ?", scheduled.ID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update scheduled message %s: %v", scheduled.ID, err)
+	}
+}
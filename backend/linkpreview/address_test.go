@@ -0,0 +1,180 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"::ffff:192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::7f00:1", false},
+		{"2002:7f00:1::", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("IsPublicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// previewPage is a page with a preview
+const previewPage = `<html><head><title>Example</title><meta property="og:description" content="A page"></head></html>`
+
+// newTestFetcher creates a fetcher that may connect to the test server at 127.0.0.1 as if it
+// were a public website, and to public addresses, but nowhere else
+func newTestFetcher() *Fetcher {
+	standIn := netip.MustParseAddr("127.0.0.1")
+	return NewFetcher(Options{
+		Timeout:   5 * time.Second,
+		MaxBytes:  64 << 10,
+		UserAgent: "test",
+		AllowAddress: func(addr netip.Addr) bool {
+			return addr == standIn || IsPublicAddress(addr)
+		},
+	})
+}
+
+// newInternalServer starts a server standing in for an internal service, counting its requests
+func newInternalServer(t *testing.T, address string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", address, err)
+	}
+
+	var hits atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, previewPage)
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestFetchBlocksLoopbackByDefault(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, previewPage)
+	}))
+	defer server.Close()
+
+	fetcher := NewFetcher(Options{Timeout: 5 * time.Second, MaxBytes: 64 << 10})
+	localhostURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	for _, link := range []string{server.URL, localhostURL} {
+		if _, err := fetcher.Fetch(context.Background(), link); !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("Fetch(%s) error = %v, want ErrBlockedAddress", link, err)
+		}
+	}
+	if hits.Load() != 0 {
+		t.Errorf("the loopback server received %d requests", hits.Load())
+	}
+}
+
+func TestFetchBlocksRedirectsToInternalAddresses(t *testing.T) {
+	internal, internalHits := newInternalServer(t, "127.0.0.2:0")
+	internalPort := internal.Listener.Addr().(*net.TCPAddr).Port
+
+	targets := []string{
+		internal.URL + "/admin",
+		"http://[::1]:" + strconv.Itoa(internalPort) + "/",
+		"http://10.0.0.1/",
+		"http://192.168.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[fd00::1]/",
+		"http://[::ffff:127.0.0.2]:" + strconv.Itoa(internalPort) + "/",
+	}
+
+	for _, target := range targets {
+		t.Run(target, func(t *testing.T) {
+			public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, target, http.StatusFound)
+			}))
+			defer public.Close()
+
+			_, err := newTestFetcher().Fetch(context.Background(), public.URL)
+			if !errors.Is(err, ErrBlockedAddress) {
+				t.Errorf("Fetch() error = %v, want ErrBlockedAddress", err)
+			}
+		})
+	}
+
+	if internalHits.Load() != 0 {
+		t.Errorf("the internal server received %d requests", internalHits.Load())
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, previewPage)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/credentials", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://user:secret@"+r.Host+"/page", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	fetcher := newTestFetcher()
+	ctx := context.Background()
+
+	// Redirects between allowed addresses are followed
+	preview, err := fetcher.Fetch(ctx, server.URL+"/moved")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if preview.Title != "Example" || preview.URL != server.URL+"/moved" {
+		t.Errorf("Fetch() = %+v, want the preview of the page under the link sent", preview)
+	}
+
+	for _, path := range []string{"/loop", "/file", "/credentials"} {
+		if _, err := fetcher.Fetch(ctx, server.URL+path); err == nil {
+			t.Errorf("Fetch(%s) succeeded, want an error", path)
+		}
+	}
+}
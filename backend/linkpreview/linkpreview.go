@@ -0,0 +1,309 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// maxRedirects is the most redirects followed to reach a page
+	maxRedirects = 5
+
+	// maxURLLength is the longest link previews are fetched for
+	maxURLLength = 2048
+
+	// maxTitleLength and maxDescriptionLength cap the text of previews, in characters
+	maxTitleLength       = 200
+	maxDescriptionLength = 500
+)
+
+var (
+	// ErrNotHTML is returned for links to anything but web pages
+	ErrNotHTML = errors.New("not an HTML page")
+	// ErrNoPreview is returned for pages without a title or description
+	ErrNoPreview = errors.New("page has no preview")
+)
+
+// Preview is what a web page says about itself in its OpenGraph and other meta tags
+type Preview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+}
+
+// Options configures a Fetcher
+type Options struct {
+	// Timeout limits the whole fetch, including redirects
+	Timeout time.Duration
+	// MaxBytes is how much of a page is read; meta tags are at the start
+	MaxBytes int64
+	// UserAgent identifies the fetcher to websites
+	UserAgent string
+	// AllowAddress reports whether the fetcher may connect to an address. Only public
+	// addresses are allowed if it is nil; tests can allow a local stand-in server.
+	AllowAddress func(netip.Addr) bool
+}
+
+// Fetcher fetches web pages and extracts their previews, refusing to connect to internal networks
+type Fetcher struct {
+	client    *http.Client
+	maxBytes  int64
+	userAgent string
+}
+
+// NewFetcher creates a new fetcher
+func NewFetcher(opts Options) *Fetcher {
+	allow := opts.AllowAddress
+	if allow == nil {
+		allow = IsPublicAddress
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout, Control: dialControl(allow)}
+	transport := &http.Transport{
+		// A proxy would make the connection checks apply to the proxy instead of the website
+		Proxy:                  nil,
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    opts.Timeout,
+		ResponseHeaderTimeout:  opts.Timeout,
+		MaxResponseHeaderBytes: 64 << 10,
+		MaxIdleConns:           10,
+		IdleConnTimeout:        30 * time.Second,
+	}
+
+	return &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return checkURL(req.URL)
+			},
+		},
+		maxBytes:  opts.MaxBytes,
+		userAgent: opts.UserAgent,
+	}
+}
+
+// Fetch fetches a web page and extracts its preview
+func (f *Fetcher) Fetch(ctx context.Context, link string) (*Preview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNotHTML
+	}
+
+	// Pages in other encodings are converted to UTF-8
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.maxBytes), contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := parse(body, resp.Request.URL)
+	preview.URL = link
+	if preview.Title == "" && preview.Description == "" {
+		return nil, ErrNoPreview
+	}
+	return preview, nil
+}
+
+// checkURL checks that a URL is a web link without credentials
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if u.User != nil {
+		return errors.New("links with credentials are not previewed")
+	}
+	return nil
+}
+
+// parse reads the meta tags and title of a page, stopping at its body
+func parse(r io.Reader, base *url.URL) *Preview {
+	meta := make(map[string]string)
+	var title string
+
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+		if tokenType == html.TextToken {
+			if inTitle && title == "" {
+				title = token.Data
+			}
+			continue
+		}
+		if tokenType == html.EndTagToken {
+			if token.Data == "head" {
+				break
+			}
+			inTitle = false
+			continue
+		}
+
+		switch token.Data {
+		case "body":
+			tokenType = html.ErrorToken
+		case "title":
+			inTitle = tokenType == html.StartTagToken
+		case "meta":
+			var key, content string
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "property", "name":
+					key = strings.ToLower(attr.Val)
+				case "content":
+					content = attr.Val
+				}
+			}
+			// The first of repeated tags is the main one, e.g. of several og:image tags
+			if _, seen := meta[key]; key != "" && !seen {
+				meta[key] = content
+			}
+		}
+		if tokenType == html.ErrorToken {
+			break
+		}
+	}
+
+	preview := &Preview{
+		Title:       clean(first(meta["og:title"], meta["twitter:title"], title), maxTitleLength),
+		Description: clean(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+		SiteName:    clean(meta["og:site_name"], maxTitleLength),
+	}
+
+	// Images are linked relative to the page, and only web images are kept
+	image := first(meta["og:image:secure_url"], meta["og:image"], meta["og:image:url"], meta["twitter:image"], meta["twitter:image:src"])
+	if image != "" {
+		if u, err := base.Parse(strings.TrimSpace(image)); err == nil && checkURL(u) == nil && len(u.String()) <= maxURLLength {
+			preview.ImageURL = u.String()
+		}
+	}
+
+	return preview
+}
+
+// first returns the first non-blank value
+func first(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// clean collapses the whitespace of text and shortens it to a number of characters
+func clean(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= maxLength {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:maxLength-1])) + "…"
+}
+
+// urlPattern matches web links in text
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+// FirstURL returns the first web link in a text, or "" if there is none
+func FirstURL(text string) string {
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		link := trimTrailingPunctuation(match)
+		if len(link) > maxURLLength {
+			continue
+		}
+		if u, err := url.Parse(link); err == nil && checkURL(u) == nil {
+			return link
+		}
+	}
+	return ""
+}
+
+// trimTrailingPunctuation removes punctuation that ends the sentence rather than the link,
+// keeping closing parentheses that belong to the link, as in Wikipedia links
+func trimTrailingPunctuation(link string) string {
+	for link != "" {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'*", last) >= 0:
+			link = link[:len(link)-1]
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+			link = link[:len(link)-1]
+		case last == ']' && strings.Count(link, "[") < strings.Count(link, "]"):
+			link = link[:len(link)-1]
+		default:
+			return link
+		}
+	}
+	return link
+}
+
+// Normalize turns a link into the form previews are cached under, without its fragment and
+// with a lower-case scheme and host
+func Normalize(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if err := checkURL(u); err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
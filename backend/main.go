@@ -8,9 +8,11 @@ import (
 
 	"backend/config"
 	"backend/controllers"
+	"backend/jobs"
 	"backend/middleware"
 	"backend/models"
 	"backend/mqtt"
+	"backend/search"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -34,6 +36,56 @@ func main() {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
+	// Link messages stored before conversations existed
+	if err := models.MigrateConversations(db); err != nil {
+		log.Fatalf("Failed to migrate conversations: %v", err)
+	}
+
+	// Drop the avatar links set by clients before avatars were uploaded
+	if err := models.MigrateAvatars(db); err != nil {
+		log.Fatalf("Failed to migrate avatars: %v", err)
+	}
+
+	// Track the transaction that last changed each message for syncing clients
+	if err := models.MigrateChangeTracking(db); err != nil {
+		log.Fatalf("Failed to set up change tracking: %v", err)
+	}
+
+	// Set up message search
+	searchIndex := search.NewPostgresIndex(db)
+	if err := searchIndex.Setup(); err != nil {
+		log.Fatalf("Failed to set up message search: %v", err)
+	}
+
+	// Initialize attachment storage
+	store, err := config.InitStorage()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// Configure storage quotas
+	if err := config.InitQuotas(); err != nil {
+		log.Fatalf("Failed to configure storage quotas: %v", err)
+	}
+
+	// Initialize signing of file URLs served without authentication
+	signer, err := config.InitURLSigner()
+	if err != nil {
+		log.Fatalf("Failed to initialize URL signing: %v", err)
+	}
+
+	// Initialize malware scanning of uploaded files
+	fileScanner, err := config.InitScanner()
+	if err != nil {
+		log.Fatalf("Failed to initialize malware scanner: %v", err)
+	}
+
+	// Initialize fetching of link previews
+	linkFetcher, err := config.InitLinkPreviews()
+	if err != nil {
+		log.Fatalf("Failed to initialize link previews: %v", err)
+	}
+
 	// Initialize MQTT client
 	mqttClient, err := mqtt.NewClient()
 	if err != nil {
@@ -47,9 +99,9 @@ func main() {
 	// Configure CORS
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key", "Upload-Offset", "Upload-Checksum"},
+		ExposeHeaders:    []string{"Content-Length", "Idempotent-Replayed", "Location", "Upload-Offset", "Upload-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -57,8 +109,53 @@ func main() {
 	// Initialize controllers
 	authController := controllers.NewAuthController(db)
 	userController := controllers.NewUserController(db)
-	messageController := controllers.NewMessageController(db, mqttClient)
+	notifier := jobs.NewNotifier(db, mqttClient)
+	linkPreviewer := jobs.NewLinkPreviewer(db, linkFetcher, mqttClient)
+	messageController := controllers.NewMessageController(db, mqttClient, notifier.Enqueue, linkPreviewer.Enqueue)
 	groupController := controllers.NewGroupController(db, mqttClient)
+	pinController := controllers.NewPinController(db, mqttClient)
+	savedMessageController := controllers.NewSavedMessageController(db)
+	scheduledMessageController := controllers.NewScheduledMessageController(db)
+	retentionController := controllers.NewRetentionController(db, mqttClient)
+	syncController := controllers.NewSyncController(db)
+	searchController := controllers.NewSearchController(db, searchIndex)
+	mentionController := controllers.NewMentionController(db)
+	readReceiptController := controllers.NewReadReceiptController(db, mqttClient)
+	inboxController := controllers.NewInboxController(db)
+	conversationController := controllers.NewConversationController(db, messageController)
+	pollController := controllers.NewPollController(db, mqttClient, notifier.Enqueue)
+	mediaProcessor := jobs.NewMediaProcessor(db, store, fileScanner, mqttClient)
+	attachmentController := controllers.NewAttachmentController(db, store, signer, mediaProcessor.Wake, mediaProcessor.Scans())
+	uploadController := controllers.NewUploadController(db, store, attachmentController)
+	fileController := controllers.NewFileController(store, signer)
+	avatarController := controllers.NewAvatarController(db, store)
+	storageController := controllers.NewStorageController(db)
+	locationController := controllers.NewLocationController(db, mqttClient)
+
+	// Avatar URLs are signed whenever users and groups are loaded
+	models.SignAvatarURL = fileController.AvatarURL
+
+	// Start background jobs
+	messageScheduler := jobs.NewMessageScheduler(db, messageController.DeliverScheduledMessage)
+	messageScheduler.Start()
+	defer messageScheduler.Stop()
+
+	notifier.Start()
+	defer notifier.Stop()
+
+	linkPreviewer.Start()
+	defer linkPreviewer.Stop()
+
+	messageReaper := jobs.NewMessageReaper(db, mqttClient, pollController.PublishPollClosed)
+	messageReaper.Start()
+	defer messageReaper.Stop()
+
+	mediaProcessor.Start()
+	defer mediaProcessor.Stop()
+
+	attachmentJanitor := jobs.NewAttachmentJanitor(db, store)
+	attachmentJanitor.Start()
+	defer attachmentJanitor.Stop()
 
 	// API routes
 	api := router.Group("/api")
@@ -77,6 +174,8 @@ func main() {
 			users.GET("/search", userController.SearchUsers)
 			users.GET("/:id", userController.GetUser)
 			users.PUT("/:id", userController.UpdateUser)
+			users.POST("/:id/avatar", avatarController.UploadUserAvatar)
+			users.DELETE("/:id/avatar", avatarController.DeleteUserAvatar)
 			users.GET("/:id/groups", userController.GetUserGroups)
 			users.GET("/:id/recent-chats", userController.GetRecentChats) // <-- Add this line
 		}
@@ -85,15 +184,121 @@ func main() {
 		messages := api.Group("/messages")
 		messages.Use(middleware.AuthMiddleware())
 		{
+			messages.GET("/search", searchController.SearchMessages)
 			messages.GET("/direct/:userId/:otherUserId", messageController.GetDirectMessages)
 			messages.POST("/direct", messageController.SendDirectMessage)
 			messages.GET("/group/:groupId", messageController.GetGroupMessages)
 			messages.POST("/group", messageController.SendGroupMessage)
 			messages.POST("/mark-as-read", messageController.MarkMessagesAsRead)
+			messages.POST("/group/:groupId/read", readReceiptController.MarkGroupRead)
+			messages.GET("/group/:groupId/unseen-count", readReceiptController.GetGroupUnreadCount)
+			messages.GET("/:id/readers", readReceiptController.GetMessageReaders)
+			messages.POST("/:id/played", readReceiptController.MarkPlayed)
+			messages.GET("/:id/players", readReceiptController.GetMessagePlayers)
+			messages.PUT("/:id/location", locationController.UpdateLiveLocation)
+			messages.DELETE("/:id/location", locationController.StopLiveLocation)
 			messages.GET("/direct/unseen-count/:userId/:otherUserId", messageController.GetUnseenMessagesBWCount)
+			messages.GET("/unseen-count/:userId", messageController.GetUnseenMessagesALLCount)
 			messages.DELETE("/:id", messageController.DeleteMessage)
+			messages.POST("/:id/pin", pinController.PinMessage)
+			messages.DELETE("/:id/pin", pinController.UnpinMessage)
+			messages.GET("/direct/:userId/:otherUserId/pins", pinController.GetDirectPins)
+			messages.GET("/group/:groupId/pins", pinController.GetGroupPins)
+			messages.GET("/direct/:userId/:otherUserId/retention", retentionController.GetDirectRetention)
+			messages.PUT("/direct/:userId/:otherUserId/retention", retentionController.UpdateDirectRetention)
+			messages.GET("/group/:groupId/retention", retentionController.GetGroupRetention)
+			messages.PUT("/group/:groupId/retention", retentionController.UpdateGroupRetention)
 		}
 
+		// Saved message routes
+		saved := api.Group("/saved-messages")
+		saved.Use(middleware.AuthMiddleware())
+		{
+			saved.GET("", savedMessageController.GetSavedMessages)
+			saved.POST("", savedMessageController.SaveMessage)
+			saved.PUT("/:messageId", savedMessageController.UpdateSavedMessage)
+			saved.DELETE("/:messageId", savedMessageController.UnsaveMessage)
+		}
+
+		// Scheduled message routes
+		scheduled := api.Group("/scheduled-messages")
+		scheduled.Use(middleware.AuthMiddleware())
+		{
+			scheduled.GET("", scheduledMessageController.GetScheduledMessages)
+			scheduled.POST("", scheduledMessageController.CreateScheduledMessage)
+			scheduled.PUT("/:id", scheduledMessageController.UpdateScheduledMessage)
+			scheduled.DELETE("/:id", scheduledMessageController.CancelScheduledMessage)
+		}
+
+		// Conversation routes
+		conversations := api.Group("/conversations")
+		conversations.Use(middleware.AuthMiddleware())
+		{
+			conversations.GET("", conversationController.GetConversations)
+			conversations.POST("/direct", conversationController.CreateDirectConversation)
+			conversations.GET("/:id", conversationController.GetConversation)
+			conversations.PUT("/:id/settings", conversationController.UpdateConversationSettings)
+			conversations.GET("/:id/messages", conversationController.GetConversationMessages)
+			conversations.GET("/:id/messages/range", conversationController.GetConversationMessageRange)
+			conversations.POST("/:id/messages", conversationController.SendConversationMessage)
+		}
+
+		// Poll routes
+		polls := api.Group("/polls")
+		polls.Use(middleware.AuthMiddleware())
+		{
+			polls.POST("", pollController.CreatePoll)
+			polls.GET("/:id", pollController.GetPoll)
+			polls.POST("/:id/votes", pollController.VotePoll)
+			polls.DELETE("/:id/votes", pollController.RetractPollVote)
+			polls.POST("/:id/close", pollController.ClosePoll)
+		}
+
+		// Attachment routes
+		attachments := api.Group("/attachments")
+		attachments.Use(middleware.AuthMiddleware())
+		{
+			attachments.POST("", attachmentController.UploadAttachment)
+			attachments.POST("/urls", attachmentController.GetAttachmentURLs)
+			attachments.GET("/:id", attachmentController.GetAttachment)
+			attachments.GET("/:id/download", attachmentController.DownloadAttachment)
+			attachments.GET("/:id/url", attachmentController.GetAttachmentURL)
+			attachments.DELETE("/:id", attachmentController.DeleteAttachment)
+		}
+
+		// Storage routes
+		storageRoutes := api.Group("/storage")
+		storageRoutes.Use(middleware.AuthMiddleware())
+		{
+			storageRoutes.GET("/usage", storageController.GetUsage)
+		}
+
+		// Resumable upload routes
+		uploads := api.Group("/uploads")
+		uploads.Use(middleware.AuthMiddleware())
+		{
+			uploads.POST("", uploadController.CreateUpload)
+			uploads.GET("/:id", uploadController.GetUpload)
+			uploads.HEAD("/:id", uploadController.GetUploadOffset)
+			uploads.PATCH("/:id", uploadController.UploadChunk)
+			uploads.DELETE("/:id", uploadController.CancelUpload)
+		}
+
+		// Inbox routes
+		api.GET("/inbox", middleware.AuthMiddleware(), inboxController.GetInbox)
+
+		// Mention routes
+		mentions := api.Group("/mentions")
+		mentions.Use(middleware.AuthMiddleware())
+		{
+			mentions.GET("", mentionController.GetMentions)
+			mentions.GET("/unread-count", mentionController.GetUnreadMentionCounts)
+			mentions.POST("/mark-as-read", mentionController.MarkMentionsAsRead)
+		}
+
+		// Sync routes
+		api.GET("/sync", middleware.AuthMiddleware(), syncController.Sync)
+
 		// Group routes
 		groups := api.Group("/groups")
 		groups.Use(middleware.AuthMiddleware())
@@ -101,12 +306,23 @@ func main() {
 			groups.POST("", groupController.CreateGroup)
 			groups.GET("/:id", groupController.GetGroup)
 			groups.PUT("/:id", groupController.UpdateGroup)
+			groups.POST("/:id/avatar", avatarController.UploadGroupAvatar)
+			groups.DELETE("/:id/avatar", avatarController.DeleteGroupAvatar)
 			groups.POST("/:id/members", groupController.AddMember)
 			groups.DELETE("/:id/members/:userId", groupController.RemoveMember)
 			groups.DELETE("/:id", groupController.DeleteGroup) // <-- Add this line
+			groups.GET("/:id/storage", storageController.GetGroupStorage)
+			groups.PUT("/:id/storage", storageController.UpdateGroupStorage)
 		}
 	}
 
+	// Signed file routes, which authenticate through the URL signature instead of a token
+	files := router.Group("/files")
+	{
+		files.GET("/attachments/:id", attachmentController.ServeSignedAttachment)
+		files.GET("/avatars/*key", fileController.ServeSignedAvatar)
+	}
+
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
 	if port == "" {
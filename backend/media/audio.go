@@ -0,0 +1,191 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+// Content types of the audio formats voice notes can be sent in
+const (
+	AudioOgg  = "audio/ogg"
+	AudioWebM = "audio/webm"
+	AudioMP4  = "audio/mp4"
+	AudioMPEG = "audio/mpeg"
+	AudioWAV  = "audio/wav"
+)
+
+const (
+	// WaveformLength is the number of bars in the waveform of an audio file
+	WaveformLength = 64
+
+	// MaxWaveformLevel is the level of the loudest bars of a waveform
+	MaxWaveformLevel = 255
+
+	// maxAudioPackets is the most packets read from an audio file, about 6 hours of AAC
+	maxAudioPackets = 1 << 20
+)
+
+// ErrUnsupportedAudio is returned for audio that is corrupt or not in a supported format
+var ErrUnsupportedAudio = errors.New("unsupported audio format")
+
+// AudioInfo describes an audio file
+type AudioInfo struct {
+	// Duration is the playing time in seconds
+	Duration float64
+	// Waveform has WaveformLength levels from 0 to MaxWaveformLevel spread evenly over the duration
+	Waveform []int
+}
+
+// IsAudio reports whether audio of a content type can be processed
+func IsAudio(contentType string) bool {
+	switch contentType {
+	case AudioOgg, AudioWebM, AudioMP4, AudioMPEG, AudioWAV:
+		return true
+	default:
+		return false
+	}
+}
+
+// SniffAudio detects the format of an audio file from its first bytes, where generic content
+// type sniffing only sees a container, e.g. application/ogg. It returns "" for anything but
+// the supported audio formats, so containers holding video are not mistaken for audio.
+func SniffAudio(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("OggS")):
+		if len(head) > 27 && 27+int(head[26]) < len(head) {
+			packet := head[27+int(head[26]):]
+			if bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("\x01vorbis")) {
+				return AudioOgg
+			}
+		}
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		if audio, video := webmCodecs(head); audio && !video {
+			return AudioWebM
+		}
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		if brand := string(head[8:12]); brand == "M4A " || brand == "M4B " {
+			return AudioMP4
+		}
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return AudioWAV
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return AudioMPEG
+	default:
+		if _, ok := parseMP3Header(head); ok {
+			return AudioMPEG
+		}
+	}
+	return ""
+}
+
+// webmCodecs reports whether the track codecs named in the first bytes of a WebM file include
+// audio and video codecs
+func webmCodecs(head []byte) (audio, video bool) {
+	for i := 0; i+3 < len(head); i++ {
+		// A CodecID element with a one byte size, e.g. "A_OPUS" or "V_VP8"
+		if head[i] != 0x86 || head[i+1]&0x80 == 0 {
+			continue
+		}
+		switch string(head[i+2 : i+4]) {
+		case "A_":
+			audio = true
+		case "V_":
+			video = true
+		}
+	}
+	return audio, video
+}
+
+// ProbeAudio reads the duration of an audio file and computes its waveform
+func ProbeAudio(data []byte, contentType string) (*AudioInfo, error) {
+	var track *audioTrack
+	var err error
+	switch contentType {
+	case AudioOgg:
+		track, err = parseOgg(data)
+	case AudioWebM:
+		track, err = parseWebM(data)
+	case AudioMP4:
+		track, err = parseMP4(data)
+	case AudioMPEG:
+		track, err = parseMP3(data)
+	case AudioWAV:
+		track, err = parseWAV(data)
+	default:
+		return nil, ErrUnsupportedAudio
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(track.packets) == 0 || !(track.duration > 0) || math.IsInf(track.duration, 0) {
+		return nil, ErrUnsupportedAudio
+	}
+
+	return &AudioInfo{Duration: track.duration, Waveform: track.waveform()}, nil
+}
+
+// audioPacket is the loudness of a stretch of audio starting at a time in seconds. Compressed
+// formats are not decoded, so the sizes of their packets stand in for loudness: encoders spend
+// few bits on silence.
+type audioPacket struct {
+	at    float64
+	level float64
+}
+
+// audioTrack is what the format parsers read from an audio file
+type audioTrack struct {
+	duration float64
+	packets  []audioPacket
+	// absolute is set if the levels are loudness itself rather than something growing with it
+	absolute bool
+}
+
+// add appends a packet, failing once a file has implausibly many
+func (t *audioTrack) add(at, level float64) error {
+	if len(t.packets) >= maxAudioPackets {
+		return ErrUnsupportedAudio
+	}
+	t.packets = append(t.packets, audioPacket{at: at, level: level})
+	return nil
+}
+
+// waveform averages the packet levels into WaveformLength bars and scales them so the
+// loudest bar is MaxWaveformLevel
+func (t *audioTrack) waveform() []int {
+	var sums [WaveformLength]float64
+	var counts [WaveformLength]int
+	for _, packet := range t.packets {
+		i := int(packet.at / t.duration * WaveformLength)
+		i = max(0, min(i, WaveformLength-1))
+		sums[i] += packet.level
+		counts[i]++
+	}
+
+	// Bars without packets of their own, e.g. in very short files, repeat the previous bar
+	levels := make([]float64, WaveformLength)
+	low, high := math.Inf(1), 0.0
+	for i := range levels {
+		if counts[i] > 0 {
+			levels[i] = sums[i] / float64(counts[i])
+		} else if i > 0 {
+			levels[i] = levels[i-1]
+		}
+		low = min(low, levels[i])
+		high = max(high, levels[i])
+	}
+
+	// Proxies for loudness are never zero, even for silence, so their quietest bar is the baseline
+	if t.absolute {
+		low = 0
+	}
+
+	waveform := make([]int, WaveformLength)
+	if high <= low {
+		return waveform
+	}
+	for i, level := range levels {
+		waveform[i] = int(math.Round((level - low) / (high - low) * MaxWaveformLevel))
+	}
+	return waveform
+}
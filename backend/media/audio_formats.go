@@ -0,0 +1,841 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// parseOgg reads an Ogg Opus or Vorbis file. Pages only carry the time at which their last
+// packet ends, so the packets of a page are spread evenly over the time since the previous page.
+func parseOgg(data []byte) (*audioTrack, error) {
+	track := &audioTrack{}
+
+	var (
+		found      bool
+		serial     uint32
+		rate       float64
+		preSkip    int64
+		headers    int
+		packetSize int
+		pageStart  float64
+	)
+	for pos := 0; pos+27 <= len(data); {
+		if string(data[pos:pos+4]) != "OggS" {
+			return nil, ErrUnsupportedAudio
+		}
+		flags := data[pos+5]
+		granule := int64(binary.LittleEndian.Uint64(data[pos+6:]))
+		pageSerial := binary.LittleEndian.Uint32(data[pos+14:])
+		segments := data[pos+27 : min(pos+27+int(data[pos+26]), len(data))]
+		body := pos + 27 + len(segments)
+		size := 0
+		for _, lacing := range segments {
+			size += int(lacing)
+		}
+		if len(segments) < int(data[pos+26]) || body+size > len(data) {
+			// The recording was cut off
+			break
+		}
+		next := body + size
+
+		if !found {
+			// The first page of each stream identifies its codec; other streams are skipped
+			if flags&0x02 == 0 {
+				return nil, ErrUnsupportedAudio
+			}
+			packet := data[body:next]
+			switch {
+			case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 19:
+				// Opus always counts samples at 48 kHz, after skipping the encoder's delay
+				rate = 48000
+				preSkip = int64(binary.LittleEndian.Uint16(packet[10:]))
+				headers = 2
+			case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+				rate = float64(binary.LittleEndian.Uint32(packet[12:]))
+				headers = 3
+			default:
+				pos = next
+				continue
+			}
+			if rate == 0 {
+				return nil, ErrUnsupportedAudio
+			}
+			found = true
+			serial = pageSerial
+		}
+		if pageSerial != serial {
+			pos = next
+			continue
+		}
+
+		// A lacing value below 255 ends a packet, which may have started on an earlier page
+		var sizes []int
+		for _, lacing := range segments {
+			packetSize += int(lacing)
+			if lacing == 255 {
+				continue
+			}
+			if headers > 0 {
+				headers--
+			} else {
+				sizes = append(sizes, packetSize)
+			}
+			packetSize = 0
+		}
+
+		// Pages on which no packet ends have no time
+		if granule != -1 && len(sizes) > 0 {
+			pageEnd := max(float64(granule-preSkip)/rate, pageStart)
+			step := (pageEnd - pageStart) / float64(len(sizes))
+			for i, size := range sizes {
+				if err := track.add(pageStart+(float64(i)+0.5)*step, float64(size)); err != nil {
+					return nil, err
+				}
+			}
+			pageStart = pageEnd
+			track.duration = pageEnd
+		}
+
+		pos = next
+	}
+
+	if !found {
+		return nil, ErrUnsupportedAudio
+	}
+	return track, nil
+}
+
+// EBML element IDs read from WebM files
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlTrackNumber   = 0xD7
+	ebmlTrackType     = 0x83
+	ebmlCluster       = 0x1F43B675
+	ebmlTimecode      = 0xE7
+	ebmlBlockGroup    = 0xA0
+	ebmlBlock         = 0xA1
+	ebmlSimpleBlock   = 0xA3
+
+	// ebmlAudioTrack is the TrackType of audio tracks
+	ebmlAudioTrack = 2
+)
+
+// parseWebM reads a WebM file. The elements the packets are in are entered rather than
+// skipped, which also copes with the unknown sizes browsers write while recording.
+func parseWebM(data []byte) (*audioTrack, error) {
+	if !bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		return nil, ErrUnsupportedAudio
+	}
+	track := &audioTrack{}
+
+	var (
+		scale       = 1e6 // Nanoseconds per timecode
+		duration    float64
+		clusterTime uint64
+		hasTracks   bool
+		audioTrack  uint64
+		entryNumber uint64
+		entryType   uint64
+		lastBlock   float64
+	)
+	for pos := 0; pos < len(data); {
+		id, idLength := readVint(data[pos:], true)
+		if idLength == 0 {
+			break
+		}
+		size, sizeLength := readVint(data[pos+idLength:], false)
+		if sizeLength == 0 {
+			break
+		}
+		start := pos + idLength + sizeLength
+
+		switch id {
+		case ebmlSegment, ebmlInfo, ebmlCluster, ebmlBlockGroup:
+			pos = start
+			continue
+		case ebmlTracks:
+			hasTracks = true
+			pos = start
+			continue
+		case ebmlTrackEntry:
+			entryNumber, entryType = 0, 0
+			pos = start
+			continue
+		}
+
+		if size == unknownVintSize(sizeLength) {
+			return nil, ErrUnsupportedAudio
+		}
+		if size > uint64(len(data)-start) {
+			// The recording was cut off
+			break
+		}
+		body := data[start : start+int(size)]
+
+		switch id {
+		case ebmlTimecodeScale:
+			scale = float64(readUint(body))
+		case ebmlDuration:
+			duration = readFloat(body)
+		case ebmlTrackNumber:
+			entryNumber = readUint(body)
+		case ebmlTrackType:
+			entryType = readUint(body)
+		case ebmlTimecode:
+			clusterTime = readUint(body)
+		case ebmlSimpleBlock, ebmlBlock:
+			number, numberLength := readVint(body, false)
+			if numberLength == 0 || len(body) < numberLength+3 {
+				return nil, ErrUnsupportedAudio
+			}
+			if audioTrack != 0 && number != audioTrack || audioTrack == 0 && hasTracks {
+				break
+			}
+			relative := int16(binary.BigEndian.Uint16(body[numberLength:]))
+			at := (float64(clusterTime) + float64(relative)) * scale / 1e9
+			if err := track.add(at, float64(len(body)-numberLength-3)); err != nil {
+				return nil, err
+			}
+			lastBlock = max(lastBlock, at)
+		}
+
+		// Track entries list their number and type in any order
+		if audioTrack == 0 && entryNumber != 0 && entryType == ebmlAudioTrack {
+			audioTrack = entryNumber
+		}
+
+		pos = start + int(size)
+	}
+
+	if hasTracks && audioTrack == 0 {
+		return nil, ErrUnsupportedAudio
+	}
+
+	// Recordings made in browsers often lack the duration
+	track.duration = duration * scale / 1e9
+	if !(track.duration > 0) {
+		track.duration = lastBlock
+	}
+	return track, nil
+}
+
+// readVint reads an EBML variable length integer, returning its length or 0 if it is invalid.
+// IDs keep their length marker, sizes do not.
+func readVint(data []byte, keepMarker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > len(data) {
+		return 0, 0
+	}
+
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// unknownVintSize is the size value meaning "unknown" for sizes of a length
+func unknownVintSize(length int) uint64 {
+	return 1<<(7*length) - 1
+}
+
+// readUint reads a big-endian unsigned integer element
+func readUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// readFloat reads a 4 or 8 byte float element
+func readFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	default:
+		return 0
+	}
+}
+
+// mp4Track is an audio track of an MP4 file and the samples read for it so far
+type mp4Track struct {
+	id        uint32
+	timescale uint32
+	duration  uint64
+	end       uint64
+	// Defaults of fragmented files
+	defaultDuration uint32
+	defaultSize     uint32
+}
+
+// parseMP4 reads the first audio track of an MP4 file, either from its sample tables or,
+// for fragmented files as recorded by some browsers, from its fragments
+func parseMP4(data []byte) (*audioTrack, error) {
+	track := &audioTrack{}
+
+	var audio *mp4Track
+	err := mp4Boxes(data, func(kind string, body []byte) error {
+		switch kind {
+		case "moov":
+			found, err := parseMP4Movie(body, track)
+			if err != nil {
+				return err
+			}
+			audio = found
+		case "moof":
+			if audio == nil {
+				return ErrUnsupportedAudio
+			}
+			return mp4Boxes(body, func(kind string, body []byte) error {
+				if kind == "traf" {
+					return parseMP4Fragment(body, audio, track)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if audio == nil {
+		return nil, ErrUnsupportedAudio
+	}
+
+	if audio.duration > 0 {
+		track.duration = float64(audio.duration) / float64(audio.timescale)
+	} else {
+		track.duration = float64(audio.end) / float64(audio.timescale)
+	}
+	return track, nil
+}
+
+// parseMP4Movie finds the first audio track of a movie box and reads its sample tables
+func parseMP4Movie(moov []byte, track *audioTrack) (*mp4Track, error) {
+	var audio *mp4Track
+	var trexes [][]byte
+	err := mp4Boxes(moov, func(kind string, body []byte) error {
+		switch kind {
+		case "trak":
+			if audio != nil {
+				return nil
+			}
+			found, err := parseMP4Track(body, track)
+			if err != nil {
+				return err
+			}
+			audio = found
+		case "mvex":
+			return mp4Boxes(body, func(kind string, body []byte) error {
+				if kind == "trex" {
+					trexes = append(trexes, body)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || audio == nil {
+		return nil, err
+	}
+
+	// Fragment defaults of the track
+	for _, trex := range trexes {
+		r := &beReader{data: trex}
+		r.skip(4)
+		if r.u32() == audio.id {
+			r.skip(4)
+			audio.defaultDuration = r.u32()
+			audio.defaultSize = r.u32()
+		}
+	}
+	return audio, nil
+}
+
+// parseMP4Track reads a track box, returning nil if it is not an audio track
+func parseMP4Track(trak []byte, track *audioTrack) (*mp4Track, error) {
+	audio := &mp4Track{}
+	var handler string
+	var stts, stsz []byte
+	err := mp4Boxes(trak, func(kind string, body []byte) error {
+		switch kind {
+		case "tkhd":
+			r := &beReader{data: body}
+			if r.u8() == 1 {
+				r.skip(3 + 16)
+			} else {
+				r.skip(3 + 8)
+			}
+			audio.id = r.u32()
+		case "mdia":
+			return mp4Boxes(body, func(kind string, body []byte) error {
+				switch kind {
+				case "mdhd":
+					r := &beReader{data: body}
+					if r.u8() == 1 {
+						r.skip(3 + 16)
+						audio.timescale = r.u32()
+						audio.duration = r.u64()
+					} else {
+						r.skip(3 + 8)
+						audio.timescale = r.u32()
+						audio.duration = uint64(r.u32())
+					}
+				case "hdlr":
+					if len(body) >= 12 {
+						handler = string(body[8:12])
+					}
+				case "minf":
+					return mp4Boxes(body, func(kind string, body []byte) error {
+						if kind != "stbl" {
+							return nil
+						}
+						return mp4Boxes(body, func(kind string, body []byte) error {
+							switch kind {
+							case "stts":
+								stts = body
+							case "stsz":
+								stsz = body
+							}
+							return nil
+						})
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || handler != "soun" {
+		return nil, err
+	}
+	if audio.timescale == 0 {
+		return nil, ErrUnsupportedAudio
+	}
+
+	// Sample times and sizes are listed separately; fragmented files list no samples here
+	if stts == nil || stsz == nil {
+		return audio, nil
+	}
+	times := &beReader{data: stts}
+	times.skip(4)
+	entries := times.u32()
+	sizes := &beReader{data: stsz}
+	sizes.skip(4)
+	sampleSize := sizes.u32()
+	count := sizes.u32()
+
+	var remaining, delta uint32
+	for i := uint32(0); i < count; i++ {
+		for remaining == 0 && entries > 0 && !times.short {
+			remaining = times.u32()
+			delta = times.u32()
+			entries--
+		}
+		size := sampleSize
+		if size == 0 {
+			size = sizes.u32()
+		}
+		if times.short || sizes.short || remaining == 0 {
+			return nil, ErrUnsupportedAudio
+		}
+		if err := track.add(float64(audio.end)/float64(audio.timescale), float64(size)); err != nil {
+			return nil, err
+		}
+		audio.end += uint64(delta)
+		remaining--
+	}
+	return audio, nil
+}
+
+// parseMP4Fragment reads the samples of a track fragment box if it belongs to the audio track
+func parseMP4Fragment(traf []byte, audio *mp4Track, track *audioTrack) error {
+	defaultDuration, defaultSize := audio.defaultDuration, audio.defaultSize
+	ours := false
+	return mp4Boxes(traf, func(kind string, body []byte) error {
+		r := &beReader{data: body}
+		versionFlags := r.u32()
+		version, flags := versionFlags>>24, versionFlags&0xFFFFFF
+		switch kind {
+		case "tfhd":
+			ours = r.u32() == audio.id
+			if flags&0x01 != 0 {
+				r.skip(8)
+			}
+			if flags&0x02 != 0 {
+				r.skip(4)
+			}
+			if flags&0x08 != 0 {
+				defaultDuration = r.u32()
+			}
+			if flags&0x10 != 0 {
+				defaultSize = r.u32()
+			}
+		case "tfdt":
+			if !ours {
+				return nil
+			}
+			if version == 1 {
+				audio.end = r.u64()
+			} else {
+				audio.end = uint64(r.u32())
+			}
+		case "trun":
+			if !ours {
+				return nil
+			}
+			count := r.u32()
+			if flags&0x01 != 0 {
+				r.skip(4)
+			}
+			if flags&0x04 != 0 {
+				r.skip(4)
+			}
+			for i := uint32(0); i < count; i++ {
+				duration, size := defaultDuration, defaultSize
+				if flags&0x100 != 0 {
+					duration = r.u32()
+				}
+				if flags&0x200 != 0 {
+					size = r.u32()
+				}
+				if flags&0x400 != 0 {
+					r.skip(4)
+				}
+				if flags&0x800 != 0 {
+					r.skip(4)
+				}
+				if r.short {
+					return ErrUnsupportedAudio
+				}
+				if err := track.add(float64(audio.end)/float64(audio.timescale), float64(size)); err != nil {
+					return err
+				}
+				audio.end += uint64(duration)
+			}
+		}
+		if r.short {
+			return ErrUnsupportedAudio
+		}
+		return nil
+	})
+}
+
+// mp4Boxes calls fn for each box in data
+func mp4Boxes(data []byte, fn func(kind string, body []byte) error) error {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return ErrUnsupportedAudio
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header {
+			return ErrUnsupportedAudio
+		}
+		if size > uint64(len(data)) {
+			// Only the media data may be cut off, the boxes describing it are needed whole
+			if kind == "mdat" {
+				return nil
+			}
+			return ErrUnsupportedAudio
+		}
+		if err := fn(kind, data[header:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// beReader reads big-endian fields, remembering if it ran past the end of its data
+type beReader struct {
+	data  []byte
+	pos   int
+	short bool
+}
+
+func (r *beReader) take(n int) []byte {
+	if r.short || r.pos+n > len(r.data) {
+		r.short = true
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *beReader) skip(n int)  { r.take(n) }
+func (r *beReader) u8() byte    { return r.take(1)[0] }
+func (r *beReader) u32() uint32 { return binary.BigEndian.Uint32(r.take(4)) }
+func (r *beReader) u64() uint64 { return binary.BigEndian.Uint64(r.take(8)) }
+
+// Bitrates in kbit/s of MPEG audio layer III by bitrate index, for MPEG-1 and for MPEG-2 and 2.5
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// Sample rates of MPEG-1, MPEG-2 and MPEG-2.5 audio by sample rate index
+var mp3SampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+// mp3Header is the header of an MPEG audio layer III frame
+type mp3Header struct {
+	length     int
+	samples    int
+	sampleRate int
+	mpeg1      bool
+	mono       bool
+	crc        bool
+}
+
+// parseMP3Header parses the header at the start of a layer III frame
+func parseMP3Header(data []byte) (mp3Header, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return mp3Header{}, false
+	}
+	version := (data[1] >> 3) & 3
+	layer := (data[1] >> 1) & 3
+	bitrateIndex := data[2] >> 4
+	rateIndex := (data[2] >> 2) & 3
+	if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Header{}, false
+	}
+
+	h := mp3Header{
+		mpeg1: version == 3,
+		mono:  data[3]>>6 == 3,
+		crc:   data[1]&1 == 0,
+	}
+	padding := int(data[2]>>1) & 1
+	if h.mpeg1 {
+		h.sampleRate = mp3SampleRates[0][rateIndex]
+		h.samples = 1152
+		h.length = 144*mp3Bitrates[0][bitrateIndex]*1000/h.sampleRate + padding
+	} else {
+		table := 1
+		if version == 0 {
+			table = 2
+		}
+		h.sampleRate = mp3SampleRates[table][rateIndex]
+		h.samples = 576
+		h.length = 72*mp3Bitrates[1][bitrateIndex]*1000/h.sampleRate + padding
+	}
+	return h, true
+}
+
+// sideInfo returns the side information of a frame, which describes how its audio is coded
+func (h mp3Header) sideInfo(frame []byte) []byte {
+	if h.crc {
+		return frame[min(6, len(frame)):]
+	}
+	return frame[4:]
+}
+
+// sideInfoLength is the length of the side information of the frame's kind
+func (h mp3Header) sideInfoLength() int {
+	switch {
+	case h.mpeg1 && h.mono:
+		return 17
+	case h.mpeg1:
+		return 32
+	case h.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+// globalGain returns the global gain of the first granule of a frame. It is the quantizer
+// step size, which encoders raise with the loudness of the audio.
+func (h mp3Header) globalGain(frame []byte) int {
+	// Skip main_data_begin, the private bits and scfsi, then part2_3_length and big_values
+	var offset int
+	switch {
+	case h.mpeg1 && h.mono:
+		offset = 9 + 5 + 4
+	case h.mpeg1:
+		offset = 9 + 3 + 8
+	case h.mono:
+		offset = 8 + 1
+	default:
+		offset = 8 + 2
+	}
+	offset += 12 + 9
+
+	info := h.sideInfo(frame)
+	gain := 0
+	for i := offset; i < offset+8; i++ {
+		if i/8 >= len(info) {
+			return 0
+		}
+		gain = gain<<1 | int(info[i/8]>>(7-i%8))&1
+	}
+	return gain
+}
+
+// parseMP3 reads an MP3 file frame by frame, skipping tags and resynchronizing after garbage
+func parseMP3(data []byte) (*audioTrack, error) {
+	track := &audioTrack{}
+
+	pos := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		pos = 10 + size
+		if data[5]&0x10 != 0 {
+			pos += 10
+		}
+	}
+
+	var at float64
+	first := true
+	for pos+4 <= len(data) {
+		if bytes.HasPrefix(data[pos:], []byte("TAG")) {
+			break
+		}
+		h, ok := parseMP3Header(data[pos:])
+		if !ok {
+			pos++
+			continue
+		}
+		if pos+h.length > len(data) {
+			break
+		}
+		frame := data[pos : pos+h.length]
+		pos += h.length
+
+		// Encoders put their Xing or Info header in a first frame without audio
+		if first {
+			first = false
+			tag := h.sideInfo(frame)[min(h.sideInfoLength(), len(h.sideInfo(frame))):]
+			if bytes.HasPrefix(tag, []byte("Xing")) || bytes.HasPrefix(tag, []byte("Info")) ||
+				(len(frame) >= 40 && string(frame[36:40]) == "VBRI") {
+				continue
+			}
+		}
+
+		if err := track.add(at, float64(h.globalGain(frame))); err != nil {
+			return nil, err
+		}
+		at += float64(h.samples) / float64(h.sampleRate)
+	}
+
+	track.duration = at
+	return track, nil
+}
+
+// WAV sample formats
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xFFFE
+)
+
+// parseWAV reads a WAV file of PCM or float samples. The samples are not compressed, so the
+// waveform is the loudness of the first channel in windows of 10 ms.
+func parseWAV(data []byte) (*audioTrack, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, ErrUnsupportedAudio
+	}
+
+	var format, bits, blockAlign, rate int
+	var samples []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size >= 0 && size < len(body) {
+			body = body[:size]
+		}
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, ErrUnsupportedAudio
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			blockAlign = int(binary.LittleEndian.Uint16(body[12:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if format == wavExtensible && len(body) >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+		case "data":
+			// Recordings cut off while writing are read as far as they go
+			samples = body
+		}
+
+		if size < 0 || size > len(data)-pos-8 {
+			break
+		}
+		pos += 8 + size + size&1
+	}
+
+	validFormat := format == wavPCM && (bits == 8 || bits == 16 || bits == 24 || bits == 32) ||
+		format == wavFloat && bits == 32
+	if !validFormat || rate <= 0 || blockAlign < bits/8 {
+		return nil, ErrUnsupportedAudio
+	}
+
+	frames := len(samples) / blockAlign
+	track := &audioTrack{duration: float64(frames) / float64(rate), absolute: true}
+	window := max(rate/100, 1)
+	for start := 0; start < frames; start += window {
+		end := min(start+window, frames)
+		var sum float64
+		for i := start; i < end; i++ {
+			sample := wavSample(samples[i*blockAlign:], format, bits)
+			sum += sample * sample
+		}
+		if err := track.add(float64(start)/float64(rate), math.Sqrt(sum/float64(end-start))); err != nil {
+			return nil, err
+		}
+	}
+	return track, nil
+}
+
+// wavSample reads a sample scaled to [-1, 1]
+func wavSample(data []byte, format, bits int) float64 {
+	switch {
+	case format == wavFloat:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+	case bits == 8:
+		// 8-bit samples are unsigned
+		return (float64(data[0]) - 128) / 128
+	case bits == 16:
+		return float64(int16(binary.LittleEndian.Uint16(data))) / (1 << 15)
+	case bits == 24:
+		return float64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24)>>8) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(data))) / (1 << 31)
+	}
+}
@@ -0,0 +1,542 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// wavFile builds a WAV file of a sample format holding the given frames of one channel
+func wavFile(format, bits, rate int, samples []float64) []byte {
+	blockAlign := bits / 8
+	var data []byte
+	for _, sample := range samples {
+		switch {
+		case format == wavFloat:
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(sample)))
+		case bits == 8:
+			data = append(data, byte(sample*127+128))
+		case bits == 16:
+			data = binary.LittleEndian.AppendUint16(data, uint16(int16(sample*32767)))
+		case bits == 24:
+			v := int32(sample * (1<<23 - 1))
+			data = append(data, byte(v), byte(v>>8), byte(v>>16))
+		default:
+			data = binary.LittleEndian.AppendUint32(data, uint32(int32(sample*(1<<31-1))))
+		}
+	}
+
+	fmtChunk := binary.LittleEndian.AppendUint16(nil, uint16(format))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 1)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(rate))
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(rate*blockAlign))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(blockAlign))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+
+	out := []byte("RIFF\x00\x00\x00\x00WAVE")
+	out = append(out, riffChunk("fmt ", fmtChunk)...)
+	out = append(out, riffChunk("LIST", []byte("INFOISFT\x05\x00\x00\x00test\x00"))...)
+	out = append(out, riffChunk("data", data)...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+func riffChunk(id string, body []byte) []byte {
+	chunk := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// quietThenLoud returns a second of silence followed by a second of a loud tone
+func quietThenLoud(rate int) []float64 {
+	samples := make([]float64, 2*rate)
+	for i := rate; i < len(samples); i++ {
+		samples[i] = 0.9 * math.Sin(2*math.Pi*440*float64(i)/float64(rate))
+	}
+	return samples
+}
+
+// checkQuietThenLoud checks the waveform of audio that gets louder half way
+func checkQuietThenLoud(t *testing.T, info *AudioInfo) {
+	t.Helper()
+	if len(info.Waveform) != WaveformLength {
+		t.Fatalf("waveform has %d bars, want %d", len(info.Waveform), WaveformLength)
+	}
+	if info.Waveform[0] != 0 {
+		t.Errorf("first bar = %d, want 0", info.Waveform[0])
+	}
+	loudest := 0
+	for _, level := range info.Waveform {
+		loudest = max(loudest, level)
+	}
+	if loudest != MaxWaveformLevel {
+		t.Errorf("loudest bar = %d, want %d", loudest, MaxWaveformLevel)
+	}
+	if info.Waveform[WaveformLength-1] < MaxWaveformLevel*9/10 {
+		t.Errorf("last bar = %d, want it loud", info.Waveform[WaveformLength-1])
+	}
+}
+
+func TestProbeWAV(t *testing.T) {
+	tests := []struct {
+		name   string
+		format int
+		bits   int
+	}{
+		{"8-bit", wavPCM, 8},
+		{"16-bit", wavPCM, 16},
+		{"24-bit", wavPCM, 24},
+		{"32-bit", wavPCM, 32},
+		{"float", wavFloat, 32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := wavFile(tt.format, tt.bits, 8000, quietThenLoud(8000))
+			if got := SniffAudio(data[:512]); got != AudioWAV {
+				t.Errorf("SniffAudio() = %q, want %q", got, AudioWAV)
+			}
+
+			info, err := ProbeAudio(data, AudioWAV)
+			if err != nil {
+				t.Fatalf("ProbeAudio() error = %v", err)
+			}
+			if info.Duration != 2 {
+				t.Errorf("duration = %v, want 2", info.Duration)
+			}
+			checkQuietThenLoud(t, info)
+		})
+	}
+
+	// A recording cut off while writing is read as far as it goes
+	data := wavFile(wavPCM, 16, 8000, quietThenLoud(8000))
+	info, err := ProbeAudio(data[:len(data)-8000], AudioWAV)
+	if err != nil {
+		t.Fatalf("ProbeAudio() of a cut off file error = %v", err)
+	}
+	if info.Duration != 1.5 {
+		t.Errorf("duration of a cut off file = %v, want 1.5", info.Duration)
+	}
+
+	for name, data := range map[string][]byte{
+		"12-bit":  wavFile(wavPCM, 12, 8000, quietThenLoud(8000)),
+		"no data": wavFile(wavPCM, 16, 8000, nil),
+		"no fmt":  append([]byte("RIFF\x00\x00\x00\x00WAVE"), riffChunk("data", make([]byte, 100))...),
+		"not wav": []byte("RIFF\x00\x00\x00\x00AVI LIST"),
+	} {
+		if _, err := ProbeAudio(data, AudioWAV); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("ProbeAudio(%s) error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+// oggPage builds an Ogg page of whole packets
+func oggPage(flags byte, granule int64, serial uint32, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, packet := range packets {
+		size := len(packet)
+		for ; size >= 255; size -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(size))
+		body = append(body, packet...)
+	}
+
+	page := []byte("OggS\x00")
+	page = append(page, flags)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = append(page, 0, 0, 0, 0, 0, 0, 0, 0) // Sequence number and CRC, not checked
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+// opusFile builds an Ogg Opus file of 20 ms packets of the given sizes
+func opusFile(serial uint32, sizes []int) []byte {
+	const preSkip = 312
+	head := []byte("OpusHead\x01\x01")
+	head = binary.LittleEndian.AppendUint16(head, preSkip)
+	head = append(head, 0x80, 0xBB, 0, 0, 0, 0, 0)
+
+	data := oggPage(0x02, 0, serial, head)
+	data = append(data, oggPage(0, 0, serial, []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00"))...)
+
+	// Five packets a page
+	granule := int64(preSkip)
+	for start := 0; start < len(sizes); start += 5 {
+		var packets [][]byte
+		for _, size := range sizes[start:min(start+5, len(sizes))] {
+			packets = append(packets, bytes.Repeat([]byte{0x55}, size))
+			granule += 960
+		}
+		flags := byte(0)
+		if start+5 >= len(sizes) {
+			flags = 0x04
+		}
+		data = append(data, oggPage(flags, granule, serial, packets...)...)
+	}
+	return data
+}
+
+// quietThenLoudSizes returns packet sizes of compressed audio that gets louder half way
+func quietThenLoudSizes(n int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = 10
+		if i >= n/2 {
+			sizes[i] = 120
+		}
+	}
+	return sizes
+}
+
+func TestProbeOgg(t *testing.T) {
+	data := opusFile(1, quietThenLoudSizes(100))
+	if got := SniffAudio(data); got != AudioOgg {
+		t.Errorf("SniffAudio() = %q, want %q", got, AudioOgg)
+	}
+
+	info, err := ProbeAudio(data, AudioOgg)
+	if err != nil {
+		t.Fatalf("ProbeAudio() error = %v", err)
+	}
+	if math.Abs(info.Duration-2) > 1e-9 {
+		t.Errorf("duration = %v, want 2", info.Duration)
+	}
+	checkQuietThenLoud(t, info)
+
+	// Pages of other streams are skipped
+	mixed := append(append([]byte{}, data...), opusFile(2, quietThenLoudSizes(200))...)
+	info, err = ProbeAudio(mixed, AudioOgg)
+	if err != nil || math.Abs(info.Duration-2) > 1e-9 {
+		t.Errorf("ProbeAudio() of two streams = %+v, %v, want the duration of the first", info, err)
+	}
+
+	// A recording cut off in the middle of a page keeps the pages before it
+	info, err = ProbeAudio(data[:len(data)-50], AudioOgg)
+	if err != nil || info.Duration >= 2 {
+		t.Errorf("ProbeAudio() of a cut off file = %+v, %v", info, err)
+	}
+
+	for name, data := range map[string][]byte{
+		"no stream start": oggPage(0, 0, 1, []byte("OpusHead\x01\x01\x00\x00")),
+		"not opus":        oggPage(0x02, 0, 1, []byte("\x80theora")),
+		"headers only":    opusFile(1, nil),
+		"garbage":         append(opusFile(1, []int{10})[:60], "garbage garbage garbage"...),
+	} {
+		if _, err := ProbeAudio(data, AudioOgg); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("ProbeAudio(%s) error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+// ebml builds an EBML element with a known size
+func ebml(id uint32, body ...[]byte) []byte {
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+	content := bytes.Join(body, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(content)))
+	size[0] = 0x01
+	return append(append(element, size...), content...)
+}
+
+// ebmlUnknown builds an EBML element of unknown size, as written while recording
+func ebmlUnknown(id uint32, body ...[]byte) []byte {
+	element := binary.BigEndian.AppendUint32(nil, id)
+	element = append(element, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	return append(element, bytes.Join(body, nil)...)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, value))
+}
+
+// webmFile builds a WebM file with an audio track 1 and a video track 2, and 20 ms blocks of
+// the given sizes on the audio track followed by blocks on the video track
+func webmFile(withDuration bool, sizes []int) []byte {
+	var info [][]byte
+	info = append(info, ebmlUint(ebmlTimecodeScale, 1000000))
+	if withDuration {
+		info = append(info, ebml(ebmlDuration, binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(20*len(sizes))))))
+	}
+
+	var blocks [][]byte
+	blocks = append(blocks, ebmlUint(ebmlTimecode, 0))
+	for i, size := range sizes {
+		block := []byte{0x81, byte(i * 20 >> 8), byte(i * 20), 0x80}
+		blocks = append(blocks, ebml(ebmlSimpleBlock, block, bytes.Repeat([]byte{0x55}, size)))
+		blocks = append(blocks, ebml(ebmlSimpleBlock, []byte{0x82, 0, 0, 0x80}, make([]byte, 4000)))
+	}
+
+	return bytes.Join([][]byte{
+		ebml(0x1A45DFA3, ebml(0x4282, []byte("webm"))),
+		ebmlUnknown(ebmlSegment,
+			ebml(ebmlInfo, info...),
+			ebml(ebmlTracks,
+				ebml(ebmlTrackEntry, ebmlUint(ebmlTrackType, 2), ebmlUint(ebmlTrackNumber, 1), ebml(0x86, []byte("A_OPUS"))),
+				ebml(ebmlTrackEntry, ebmlUint(ebmlTrackNumber, 2), ebmlUint(ebmlTrackType, 1), ebml(0x86, []byte("V_VP8"))),
+			),
+			ebmlUnknown(ebmlCluster, blocks...),
+		),
+	}, nil)
+}
+
+func TestProbeWebM(t *testing.T) {
+	for _, withDuration := range []bool{true, false} {
+		data := webmFile(withDuration, quietThenLoudSizes(100))
+		info, err := ProbeAudio(data, AudioWebM)
+		if err != nil {
+			t.Fatalf("ProbeAudio() error = %v", err)
+		}
+		// Without a duration the last block tells how long the recording is
+		want := 2.0
+		if !withDuration {
+			want = 1.98
+		}
+		if math.Abs(info.Duration-want) > 1e-9 {
+			t.Errorf("duration = %v, want %v", info.Duration, want)
+		}
+		checkQuietThenLoud(t, info)
+	}
+
+	// Files with video tracks are video, not voice notes
+	if got := SniffAudio(webmFile(true, quietThenLoudSizes(10))); got != "" {
+		t.Errorf("SniffAudio() of a video = %q, want none", got)
+	}
+
+	videoOnly := bytes.Join([][]byte{
+		ebml(0x1A45DFA3),
+		ebml(ebmlSegment, ebml(ebmlTracks, ebml(ebmlTrackEntry, ebmlUint(ebmlTrackNumber, 1), ebmlUint(ebmlTrackType, 1)))),
+	}, nil)
+	for name, data := range map[string][]byte{
+		"video only":       videoOnly,
+		"not webm":         []byte("OggS"),
+		"unknown size":     append(ebml(0x1A45DFA3), ebmlUnknown(ebmlDuration)...),
+		"truncated blocks": append(ebml(0x1A45DFA3), ebml(ebmlSimpleBlock, []byte{0x81})...),
+	} {
+		if _, err := ProbeAudio(data, AudioWebM); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("ProbeAudio(%s) error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+// mp4Box builds an MP4 box
+func mp4Box(kind string, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	return append(append(box, kind...), content...)
+}
+
+// fullBox builds the version and flags of a full box followed by 32-bit fields
+func fullBox(versionFlags uint32, fields ...uint32) []byte {
+	body := binary.BigEndian.AppendUint32(nil, versionFlags)
+	for _, field := range fields {
+		body = binary.BigEndian.AppendUint32(body, field)
+	}
+	return body
+}
+
+// mp4Trak builds a track box with a handler, listing 20 ms samples of the given sizes
+func mp4Trak(id uint32, handler string, sizes []int) []byte {
+	stsz := fullBox(0, 0, uint32(len(sizes)))
+	for _, size := range sizes {
+		stsz = binary.BigEndian.AppendUint32(stsz, uint32(size))
+	}
+	return mp4Box("trak",
+		mp4Box("tkhd", fullBox(0, 0, 0, id)),
+		mp4Box("mdia",
+			mp4Box("mdhd", fullBox(0, 0, 0, 1000, uint32(20*len(sizes)))),
+			mp4Box("hdlr", fullBox(0, 0), []byte(handler), make([]byte, 13)),
+			mp4Box("minf", mp4Box("stbl",
+				mp4Box("stts", fullBox(0, 1, uint32(len(sizes)), 20)),
+				mp4Box("stsz", stsz),
+			)),
+		),
+	)
+}
+
+func TestProbeMP4(t *testing.T) {
+	sizes := quietThenLoudSizes(100)
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00M4A isom"))
+	data := bytes.Join([][]byte{
+		ftyp,
+		mp4Box("moov", mp4Trak(1, "vide", []int{5000}), mp4Trak(2, "soun", sizes)),
+		mp4Box("mdat", make([]byte, 100)),
+	}, nil)
+	if got := SniffAudio(data); got != AudioMP4 {
+		t.Errorf("SniffAudio() = %q, want %q", got, AudioMP4)
+	}
+
+	info, err := ProbeAudio(data, AudioMP4)
+	if err != nil {
+		t.Fatalf("ProbeAudio() error = %v", err)
+	}
+	if info.Duration != 2 {
+		t.Errorf("duration = %v, want 2", info.Duration)
+	}
+	checkQuietThenLoud(t, info)
+
+	// The media data may be cut off, the boxes describing it may not
+	if _, err := ProbeAudio(data[:len(data)-50], AudioMP4); err != nil {
+		t.Errorf("ProbeAudio() of cut off media data error = %v", err)
+	}
+
+	// Fragmented files list their samples in fragments, with defaults in the movie
+	moov := mp4Box("moov",
+		mp4Box("trak",
+			mp4Box("tkhd", fullBox(0, 0, 0, 1)),
+			mp4Box("mdia", mp4Box("mdhd", fullBox(0, 0, 0, 1000, 0)), mp4Box("hdlr", fullBox(0, 0), []byte("soun"))),
+		),
+		mp4Box("mvex", mp4Box("trex", fullBox(0, 1, 1, 20, 10, 0))),
+	)
+	fragmented := append(append([]byte{}, ftyp...), moov...)
+	for start := 0; start < len(sizes); start += 10 {
+		trun := fullBox(0x200, 10)
+		for _, size := range sizes[start : start+10] {
+			trun = binary.BigEndian.AppendUint32(trun, uint32(size))
+		}
+		fragmented = append(fragmented, mp4Box("moof", mp4Box("traf",
+			mp4Box("tfhd", fullBox(0x020000, 1)),
+			mp4Box("tfdt", fullBox(0, uint32(start*20))),
+			mp4Box("trun", trun),
+		))...)
+		fragmented = append(fragmented, mp4Box("mdat", make([]byte, 10))...)
+	}
+	info, err = ProbeAudio(fragmented, AudioMP4)
+	if err != nil {
+		t.Fatalf("ProbeAudio() of a fragmented file error = %v", err)
+	}
+	if info.Duration != 2 {
+		t.Errorf("duration of a fragmented file = %v, want 2", info.Duration)
+	}
+	checkQuietThenLoud(t, info)
+
+	for name, data := range map[string][]byte{
+		"video only":    bytes.Join([][]byte{ftyp, mp4Box("moov", mp4Trak(1, "vide", sizes))}, nil),
+		"no movie":      ftyp,
+		"cut off box":   bytes.Join([][]byte{ftyp, mp4Box("moov", mp4Trak(1, "soun", sizes))[:200]}, nil),
+		"short sizes":   bytes.Join([][]byte{ftyp, mp4Box("moov", mp4Box("trak", mp4Trak(1, "soun", sizes)[8:300]))}, nil),
+		"box too short": append(append([]byte{}, ftyp...), 0, 0, 0, 4, 'm', 'o', 'o', 'v'),
+	} {
+		if _, err := ProbeAudio(data, AudioMP4); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("ProbeAudio(%s) error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+// mp3Frame builds an MPEG-1 layer III frame at 128 kbit/s and 44.1 kHz with a global gain
+func mp3Frame(gain int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+
+	// The global gain of the first granule starts 41 bits into the side information of stereo frames
+	for i := 0; i < 8; i++ {
+		if gain>>(7-i)&1 == 1 {
+			bit := 41 + i
+			frame[4+bit/8] |= 0x80 >> (bit % 8)
+		}
+	}
+	return frame
+}
+
+func TestProbeMP3(t *testing.T) {
+	var data []byte
+
+	// A tag before the audio, and a first frame holding the encoder's Xing header
+	data = append(data, "ID3\x04\x00\x00\x00\x00\x00\x0A"...)
+	data = append(data, make([]byte, 10)...)
+	xing := mp3Frame(0)
+	copy(xing[4+32:], "Xing")
+	data = append(data, xing...)
+	for i := 0; i < 100; i++ {
+		gain := 100
+		if i >= 50 {
+			gain = 200
+		}
+		data = append(data, mp3Frame(gain)...)
+		if i == 30 {
+			// Garbage the parser resynchronizes after
+			data = append(data, "garbage"...)
+		}
+	}
+	data = append(data, "TAG"...)
+	data = append(data, make([]byte, 125)...)
+
+	if got := SniffAudio(data); got != AudioMPEG {
+		t.Errorf("SniffAudio() = %q, want %q", got, AudioMPEG)
+	}
+	if got := SniffAudio(mp3Frame(100)); got != AudioMPEG {
+		t.Errorf("SniffAudio() of a file without tags = %q, want %q", got, AudioMPEG)
+	}
+
+	info, err := ProbeAudio(data, AudioMPEG)
+	if err != nil {
+		t.Fatalf("ProbeAudio() error = %v", err)
+	}
+	if want := 100 * 1152 / 44100.0; math.Abs(info.Duration-want) > 1e-9 {
+		t.Errorf("duration = %v, want %v", info.Duration, want)
+	}
+	checkQuietThenLoud(t, info)
+
+	for name, data := range map[string][]byte{
+		"no frames": []byte("ID3\x04\x00\x00\x00\x00\x00\x00garbage"),
+		"layer II":  append([]byte{0xFF, 0xFD, 0x90, 0x00}, make([]byte, 500)...),
+		"cut off":   mp3Frame(100)[:200],
+		"xing only": xing,
+	} {
+		if _, err := ProbeAudio(data, AudioMPEG); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("ProbeAudio(%s) error = %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
+
+func TestProbeAudioUnsupported(t *testing.T) {
+	if _, err := ProbeAudio(wavFile(wavPCM, 16, 8000, quietThenLoud(8000)), "audio/flac"); !errors.Is(err, ErrUnsupportedAudio) {
+		t.Errorf("ProbeAudio() of another type error = %v, want ErrUnsupportedAudio", err)
+	}
+	for _, contentType := range []string{AudioOgg, AudioWebM, AudioMP4, AudioMPEG, AudioWAV} {
+		if _, err := ProbeAudio(nil, contentType); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("ProbeAudio() of an empty %s file error = %v, want ErrUnsupportedAudio", contentType, err)
+		}
+	}
+}
+
+func FuzzProbeAudio(f *testing.F) {
+	sizes := quietThenLoudSizes(10)
+	f.Add(uint8(0), opusFile(1, sizes))
+	f.Add(uint8(1), webmFile(false, sizes))
+	f.Add(uint8(2), bytes.Join([][]byte{mp4Box("ftyp", []byte("M4A ")), mp4Box("moov", mp4Trak(1, "soun", sizes))}, nil))
+	f.Add(uint8(3), append(mp3Frame(100), mp3Frame(200)...))
+	f.Add(uint8(4), wavFile(wavPCM, 16, 8000, make([]float64, 100)))
+
+	contentTypes := []string{AudioOgg, AudioWebM, AudioMP4, AudioMPEG, AudioWAV}
+	f.Fuzz(func(t *testing.T, format uint8, data []byte) {
+		info, err := ProbeAudio(data, contentTypes[int(format)%len(contentTypes)])
+		if err != nil {
+			return
+		}
+		if !(info.Duration > 0) || math.IsInf(info.Duration, 0) {
+			t.Errorf("ProbeAudio() duration = %v", info.Duration)
+		}
+		if len(info.Waveform) != WaveformLength {
+			t.Errorf("ProbeAudio() returned %d bars", len(info.Waveform))
+		}
+		for _, level := range info.Waveform {
+			if level < 0 || level > MaxWaveformLevel {
+				t.Errorf("ProbeAudio() returned level %d", level)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// MinAvatarDimension is the smallest width and height of an avatar image
+const MinAvatarDimension = 32
+
+// ErrAvatarTooSmall is returned for avatar images smaller than MinAvatarDimension
+var ErrAvatarTooSmall = errors.New("avatar image is too small")
+
+// MakeAvatar crops a JPEG, PNG or GIF image to a centered square and encodes it as a JPEG in
+// each of the given sizes. Sizes larger than the square are encoded at the square's size.
+// Transparent areas become white, and no metadata of the original is kept.
+func MakeAvatar(data []byte, contentType string, sizes []ThumbnailSize) ([]Thumbnail, error) {
+	if !CanProcess(contentType) {
+		return nil, ErrUnsupportedImage
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+	if config.Width < MinAvatarDimension || config.Height < MinAvatarDimension {
+		return nil, ErrAvatarTooSmall
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := toRGBA(decoded)
+	if contentType == "image/jpeg" {
+		img = Orient(img, JPEGOrientation(data))
+	}
+
+	// Crop the centered square onto a white background
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	side := min(w, h)
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(square, square.Bounds(), img, image.Pt((w-side)/2, (h-side)/2), draw.Over)
+
+	avatars := make([]Thumbnail, 0, len(sizes))
+	for _, size := range sizes {
+		dimension := min(size.MaxDimension, side)
+		scaled := square
+		if dimension < side {
+			scaled = Resize(square, dimension, dimension)
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		avatars = append(avatars, Thumbnail{
+			Name:        size.Name,
+			Width:       dimension,
+			Height:      dimension,
+			ContentType: "image/jpeg",
+			Data:        buf.Bytes(),
+		})
+	}
+
+	return avatars, nil
+}
@@ -0,0 +1,153 @@
+// Package media processes uploaded images: it strips their metadata, generates
+// thumbnails and computes placeholders shown while they load.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// MaxImagePixels is the largest image, in pixels, that is decoded. Larger images are
+// rejected so a small file cannot expand to gigabytes of memory.
+const MaxImagePixels = 50_000_000
+
+// ErrUnsupportedImage is returned for image formats that cannot be processed
+var ErrUnsupportedImage = errors.New("unsupported image format")
+
+// ThumbnailSize is a named thumbnail size
+type ThumbnailSize struct {
+	Name string
+	// MaxDimension is the length of the thumbnail's longer side
+	MaxDimension int
+}
+
+// ThumbnailSizes are the thumbnails generated for images. Only sizes smaller than the
+// image itself are generated.
+var ThumbnailSizes = []ThumbnailSize{
+	{Name: "small", MaxDimension: 160},
+	{Name: "medium", MaxDimension: 480},
+	{Name: "large", MaxDimension: 1280},
+}
+
+// Thumbnail is a scaled down copy of an image
+type Thumbnail struct {
+	Name        string
+	Width       int
+	Height      int
+	ContentType string
+	Data        []byte
+}
+
+// ProcessedImage is the result of processing an image
+type ProcessedImage struct {
+	// Original is the image without metadata. It is nil if the image had none.
+	Original      []byte
+	Width         int
+	Height        int
+	Thumbnails    []Thumbnail
+	Blurhash      string
+	DominantColor string
+}
+
+// CanProcess reports whether images of a content type can be processed
+func CanProcess(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png" || contentType == "image/gif"
+}
+
+// ProcessImage strips the metadata of a JPEG, PNG or GIF image and generates its thumbnails
+// and placeholders. JPEGs rotated through EXIF are re-encoded upright, since their rotation
+// would be lost with the metadata.
+func ProcessImage(data []byte, contentType string) (*ProcessedImage, error) {
+	if !CanProcess(contentType) {
+		return nil, ErrUnsupportedImage
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := toRGBA(decoded)
+
+	result := &ProcessedImage{}
+
+	switch contentType {
+	case "image/jpeg":
+		if orientation := JPEGOrientation(data); orientation > 1 {
+			img = Orient(img, orientation)
+			// The encoder writes no metadata
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+				return nil, err
+			}
+			result.Original = buf.Bytes()
+		} else if result.Original, err = StripJPEGMetadata(data); err != nil {
+			return nil, err
+		}
+	case "image/png":
+		if result.Original, err = StripPNGMetadata(data); err != nil {
+			return nil, err
+		}
+	}
+	if result.Original != nil && bytes.Equal(result.Original, data) {
+		result.Original = nil
+	}
+
+	result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	for _, size := range ThumbnailSizes {
+		if result.Width <= size.MaxDimension && result.Height <= size.MaxDimension {
+			continue
+		}
+		thumbnail, err := encodeThumbnail(img, size, contentType)
+		if err != nil {
+			return nil, err
+		}
+		result.Thumbnails = append(result.Thumbnails, *thumbnail)
+	}
+
+	// Placeholders are computed from a tiny copy, which looks the same at that level of detail
+	pw, ph := fit(result.Width, result.Height, 32)
+	preview := Resize(img, pw, ph)
+	result.Blurhash = Blurhash(preview, 4, 3)
+	result.DominantColor = DominantColor(preview)
+
+	return result, nil
+}
+
+// encodeThumbnail scales an image down to a thumbnail size. Thumbnails of JPEGs are JPEGs,
+// thumbnails of other formats are PNGs to keep transparency.
+func encodeThumbnail(img *image.RGBA, size ThumbnailSize, contentType string) (*Thumbnail, error) {
+	width, height := fit(img.Bounds().Dx(), img.Bounds().Dy(), size.MaxDimension)
+	scaled := Resize(img, width, height)
+
+	thumbnail := &Thumbnail{Name: size.Name, Width: width, Height: height}
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		thumbnail.ContentType = "image/jpeg"
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, err
+		}
+	} else {
+		thumbnail.ContentType = "image/png"
+		if err := png.Encode(&buf, scaled); err != nil {
+			return nil, err
+		}
+	}
+	thumbnail.Data = buf.Bytes()
+
+	return thumbnail, nil
+}
@@ -0,0 +1,198 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// errMalformedImage is returned when an image's container structure cannot be parsed
+var errMalformedImage = errors.New("malformed image")
+
+// JPEG markers handled while stripping metadata
+const (
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerAPP1 = 0xE1 // EXIF (including GPS) and XMP
+	markerAPPD = 0xED // Photoshop and IPTC
+	markerCOM  = 0xFE
+)
+
+// StripJPEGMetadata removes EXIF, XMP, IPTC and comment segments from a JPEG without
+// re-encoding it. Other segments, such as the ICC colour profile, are kept. Anything after
+// the end of the image is dropped: phones append secondary images and depth maps there,
+// each with EXIF of its own.
+func StripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, errMalformedImage
+		}
+		// Skip fill bytes between segments
+		j := i + 1
+		for j < len(data) && data[j] == 0xFF {
+			j++
+		}
+		if j >= len(data) {
+			return nil, errMalformedImage
+		}
+		marker := data[j]
+
+		if marker == markerEOI {
+			out.Write(data[i : j+1])
+			return out.Bytes(), nil
+		}
+
+		// Markers without a payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[i : j+1])
+			i = j + 1
+			continue
+		}
+
+		if j+3 > len(data) {
+			return nil, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(data[j+1 : j+3]))
+		end := j + 1 + length
+		if length < 2 || end > len(data) {
+			return nil, errMalformedImage
+		}
+
+		if marker != markerAPP1 && marker != markerAPPD && marker != markerCOM {
+			out.Write(data[i:end])
+		}
+		i = end
+
+		// The entropy-coded data of a scan runs up to the next marker. Inside it 0xFF is
+		// followed by a zero byte or a restart marker.
+		if marker == markerSOS {
+			k := i
+			for ; k+1 < len(data); k++ {
+				if data[k] == 0xFF && data[k+1] != 0x00 && (data[k+1] < 0xD0 || data[k+1] > 0xD7) {
+					break
+				}
+			}
+			if k+1 >= len(data) {
+				return nil, errMalformedImage
+			}
+			out.Write(data[i:k])
+			i = k
+		}
+	}
+
+	return nil, errMalformedImage
+}
+
+// JPEGOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 if it has none
+func JPEGOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		if marker == markerAPP1 && length >= 8 && bytes.HasPrefix(data[i+4:end], []byte("Exif\x00\x00")) {
+			return exifOrientation(data[i+10 : end])
+		}
+		i = end
+	}
+
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of an EXIF TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// Orientation is tag 0x0112 of type SHORT
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 && order.Uint16(tiff[entry+2:entry+4]) == 3 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+
+	return 1
+}
+
+// strippedPNGChunks are the ancillary PNG chunks that carry metadata
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// StripPNGMetadata removes EXIF, text and timestamp chunks from a PNG without re-encoding it
+func StripPNGMetadata(data []byte) ([]byte, error) {
+	const signatureLength = 8
+	if len(data) < signatureLength || string(data[:signatureLength]) != "\x89PNG\r\n\x1a\n" {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:signatureLength])
+
+	i := signatureLength
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		// Chunks are a length, a type, the data and a CRC
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:i+4]))
+		if end > len(data) || end < i {
+			return nil, errMalformedImage
+		}
+
+		if !strippedPNGChunks[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
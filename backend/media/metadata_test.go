@@ -0,0 +1,277 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a small image with some detail in it
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 10), G: uint8(y * 15), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// encodeJPEG encodes the test image as a JPEG. The standard encoder writes no metadata.
+func encodeJPEG(t testing.TB) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// jpegSegment builds a JPEG segment with a payload
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// exifSegment builds an APP1 EXIF segment holding an orientation tag and a GPS marker string
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2A\x00\x00\x00\x08")
+	tiff = append(tiff, 0, 1) // One IFD entry
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "GPS 52.37N 4.89E"...)
+	return jpegSegment(markerAPP1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+// withSegments inserts segments right after the start of image marker of a JPEG
+func withSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	plain := encodeJPEG(t)
+
+	// A secondary image as phones append it after the primary one, with its own EXIF
+	secondary := withSegments(plain, exifSegment(1))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no metadata", plain},
+		{"exif", withSegments(plain, exifSegment(6))},
+		{"exif, xmp, iptc and comment", withSegments(plain,
+			exifSegment(1),
+			jpegSegment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")),
+			jpegSegment(markerAPPD, []byte("Photoshop 3.0\x00")),
+			jpegSegment(markerCOM, []byte("taken at home")),
+		)},
+		{"secondary image after the end", append(withSegments(plain, exifSegment(1)), secondary...)},
+		{"trailing garbage", append(append([]byte{}, plain...), "GPS 52.37N 4.89E"...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripped, err := StripJPEGMetadata(tt.data)
+			if err != nil {
+				t.Fatalf("StripJPEGMetadata() error = %v", err)
+			}
+			if !bytes.Equal(stripped, plain) {
+				t.Errorf("StripJPEGMetadata() returned %d bytes, want the %d bytes of the image without metadata", len(stripped), len(plain))
+			}
+			if bytes.Contains(stripped, []byte("GPS")) {
+				t.Error("StripJPEGMetadata() kept the location")
+			}
+		})
+	}
+}
+
+func TestStripJPEGMetadataKeepsOtherSegments(t *testing.T) {
+	icc := jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	data := withSegments(encodeJPEG(t), exifSegment(1), icc)
+
+	stripped, err := StripJPEGMetadata(data)
+	if err != nil {
+		t.Fatalf("StripJPEGMetadata() error = %v", err)
+	}
+	if !bytes.Contains(stripped, icc) {
+		t.Error("StripJPEGMetadata() dropped the colour profile")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image does not decode: %v", err)
+	}
+}
+
+func TestStripJPEGMetadataScans(t *testing.T) {
+	// A progressive JPEG as a sequence of segments: scans hold escaped 0xFF bytes and restart
+	// markers, and further tables and metadata may come between them
+	scan := []byte{0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD3, 0x56}
+	var data []byte
+	data = append(data, 0xFF, markerSOI)
+	data = append(data, jpegSegment(0xC2, []byte{8, 0, 1, 0, 1, 1, 1, 0x11, 0})...)
+	data = append(data, jpegSegment(markerSOS, []byte{1, 1, 0, 0, 63, 0})...)
+	data = append(data, scan...)
+	data = append(data, jpegSegment(0xC4, []byte{0x00, 1})...)
+	data = append(data, jpegSegment(markerCOM, []byte("between scans"))...)
+	data = append(data, jpegSegment(markerSOS, []byte{1, 1, 0, 1, 63, 0})...)
+	data = append(data, scan...)
+	data = append(data, 0xFF, 0xFF, markerEOI)
+	data = append(data, exifSegment(1)...)
+
+	stripped, err := StripJPEGMetadata(data)
+	if err != nil {
+		t.Fatalf("StripJPEGMetadata() error = %v", err)
+	}
+	if bytes.Contains(stripped, []byte("between scans")) || bytes.Contains(stripped, []byte("Exif")) {
+		t.Error("StripJPEGMetadata() kept metadata")
+	}
+	if bytes.Count(stripped, scan) != 2 {
+		t.Error("StripJPEGMetadata() changed the scans")
+	}
+	if !bytes.HasSuffix(stripped, []byte{0xFF, markerEOI}) {
+		t.Error("StripJPEGMetadata() output does not end with the end of the image")
+	}
+}
+
+func TestStripJPEGMetadataMalformed(t *testing.T) {
+	plain := encodeJPEG(t)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a jpeg", []byte("GIF89a")},
+		{"segment past the end", withSegments(plain, []byte{0xFF, markerAPP1, 0xFF, 0xFF})},
+		{"segment length 0", withSegments(plain, []byte{0xFF, markerAPP1, 0, 0})},
+		{"segment length 1", withSegments(plain, []byte{0xFF, markerAPP1, 0, 1})},
+		{"truncated scan", plain[:len(plain)-2]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := StripJPEGMetadata(tt.data); err == nil {
+				t.Error("StripJPEGMetadata() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := encodeJPEG(t)
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", plain, 1},
+		{"rotated", withSegments(plain, exifSegment(6)), 6},
+		{"out of range", withSegments(plain, exifSegment(9)), 1},
+		{"after other segments", withSegments(plain, jpegSegment(0xE0, []byte("JFIF\x00")), exifSegment(8)), 8},
+		{"segment length 0", withSegments(plain, []byte{0xFF, markerAPP1, 0, 0}), 1},
+		{"segment length 1", withSegments(plain, []byte{0xFF, markerAPP1, 0, 1}), 1},
+		{"short exif", withSegments(plain, jpegSegment(markerAPP1, []byte("Exif"))), 1},
+		{"truncated", withSegments(plain, exifSegment(6))[:12], 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JPEGOrientation(tt.data); got != tt.want {
+				t.Errorf("JPEGOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// pngChunk builds a PNG chunk with its CRC
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// Metadata chunks go between the header chunk and the image data
+	const headerEnd = 8 + 12 + 13
+	var data []byte
+	data = append(data, plain[:headerEnd]...)
+	data = append(data, pngChunk("eXIf", []byte("MM\x00\x2A GPS 52.37N 4.89E"))...)
+	data = append(data, pngChunk("tEXt", []byte("Comment\x00GPS 52.37N 4.89E"))...)
+	data = append(data, pngChunk("tIME", []byte{7, 0xE9, 10, 19, 9, 30, 0})...)
+	data = append(data, plain[headerEnd:]...)
+
+	stripped, err := StripPNGMetadata(data)
+	if err != nil {
+		t.Fatalf("StripPNGMetadata() error = %v", err)
+	}
+	if !bytes.Equal(stripped, plain) {
+		t.Errorf("StripPNGMetadata() returned %d bytes, want the %d bytes of the image without metadata", len(stripped), len(plain))
+	}
+
+	for name, malformed := range map[string][]byte{
+		"not a png":       []byte("\x89PNX\r\n\x1a\n"),
+		"truncated chunk": plain[:len(plain)-4],
+		"huge length":     append(append([]byte{}, plain[:8]...), 0xFF, 0xFF, 0xFF, 0xFF, 'I', 'H', 'D', 'R'),
+	} {
+		if _, err := StripPNGMetadata(malformed); err == nil {
+			t.Errorf("StripPNGMetadata(%s) succeeded, want an error", name)
+		}
+	}
+}
+
+func FuzzStripJPEGMetadata(f *testing.F) {
+	plain := encodeJPEG(f)
+	f.Add(plain)
+	f.Add(withSegments(plain, exifSegment(6)))
+	f.Add([]byte{0xFF, markerSOI, 0xFF, markerAPP1, 0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stripped, err := StripJPEGMetadata(data)
+		JPEGOrientation(data)
+		if err != nil {
+			return
+		}
+		if len(stripped) > len(data) || !bytes.HasSuffix(stripped, []byte{0xFF, markerEOI}) {
+			t.Errorf("StripJPEGMetadata() returned %d bytes not ending the image", len(stripped))
+		}
+	})
+}
+
+func FuzzStripPNGMetadata(f *testing.F) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stripped, err := StripPNGMetadata(data)
+		if err == nil && len(stripped) > len(data) {
+			t.Errorf("StripPNGMetadata() grew the image from %d to %d bytes", len(data), len(stripped))
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UnattachedAttachmentTTL is how long an uploaded attachment waits to be sent in a message before it is deleted
+const UnattachedAttachmentTTL = 24 * time.Hour
+
+// AttachmentStatus represents how far an uploaded attachment has been processed
+type AttachmentStatus string
+
+const (
+	// AttachmentPending attachments wait for processing, e.g. thumbnail generation for images
+	AttachmentPending AttachmentStatus = "pending"
+	// AttachmentProcessing attachments are being processed
+	AttachmentProcessing AttachmentStatus = "processing"
+	// AttachmentReady attachments can be downloaded by everyone in the chat they were sent to
+	AttachmentReady AttachmentStatus = "ready"
+	// AttachmentFailed attachments could not be processed and are only available to their uploader
+	AttachmentFailed AttachmentStatus = "failed"
+	// AttachmentQuarantined attachments contain malware and cannot be downloaded by anyone
+	AttachmentQuarantined AttachmentStatus = "quarantined"
+)
+
+// ScanStatus represents the outcome of the malware scan of an attachment
+type ScanStatus string
+
+const (
+	// ScanClean attachments were scanned and no malware was found
+	ScanClean ScanStatus = "clean"
+	// ScanInfected attachments were scanned and contain malware
+	ScanInfected ScanStatus = "infected"
+	// ScanFailed attachments could not be scanned, e.g. because the scanner was unavailable
+	ScanFailed ScanStatus = "failed"
+)
+
+// AttachmentThumbnail is a scaled down copy of an image attachment
+type AttachmentThumbnail struct {
+	Name        string `json:"name"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	StorageKey  string `json:"-"`
+}
+
+// Attachment represents an uploaded file. It is uploaded first and then sent by
+// referencing its ID in the metadata of an image or file message.
+type Attachment struct {
+	ID            string                `json:"id" gorm:"primaryKey"`
+	UploaderID    string                `json:"uploader_id" gorm:"index;not null"`
+	MessageID     *string               `json:"message_id" gorm:"index"`
+	StorageKey    string                `json:"-" gorm:"not null"`
+	FileName      string                `json:"file_name" gorm:"not null"`
+	ContentType   string                `json:"content_type" gorm:"not null"`
+	Size          int64                 `json:"size" gorm:"not null"`
+	Checksum      string                `json:"checksum" gorm:"not null"`
+	Status        AttachmentStatus      `json:"status" gorm:"index;default:'ready'"`
+	Width         *int                  `json:"width,omitempty"`
+	Height        *int                  `json:"height,omitempty"`
+	Blurhash      string                `json:"blurhash,omitempty"`
+	DominantColor string                `json:"dominant_color,omitempty"`
+	Thumbnails    []AttachmentThumbnail `json:"thumbnails,omitempty" gorm:"type:jsonb;serializer:json"`
+	Duration      *float64              `json:"duration,omitempty"`
+	Waveform      []int                 `json:"waveform,omitempty" gorm:"type:jsonb;serializer:json"`
+	ScanStatus    ScanStatus            `json:"scan_status,omitempty"`
+	ScanSignature string                `json:"scan_signature,omitempty"`
+	ScanAttempts  int                   `json:"-" gorm:"default:0"`
+	ScannedAt     *time.Time            `json:"scanned_at,omitempty"`
+	ClaimedAt     *time.Time            `json:"-"`
+	DetachedAt    *time.Time            `json:"-" gorm:"index"`
+	CreatedAt     time.Time             `json:"created_at"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+}
+
+// DownloadPath is the API path the attachment is downloaded from
+func (a *Attachment) DownloadPath() string {
+	return "/api/attachments/" + a.ID + "/download"
+}
+
+// StorageKeys returns the keys of all stored files of the attachment, including thumbnails
+func (a *Attachment) StorageKeys() []string {
+	keys := []string{a.StorageKey}
+	for _, thumbnail := range a.Thumbnails {
+		keys = append(keys, thumbnail.StorageKey)
+	}
+	return keys
+}
+
+// Thumbnail returns the thumbnail with the given name, or nil if the attachment has none
+func (a *Attachment) Thumbnail(name string) *AttachmentThumbnail {
+	for i := range a.Thumbnails {
+		if a.Thumbnails[i].Name == name {
+			return &a.Thumbnails[i]
+		}
+	}
+	return nil
+}
+
+// ApplyToMetadata fills the metadata of a message sent with the attachment with the
+// attachment's details, so clients cannot misreport them. It returns a new map.
+func (a *Attachment) ApplyToMetadata(metadata MessageMetadata, messageType MessageType) MessageMetadata {
+	result := metadata.Clone()
+
+	result["size"] = float64(a.Size)
+	result["mime_type"] = a.ContentType
+	if messageType == FileMessage {
+		result["name"] = a.FileName
+	}
+
+	// Quarantined files cannot be downloaded, so clients show a placeholder instead
+	if a.Status == AttachmentQuarantined {
+		delete(result, "url")
+		delete(result, "thumbnails")
+		result["quarantined"] = true
+		return result
+	}
+	result["url"] = a.DownloadPath()
+
+	// Details extracted while processing images
+	if a.Width != nil && a.Height != nil {
+		result["width"] = float64(*a.Width)
+		result["height"] = float64(*a.Height)
+	}
+	if a.Blurhash != "" {
+		result["blurhash"] = a.Blurhash
+	}
+	if a.DominantColor != "" {
+		result["dominant_color"] = a.DominantColor
+	}
+	// Details extracted while processing audio
+	if a.Duration != nil {
+		result["duration"] = *a.Duration
+	}
+	if len(a.Waveform) > 0 {
+		result["waveform"] = a.Waveform
+	}
+	if len(a.Thumbnails) > 0 {
+		thumbnails := map[string]interface{}{}
+		for _, thumbnail := range a.Thumbnails {
+			thumbnails[thumbnail.Name] = map[string]interface{}{
+				"url":    a.DownloadPath() + "?size=" + thumbnail.Name,
+				"width":  float64(thumbnail.Width),
+				"height": float64(thumbnail.Height),
+			}
+		}
+		result["thumbnails"] = thumbnails
+	}
+
+	return result
+}
+
+// ClaimAttachment links an attachment of the uploader to a message. An attachment can only be
+// claimed once, and not after the message it was sent in was deleted. It reports whether the
+// attachment was claimed.
+func ClaimAttachment(db *gorm.DB, attachmentID, uploaderID, messageID string) (bool, error) {
+	result := db.Model(&Attachment{}).
+		Where("id = ? AND uploader_id = ? AND message_id IS NULL AND detached_at IS NULL", attachmentID, uploaderID).
+		Updates(map[string]interface{}{"message_id": messageID, "updated_at": time.Now()})
+	return result.RowsAffected == 1, result.Error
+}
+
+// DetachGroupAttachments detaches the attachments of all messages of a group so they get deleted
+func DetachGroupAttachments(db *gorm.DB, groupID string) error {
+	return detachAttachments(db, db.Model(&Message{}).Select("id").Where("group_id = ?", groupID))
+}
+
+// detachAttachments detaches the attachments of the messages selected by a subquery of message IDs
+func detachAttachments(db *gorm.DB, messageIDs interface{}) error {
+	now := time.Now()
+	return db.Model(&Attachment{}).
+		Where("message_id IN (?)", messageIDs).
+		Updates(map[string]interface{}{"message_id": nil, "detached_at": now, "updated_at": now}).Error
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// AvatarSizes are the names of the sizes every avatar is stored in
+var AvatarSizes = []string{"small", "medium", "large"}
+
+// DefaultAvatarSize is the size linked by the avatar_url field
+const DefaultAvatarSize = "medium"
+
+// SignAvatarURL returns a URL for the stored avatar file with the given key.
+// It is set at startup; without it avatars have no URLs.
+var SignAvatarURL func(key string) string
+
+// AvatarFileKey returns the storage key of one size of an avatar
+func AvatarFileKey(avatarKey, size string) string {
+	return avatarKey + "-" + size + ".jpg"
+}
+
+// avatarURLs returns the URL of the default size and the URLs of all sizes of an avatar
+func avatarURLs(avatarKey *string) (*string, map[string]string) {
+	if avatarKey == nil || SignAvatarURL == nil {
+		return nil, nil
+	}
+
+	urls := make(map[string]string, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		urls[size] = SignAvatarURL(AvatarFileKey(*avatarKey, size))
+	}
+	defaultURL := urls[DefaultAvatarSize]
+	return &defaultURL, urls
+}
+
+// AfterFind fills in the avatar URLs of a user
+func (u *User) AfterFind(tx *gorm.DB) error {
+	u.AvatarURL, u.AvatarURLs = avatarURLs(u.AvatarKey)
+	return nil
+}
+
+// AfterFind fills in the avatar URLs of a group
+func (g *Group) AfterFind(tx *gorm.DB) error {
+	g.AvatarURL, g.AvatarURLs = avatarURLs(g.AvatarKey)
+	return nil
+}
+
+// IsCurrentAvatarURL reports whether a URL links to the avatar with the given key, or is empty
+// when there is none, so clients sending back the avatar_url they read are not changing it.
+// The signatures of the URLs are not compared since avatar links are signed anew when read.
+func IsCurrentAvatarURL(avatarKey *string, url string) bool {
+	_, urls := avatarURLs(avatarKey)
+	if len(urls) == 0 {
+		return url == ""
+	}
+
+	for _, current := range urls {
+		if withoutQuery(current) == withoutQuery(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutQuery returns a URL without its query string
+func withoutQuery(url string) string {
+	path, _, _ := strings.Cut(url, "?")
+	return path
+}
+
+// MigrateAvatars drops the avatar_url columns of users and groups. They held links chosen by
+// clients, which are not shown anymore now that avatars are uploaded, so they are cleared
+// rather than carried over.
+func MigrateAvatars(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&User{}, &Group{}} {
+			if tx.Migrator().HasColumn(model, "avatar_url") {
+				if err := tx.Migrator().DropColumn(model, "avatar_url"); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TombstoneRetention is how long deleted message tombstones are kept for syncing clients
+const TombstoneRetention = 30 * 24 * time.Hour
+
+// DeleteMessages deletes messages together with everything that references them,
+// leaving a tombstone behind for each deleted message
+func DeleteMessages(db *gorm.DB, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var messages []Message
+		if err := tx.Where("id IN ?", messageIDs).Find(&messages).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		tombstones := make([]MessageTombstone, len(messages))
+		for i, message := range messages {
+			tombstones[i] = MessageTombstone{
+				MessageID:      message.ID,
+				SenderID:       message.SenderID,
+				ReceiverID:     message.ReceiverID,
+				GroupID:        message.GroupID,
+				ConversationID: message.ConversationID,
+				Seq:            message.Seq,
+				DeletedAt:      now,
+			}
+		}
+		if len(tombstones) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&tombstones).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("message_id IN ?", messageIDs).Delete(&PinnedMessage{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("message_id IN ?", messageIDs).Delete(&SavedMessage{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("message_id IN ?", messageIDs).Delete(&Mention{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("message_id IN ?", messageIDs).Delete(&PlayedState{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("message_id IN ?", messageIDs).Delete(&LiveLocation{}).Error; err != nil {
+			return err
+		}
+
+		if err := detachAttachments(tx, messageIDs); err != nil {
+			return err
+		}
+
+		if err := deletePolls(tx, tx.Model(&Poll{}).Select("id").Where("message_id IN ?", messageIDs)); err != nil {
+			return err
+		}
+
+		if err := tx.Where("id IN ?", messageIDs).Delete(&Message{}).Error; err != nil {
+			return err
+		}
+
+		// Conversations whose last message was deleted point at the new latest one
+		var conversationIDs []string
+		for _, message := range messages {
+			if message.ConversationID != nil {
+				conversationIDs = append(conversationIDs, *message.ConversationID)
+			}
+		}
+		return refreshLastMessages(tx, conversationIDs)
+	})
+}
+
+// DeleteGroupPolls deletes all polls of a group with their options and votes
+func DeleteGroupPolls(db *gorm.DB, groupID string) error {
+	return deletePolls(db, db.Model(&Poll{}).Select("id").Where("group_id = ?", groupID))
+}
+
+// deletePolls deletes the polls selected by a subquery of poll IDs with their options and votes
+func deletePolls(db *gorm.DB, pollIDs *gorm.DB) error {
+	if err := db.Where("poll_id IN (?)", pollIDs).Delete(&PollVote{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("poll_id IN (?)", pollIDs).Delete(&PollOption{}).Error; err != nil {
+		return err
+	}
+	return db.Where("id IN (?)", pollIDs).Delete(&Poll{}).Error
+}
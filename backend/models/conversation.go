@@ -0,0 +1,265 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ConversationType represents the kind of a conversation
+type ConversationType string
+
+const (
+	DirectConversation ConversationType = "direct"
+	GroupConversation  ConversationType = "group"
+)
+
+// Conversation represents a direct chat between two users or a group chat.
+// Key is the chat key of the conversation (see DirectChatKey and GroupChatKey).
+// LastSeq is the sequence number of the latest message; messages are numbered 1, 2, 3, ...
+type Conversation struct {
+	ID            string           `json:"id" gorm:"primaryKey"`
+	Type          ConversationType `json:"type" gorm:"not null"`
+	Key           string           `json:"key" gorm:"uniqueIndex;not null"`
+	GroupID       *string          `json:"group_id" gorm:"uniqueIndex"`
+	LastMessageID *string          `json:"last_message_id"`
+	LastMessageAt *time.Time       `json:"last_message_at" gorm:"index"`
+	LastSeq       int64            `json:"last_seq" gorm:"not null;default:0"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+
+	// Relations
+	Participants []ConversationParticipant `json:"participants,omitempty" gorm:"foreignKey:ConversationID"`
+	LastMessage  *Message                  `json:"last_message,omitempty" gorm:"foreignKey:LastMessageID;constraint:OnDelete:SET NULL"`
+	Group        *Group                    `json:"group,omitempty" gorm:"foreignKey:GroupID"`
+}
+
+// ConversationParticipant represents a user taking part in a conversation.
+// Per-participant settings are stored as the participant's ChatPreference for the conversation key.
+type ConversationParticipant struct {
+	ConversationID string    `json:"conversation_id" gorm:"primaryKey"`
+	UserID         string    `json:"user_id" gorm:"primaryKey;index"`
+	JoinedAt       time.Time `json:"joined_at"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+
+	// Relations
+	User User `json:"user" gorm:"foreignKey:UserID"`
+}
+
+// EnsureDirectConversation gets or creates the direct conversation between two users
+func EnsureDirectConversation(db *gorm.DB, userID, otherUserID string) (*Conversation, error) {
+	conversation, created, err := ensureConversation(db, DirectConversation, DirectChatKey(userID, otherUserID), nil)
+	if err != nil || !created {
+		return conversation, err
+	}
+
+	now := time.Now()
+	participants := []ConversationParticipant{
+		{ConversationID: conversation.ID, UserID: userID, JoinedAt: now, CreatedAt: now, UpdatedAt: now},
+	}
+	if otherUserID != userID {
+		participants = append(participants, ConversationParticipant{
+			ConversationID: conversation.ID, UserID: otherUserID, JoinedAt: now, CreatedAt: now, UpdatedAt: now,
+		})
+	}
+
+	err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&participants).Error
+	return conversation, err
+}
+
+// EnsureGroupConversation gets or creates the conversation of a group.
+// A new conversation starts out with all current members of the group.
+func EnsureGroupConversation(db *gorm.DB, groupID string) (*Conversation, error) {
+	conversation, created, err := ensureConversation(db, GroupConversation, GroupChatKey(groupID), &groupID)
+	if err != nil || !created {
+		return conversation, err
+	}
+
+	err = db.Exec(`
+		INSERT INTO conversation_participants (conversation_id, user_id, joined_at, created_at, updated_at)
+		SELECT ?, user_id, joined_at, NOW(), NOW() FROM group_users WHERE group_id = ?
+		ON CONFLICT DO NOTHING`, conversation.ID, groupID).Error
+	return conversation, err
+}
+
+// AddConversationParticipant adds a user to a group's conversation
+func AddConversationParticipant(db *gorm.DB, groupID, userID string) error {
+	conversation, err := EnsureGroupConversation(db, groupID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	participant := ConversationParticipant{
+		ConversationID: conversation.ID,
+		UserID:         userID,
+		JoinedAt:       now,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&participant).Error
+}
+
+// RemoveConversationParticipant removes a user from a group's conversation
+func RemoveConversationParticipant(db *gorm.DB, groupID, userID string) error {
+	return db.Where("user_id = ? AND conversation_id IN (?)", userID,
+		db.Model(&Conversation{}).Select("id").Where("group_id = ?", groupID),
+	).Delete(&ConversationParticipant{}).Error
+}
+
+// LockConversation locks the conversation with the given key until the end of the transaction,
+// so checks on the chat and the writes that depend on them are not interleaved
+func LockConversation(tx *gorm.DB, key string) error {
+	var ids []string
+	return tx.Model(&Conversation{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("key = ?", key).Pluck("id", &ids).Error
+}
+
+// ensureConversation gets the conversation with the given key, creating it if needed.
+// It reports whether the conversation was created by this call.
+func ensureConversation(db *gorm.DB, conversationType ConversationType, key string, groupID *string) (*Conversation, bool, error) {
+	var existing Conversation
+	result := db.Where("key = ?", key).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return &existing, false, nil
+	}
+
+	now := time.Now()
+	conversation := Conversation{
+		ID:        uuid.New().String(),
+		Type:      conversationType,
+		Key:       key,
+		GroupID:   groupID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	// Another request may have created the conversation in the meantime
+	result = db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "key"}}, DoNothing: true}).Create(&conversation)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return &conversation, true, nil
+	}
+
+	if err := db.Where("key = ?", key).First(&existing).Error; err != nil {
+		return nil, false, err
+	}
+	return &existing, false, nil
+}
+
+// refreshLastMessages recomputes the last message pointer of conversations
+func refreshLastMessages(db *gorm.DB, conversationIDs []string) error {
+	if len(conversationIDs) == 0 {
+		return nil
+	}
+
+	return db.Exec(`
+		UPDATE conversations c
+		SET last_message_id = (
+				SELECT id FROM messages WHERE conversation_id = c.id ORDER BY seq DESC LIMIT 1
+			),
+			last_message_at = (
+				SELECT timestamp FROM messages WHERE conversation_id = c.id ORDER BY seq DESC LIMIT 1
+			)
+		WHERE c.id IN ?`, conversationIDs).Error
+}
+
+// MigrateConversations creates conversations for messages stored before conversations
+// existed, links those messages to them and numbers messages and read pointers stored
+// before sequence numbers existed. It is safe to run on every start.
+func MigrateConversations(db *gorm.DB) error {
+	directKey := `'direct:' || LEAST(m.sender_id COLLATE "C", m.receiver_id COLLATE "C") || ':' ||
+		GREATEST(m.sender_id COLLATE "C", m.receiver_id COLLATE "C")`
+
+	statements := []string{
+		// Group conversations with their members
+		`INSERT INTO conversations (id, type, key, group_id, created_at, updated_at)
+		SELECT gen_random_uuid()::text, 'group', 'group:' || g.id, g.id, g.created_at, NOW()
+		FROM groups g
+		ON CONFLICT DO NOTHING`,
+		`INSERT INTO conversation_participants (conversation_id, user_id, joined_at, created_at, updated_at)
+		SELECT c.id, gu.user_id, gu.joined_at, NOW(), NOW()
+		FROM group_users gu JOIN conversations c ON c.group_id = gu.group_id
+		ON CONFLICT DO NOTHING`,
+
+		// Direct conversations with both participants
+		`INSERT INTO conversations (id, type, key, created_at, updated_at)
+		SELECT gen_random_uuid()::text, 'direct', k.key, k.first_at, NOW()
+		FROM (
+			SELECT ` + directKey + ` AS key, MIN(m.timestamp) AS first_at
+			FROM messages m
+			WHERE m.receiver_id IS NOT NULL AND m.conversation_id IS NULL
+			GROUP BY 1
+		) k
+		ON CONFLICT DO NOTHING`,
+		`INSERT INTO conversation_participants (conversation_id, user_id, joined_at, created_at, updated_at)
+		SELECT c.id, p.user_id, c.created_at, NOW(), NOW()
+		FROM conversations c
+		CROSS JOIN LATERAL (VALUES (split_part(c.key, ':', 2)), (split_part(c.key, ':', 3))) AS p(user_id)
+		WHERE c.type = 'direct'
+		ON CONFLICT DO NOTHING`,
+
+		// Link messages to their conversations
+		`UPDATE messages m SET conversation_id = c.id
+		FROM conversations c
+		WHERE m.conversation_id IS NULL AND m.group_id IS NOT NULL AND c.group_id = m.group_id`,
+		`UPDATE messages m SET conversation_id = c.id
+		FROM conversations c
+		WHERE m.conversation_id IS NULL AND m.receiver_id IS NOT NULL AND c.key = ` + directKey,
+
+		// Number messages in the order they were sent, after any numbered ones
+		`UPDATE messages m SET seq = n.seq
+		FROM (
+			SELECT m2.id, c.last_seq + ROW_NUMBER() OVER (PARTITION BY m2.conversation_id ORDER BY m2.timestamp, m2.id) AS seq
+			FROM messages m2 JOIN conversations c ON c.id = m2.conversation_id
+			WHERE m2.seq = 0
+		) n
+		WHERE m.id = n.id`,
+		`UPDATE conversations c SET last_seq = s.max_seq
+		FROM (
+			SELECT conversation_id, MAX(seq) AS max_seq FROM messages
+			WHERE conversation_id IS NOT NULL
+			GROUP BY conversation_id
+		) s
+		WHERE s.conversation_id = c.id AND c.last_seq < s.max_seq`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_conversation_seq ON messages (conversation_id, seq)`,
+
+		// Number read pointers stored before sequence numbers existed, by the newest message at or
+		// before them, as the message they point at may have disappeared since
+		`UPDATE read_states rs SET last_read_seq = COALESCE((
+			SELECT MAX(m.seq) FROM messages m JOIN conversations c ON c.id = m.conversation_id
+			WHERE c.key = rs.chat_key
+				AND (m.timestamp, m.id) <= (rs.last_read_timestamp, rs.last_read_message_id)
+		), 0)
+		WHERE rs.last_read_seq = 0`,
+
+		// Point conversations at their latest message
+		`UPDATE conversations c
+		SET last_message_id = lm.id, last_message_at = lm.timestamp
+		FROM (
+			SELECT DISTINCT ON (conversation_id) conversation_id, id, timestamp
+			FROM messages
+			WHERE conversation_id IS NOT NULL
+			ORDER BY conversation_id, seq DESC
+		) lm
+		WHERE lm.conversation_id = c.id AND c.last_message_id IS NULL`,
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(strings.TrimSpace(statement)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GroupTombstone records that a user lost access to a group, because they were removed or the
+// group was deleted, so reconnecting clients can drop the group
+type GroupTombstone struct {
+	GroupID    string    `json:"group_id" gorm:"primaryKey"`
+	UserID     string    `json:"user_id" gorm:"primaryKey;index"`
+	DeletedAt  time.Time `json:"deleted_at" gorm:"index"`
+	ChangeTxID int64     `json:"-" gorm:"index;not null;default:0"`
+}
+
+// scheduledCancelledError is recorded on scheduled messages cancelled because their group is gone
+const scheduledCancelledError = "No longer a member of the group"
+
+// RemoveGroupMember removes a user from a group together with their state in it. The
+// messages of the live locations the user stopped sharing are returned.
+func RemoveGroupMember(db *gorm.DB, groupID, userID string) ([]Message, error) {
+	var ended []Message
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		chatKey := GroupChatKey(groupID)
+		messageIDs := tx.Model(&Message{}).Select("id").Where("group_id = ?", groupID)
+
+		if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&GroupUser{}).Error; err != nil {
+			return err
+		}
+
+		if err := RemoveConversationParticipant(tx, groupID, userID); err != nil {
+			return err
+		}
+
+		// The user can no longer see the group's messages, so drop them from their saved messages
+		if err := tx.Where("user_id = ? AND message_id IN (?)", userID, messageIDs).Delete(&SavedMessage{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&Mention{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("chat_key = ? AND user_id = ?", chatKey, userID).Delete(&ReadState{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("chat_key = ? AND user_id = ?", chatKey, userID).Delete(&ChatPreference{}).Error; err != nil {
+			return err
+		}
+
+		if err := cancelGroupScheduledMessages(tx, groupID, userID, now); err != nil {
+			return err
+		}
+
+		// The group must not keep following a user who left it
+		var err error
+		ended, err = EndGroupMemberLiveLocations(tx, groupID, userID)
+		if err != nil {
+			return err
+		}
+
+		return createGroupTombstones(tx, []GroupTombstone{{GroupID: groupID, UserID: userID, DeletedAt: now}})
+	})
+	return ended, err
+}
+
+// DeleteGroup deletes a group together with its messages and everything that references them.
+// Every member is left a tombstone.
+func DeleteGroup(db *gorm.DB, groupID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		chatKey := GroupChatKey(groupID)
+		messageIDs := tx.Model(&Message{}).Select("id").Where("group_id = ?", groupID)
+
+		var members []GroupUser
+		if err := tx.Where("group_id = ?", groupID).Find(&members).Error; err != nil {
+			return err
+		}
+		tombstones := make([]GroupTombstone, len(members))
+		for i, member := range members {
+			tombstones[i] = GroupTombstone{GroupID: groupID, UserID: member.UserID, DeletedAt: now}
+		}
+		if err := createGroupTombstones(tx, tombstones); err != nil {
+			return err
+		}
+
+		if err := cancelGroupScheduledMessages(tx, groupID, "", now); err != nil {
+			return err
+		}
+
+		if err := tx.Where("group_id = ?", groupID).Delete(&GroupUser{}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&PinnedMessage{}, &RetentionSetting{}, &ReadState{}, &ChatPreference{}} {
+			if err := tx.Where("chat_key = ?", chatKey).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("group_id = ?", groupID).Delete(&GroupStoragePolicy{}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&SavedMessage{}, &PlayedState{}, &LiveLocation{}} {
+			if err := tx.Where("message_id IN (?)", messageIDs).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("group_id = ?", groupID).Delete(&Mention{}).Error; err != nil {
+			return err
+		}
+
+		// Detach the attachments of group messages so their files get deleted
+		if err := DetachGroupAttachments(tx, groupID); err != nil {
+			return err
+		}
+
+		if err := DeleteGroupPolls(tx, groupID); err != nil {
+			return err
+		}
+
+		if err := tx.Where("group_id = ?", groupID).Delete(&Message{}).Error; err != nil {
+			return err
+		}
+
+		conversationIDs := tx.Model(&Conversation{}).Select("id").Where("group_id = ?", groupID)
+		if err := tx.Where("conversation_id IN (?)", conversationIDs).Delete(&ConversationParticipant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", groupID).Delete(&Conversation{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("id = ?", groupID).Delete(&Group{}).Error
+	})
+}
+
+// cancelGroupScheduledMessages cancels the pending scheduled messages to a group, only those of
+// one sender unless senderID is empty. Messages already being sent fail on their own once the
+// sender is no longer a member.
+func cancelGroupScheduledMessages(db *gorm.DB, groupID, senderID string, at time.Time) error {
+	query := db.Model(&ScheduledMessage{}).Where("group_id = ? AND status = ?", groupID, ScheduledPending)
+	if senderID != "" {
+		query = query.Where("sender_id = ?", senderID)
+	}
+	return query.Updates(map[string]interface{}{"status": ScheduledCancelled, "error": scheduledCancelledError, "updated_at": at}).Error
+}
+
+// createGroupTombstones records that users lost access to a group, replacing earlier tombstones
+// of users who were added back since
+func createGroupTombstones(db *gorm.DB, tombstones []GroupTombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"deleted_at"}),
+	}).Create(&tombstones).Error
+}
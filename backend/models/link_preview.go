@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+const (
+	// LinkPreviewTTL is how long the preview of a page is cached
+	LinkPreviewTTL = 24 * time.Hour
+
+	// FailedLinkPreviewTTL is how long a page without a preview is not fetched again
+	FailedLinkPreviewTTL = time.Hour
+)
+
+// LinkPreview is the cached preview of a web page linked in messages. Pages that could not
+// be fetched or have no preview are cached as failed, so they are not fetched for every message.
+type LinkPreview struct {
+	URL         string    `json:"url" gorm:"primaryKey"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	ImageURL    string    `json:"image_url,omitempty"`
+	SiteName    string    `json:"site_name,omitempty"`
+	Failed      bool      `json:"-" gorm:"default:false"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	ExpiresAt   time.Time `json:"-" gorm:"index"`
+}
+
+// PendingLinkPreview is a message waiting for the preview of the link in it. It is kept until
+// the preview is attached, so messages queued when the server stopped are previewed after a restart.
+type PendingLinkPreview struct {
+	MessageID string    `json:"message_id" gorm:"primaryKey"`
+	Link      string    `json:"link" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+// Metadata returns the preview as it is attached to the metadata of messages
+func (p *LinkPreview) Metadata() map[string]interface{} {
+	metadata := map[string]interface{}{"url": p.URL}
+	if p.Title != "" {
+		metadata["title"] = p.Title
+	}
+	if p.Description != "" {
+		metadata["description"] = p.Description
+	}
+	if p.ImageURL != "" {
+		metadata["image_url"] = p.ImageURL
+	}
+	if p.SiteName != "" {
+		metadata["site_name"] = p.SiteName
+	}
+	return metadata
+}
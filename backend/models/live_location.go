@@ -0,0 +1,168 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxLiveLocationPeriod is the longest a location can be shared live, in seconds
+const MaxLiveLocationPeriod = 8 * 60 * 60
+
+// ErrLiveLocationEnded is returned when updating a live location whose sharing has ended
+var ErrLiveLocationEnded = errors.New("live location sharing has ended")
+
+// LiveLocation is a location message whose sender is sharing their position live until it
+// expires. Only the latest position is kept, in the metadata of the message.
+type LiveLocation struct {
+	MessageID string    `json:"message_id" gorm:"primaryKey"`
+	SenderID  string    `json:"sender_id" gorm:"index;not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index;not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// LiveLocationUpdateSchema describes the position updates of live locations
+var LiveLocationUpdateSchema = MetadataSchema{
+	"latitude":  {Kind: NumberField, Required: true, Min: bound(-90), Max: bound(90)},
+	"longitude": {Kind: NumberField, Required: true, Min: bound(-180), Max: bound(180)},
+	"accuracy":  {Kind: NumberField, Min: bound(0)},
+	"heading":   {Kind: NumberField, Min: bound(0), Max: bound(360)},
+}
+
+// StartLiveLocation starts sharing the location of a message sent with a live period, and
+// records in the message until when. It is called before the message is saved.
+func StartLiveLocation(tx *gorm.DB, message *Message) error {
+	period, ok := message.Metadata["live_period"].(float64)
+	if message.Type != LocationMessage || !ok {
+		return nil
+	}
+
+	expiresAt := message.Timestamp.Add(time.Duration(period) * time.Second)
+	metadata := message.Metadata.Clone()
+	metadata["live"] = true
+	metadata["live_until"] = expiresAt.UTC().Format(time.RFC3339)
+	message.Metadata = metadata
+
+	return tx.Create(&LiveLocation{
+		MessageID: message.ID,
+		SenderID:  message.SenderID,
+		ExpiresAt: expiresAt,
+		CreatedAt: message.Timestamp,
+		UpdatedAt: message.Timestamp,
+	}).Error
+}
+
+// UpdateLiveLocation replaces the position of a live location message with a position
+// matching LiveLocationUpdateSchema, and returns the updated message
+func UpdateLiveLocation(db *gorm.DB, messageID string, position MessageMetadata) (*Message, error) {
+	var message Message
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		// Locking the live location orders concurrent updates and keeps it from ending meanwhile
+		var live LiveLocation
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("message_id = ? AND expires_at > ?", messageID, now).
+			Limit(1).
+			Find(&live)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLiveLocationEnded
+		}
+
+		if err := tx.First(&message, "id = ?", messageID).Error; err != nil {
+			return err
+		}
+
+		metadata := message.Metadata.Clone()
+		for name := range LiveLocationUpdateSchema {
+			delete(metadata, name)
+			if value, ok := position[name]; ok && value != nil {
+				metadata[name] = value
+			}
+		}
+		metadata["live_updated_at"] = now.UTC().Format(time.RFC3339)
+		message.Metadata = metadata
+		message.UpdatedAt = now
+
+		if err := tx.Model(&live).Update("updated_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&message).Select("metadata", "updated_at").Updates(&message).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// EndLiveLocation stops sharing a live location, marking its message as no longer live.
+// It returns nil if the sharing had already ended.
+func EndLiveLocation(db *gorm.DB, messageID string) (*Message, error) {
+	var ended *Message
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		ended, err = endLiveLocation(tx, messageID)
+		return err
+	})
+	return ended, err
+}
+
+// EndGroupMemberLiveLocations stops the live locations a member is sharing in a group, and
+// returns their messages
+func EndGroupMemberLiveLocations(tx *gorm.DB, groupID, userID string) ([]Message, error) {
+	var messageIDs []string
+	err := tx.Model(&LiveLocation{}).
+		Where("sender_id = ? AND message_id IN (?)", userID, tx.Model(&Message{}).Select("id").Where("group_id = ?", groupID)).
+		Pluck("message_id", &messageIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var ended []Message
+	for _, messageID := range messageIDs {
+		message, err := endLiveLocation(tx, messageID)
+		if err != nil {
+			return nil, err
+		}
+		if message != nil {
+			ended = append(ended, *message)
+		}
+	}
+	return ended, nil
+}
+
+// endLiveLocation stops sharing a live location in a transaction
+func endLiveLocation(tx *gorm.DB, messageID string) (*Message, error) {
+	result := tx.Where("message_id = ?", messageID).Delete(&LiveLocation{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	var message Message
+	if err := tx.Where("id = ?", messageID).Limit(1).Find(&message).Error; err != nil || message.ID == "" {
+		return nil, err
+	}
+
+	// Sharing stopped early ends now
+	now := time.Now()
+	metadata := message.Metadata.Clone()
+	metadata["live"] = false
+	if until, ok := metadata["live_until"].(string); ok {
+		if expiresAt, err := time.Parse(time.RFC3339, until); err == nil && now.Before(expiresAt) {
+			metadata["live_until"] = now.UTC().Format(time.RFC3339)
+		}
+	}
+	message.Metadata = metadata
+	message.UpdatedAt = now
+
+	if err := tx.Model(&message).Select("metadata", "updated_at").Updates(&message).Error; err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
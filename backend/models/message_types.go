@@ -0,0 +1,225 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxContentLength is the maximum length of message content in characters
+const MaxContentLength = 4000
+
+// MessageMetadata holds the structured payload of a message, e.g. the dimensions of an image
+type MessageMetadata map[string]interface{}
+
+// Clone returns a shallow copy of the metadata, so fields can be changed without changing the
+// original. The copy of nil metadata is empty, not nil.
+func (m MessageMetadata) Clone() MessageMetadata {
+	clone := make(MessageMetadata, len(m))
+	for name, value := range m {
+		clone[name] = value
+	}
+	return clone
+}
+
+// FieldKind represents the JSON type of a metadata field
+type FieldKind string
+
+const (
+	StringField  FieldKind = "string"
+	NumberField  FieldKind = "number"
+	IntegerField FieldKind = "integer"
+)
+
+// FieldSchema describes one field of a message type's metadata
+type FieldSchema struct {
+	Kind      FieldKind
+	Required  bool
+	Min       *float64
+	Max       *float64
+	MaxLength int
+}
+
+// MetadataSchema describes the metadata of a message type. Fields not in the schema are rejected.
+type MetadataSchema map[string]FieldSchema
+
+// MessageTypeSpec describes what a message of a type may contain
+type MessageTypeSpec struct {
+	// UserSendable is false for types that users cannot send through the message APIs
+	UserSendable bool
+	// NotSendableReason explains why a type cannot be sent by users
+	NotSendableReason string
+	// RequiresContent is true for types whose content is the message itself
+	RequiresContent bool
+	// Metadata is the schema of the type's metadata, or nil if it takes none
+	Metadata MetadataSchema
+}
+
+// MessageValidationError is returned when a message does not match its type
+type MessageValidationError struct {
+	Reason string
+}
+
+func (e *MessageValidationError) Error() string {
+	return e.Reason
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+// MessageTypes is the registry of message types
+var MessageTypes = map[MessageType]MessageTypeSpec{
+	TextMessage: {
+		UserSendable:    true,
+		RequiresContent: true,
+	},
+	// Images, files and voice notes are uploaded first; their URL, size and type come from the
+	// attachment, as do the dimensions of images once processed
+	ImageMessage: {
+		UserSendable: true,
+		Metadata: MetadataSchema{
+			"attachment_id": {Kind: StringField, Required: true, MaxLength: 64},
+			"width":         {Kind: IntegerField, Min: bound(1), Max: bound(20000)},
+			"height":        {Kind: IntegerField, Min: bound(1), Max: bound(20000)},
+		},
+	},
+	FileMessage: {
+		UserSendable: true,
+		Metadata: MetadataSchema{
+			"attachment_id": {Kind: StringField, Required: true, MaxLength: 64},
+		},
+	},
+	AudioMessage: {
+		UserSendable: true,
+		Metadata: MetadataSchema{
+			"attachment_id": {Kind: StringField, Required: true, MaxLength: 64},
+		},
+	},
+	LocationMessage: {
+		UserSendable: true,
+		Metadata: MetadataSchema{
+			"latitude":  {Kind: NumberField, Required: true, Min: bound(-90), Max: bound(90)},
+			"longitude": {Kind: NumberField, Required: true, Min: bound(-180), Max: bound(180)},
+			"accuracy":  {Kind: NumberField, Min: bound(0)},
+			"heading":   {Kind: NumberField, Min: bound(0), Max: bound(360)},
+			"name":      {Kind: StringField, MaxLength: 255},
+			"address":   {Kind: StringField, MaxLength: 512},
+			// Seconds the sender shares their position live for, posting updates
+			"live_period": {Kind: IntegerField, Min: bound(60), Max: bound(MaxLiveLocationPeriod)},
+		},
+	},
+	ContactMessage: {
+		UserSendable: true,
+		Metadata: MetadataSchema{
+			"name":    {Kind: StringField, Required: true, MaxLength: 255},
+			"phone":   {Kind: StringField, MaxLength: 64},
+			"email":   {Kind: StringField, MaxLength: 255},
+			"user_id": {Kind: StringField, MaxLength: 64},
+		},
+	},
+	PollMessage: {
+		NotSendableReason: "Polls must be created through the polls API",
+	},
+	SystemMessage: {
+		NotSendableReason: "System messages cannot be sent by users",
+	},
+}
+
+// ValidateUserMessage checks that a message sent by a user has an allowed type,
+// content within the length limit and metadata matching the type's schema
+func ValidateUserMessage(messageType MessageType, content string, metadata MessageMetadata) error {
+	spec, ok := MessageTypes[messageType]
+	if !ok {
+		return &MessageValidationError{Reason: fmt.Sprintf("Unsupported message type %q", messageType)}
+	}
+	if !spec.UserSendable {
+		return &MessageValidationError{Reason: spec.NotSendableReason}
+	}
+
+	if spec.RequiresContent && strings.TrimSpace(content) == "" {
+		return &MessageValidationError{Reason: "Content is required"}
+	}
+	if utf8.RuneCountInString(content) > MaxContentLength {
+		return &MessageValidationError{Reason: fmt.Sprintf("Content must be at most %d characters", MaxContentLength)}
+	}
+
+	if spec.Metadata == nil {
+		if len(metadata) > 0 {
+			return &MessageValidationError{Reason: fmt.Sprintf("Messages of type %q take no metadata", messageType)}
+		}
+		return nil
+	}
+
+	return spec.Metadata.Validate(metadata)
+}
+
+// Validate checks metadata against the schema
+func (s MetadataSchema) Validate(metadata MessageMetadata) error {
+	// Report unknown fields in a stable order
+	var unknown []string
+	for name := range metadata {
+		if _, ok := s[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &MessageValidationError{Reason: fmt.Sprintf("Unknown metadata field %q", unknown[0])}
+	}
+
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := s[name]
+		value, ok := metadata[name]
+		if !ok || value == nil {
+			if field.Required {
+				return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q is required", name)}
+			}
+			continue
+		}
+		if err := field.validate(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks one metadata value against its field schema
+func (f FieldSchema) validate(name string, value interface{}) error {
+	switch f.Kind {
+	case StringField:
+		s, ok := value.(string)
+		if !ok {
+			return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q must be a string", name)}
+		}
+		if f.MaxLength > 0 && utf8.RuneCountInString(s) > f.MaxLength {
+			return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q must be at most %d characters", name, f.MaxLength)}
+		}
+
+	case NumberField, IntegerField:
+		n, ok := value.(float64)
+		if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+			return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q must be a number", name)}
+		}
+		if f.Kind == IntegerField && n != math.Trunc(n) {
+			return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q must be an integer", name)}
+		}
+		if f.Min != nil && n < *f.Min {
+			return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q must be at least %v", name, *f.Min)}
+		}
+		if f.Max != nil && n > *f.Max {
+			return &MessageValidationError{Reason: fmt.Sprintf("Metadata field %q must be at most %v", name, *f.Max)}
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -8,59 +11,81 @@ import (
 
 // User represents a user in the system
 type User struct {
-	ID        string    `json:"id" gorm:"primaryKey"`
-	Username  string    `json:"username" gorm:"uniqueIndex;not null"`
-	Email     string    `json:"email" gorm:"uniqueIndex;not null"`
-	Password  string    `json:"-" gorm:"not null"`
-	AvatarURL *string   `json:"avatar_url"`
-	LastSeen  time.Time `json:"last_seen"`
-	IsOnline  bool      `json:"is_online" gorm:"default:false"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID       string `json:"id" gorm:"primaryKey"`
+	Username string `json:"username" gorm:"uniqueIndex;not null"`
+	Email    string `json:"email" gorm:"uniqueIndex;not null"`
+	Password string `json:"-" gorm:"not null"`
+	// AvatarKey is the storage key of the uploaded avatar, from which the avatar URLs are made
+	AvatarKey  *string           `json:"-"`
+	AvatarURL  *string           `json:"avatar_url" gorm:"-"`
+	AvatarURLs map[string]string `json:"avatar_urls,omitempty" gorm:"-"`
+	LastSeen   time.Time         `json:"last_seen"`
+	IsOnline   bool              `json:"is_online" gorm:"default:false"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
 }
 
 // MessageType represents the type of message
 type MessageType string
 
 const (
-	TextMessage   MessageType = "text"
-	ImageMessage  MessageType = "image"
-	FileMessage   MessageType = "file"
-	SystemMessage MessageType = "system"
+	TextMessage     MessageType = "text"
+	ImageMessage    MessageType = "image"
+	FileMessage     MessageType = "file"
+	SystemMessage   MessageType = "system"
+	PollMessage     MessageType = "poll"
+	LocationMessage MessageType = "location"
+	ContactMessage  MessageType = "contact"
+	AudioMessage    MessageType = "audio"
 )
 
 // Message represents a message in the system
 type Message struct {
-	ID         string      `json:"id" gorm:"primaryKey"`
-	SenderID   string      `json:"sender_id" gorm:"index;not null"`
-	ReceiverID *string     `json:"receiver_id" gorm:"index"`
-	GroupID    *string     `json:"group_id" gorm:"index"`
-	Content    string      `json:"content" gorm:"not null"`
-	Type       MessageType `json:"type" gorm:"default:'text'"`
-	IsRead     bool        `json:"is_read" gorm:"default:false"`
-	Timestamp  time.Time   `json:"timestamp"`
-	CreatedAt  time.Time   `json:"created_at"`
-	UpdatedAt  time.Time   `json:"updated_at"`
+	ID             string          `json:"id" gorm:"primaryKey"`
+	SenderID       string          `json:"sender_id" gorm:"index;not null"`
+	ReceiverID     *string         `json:"receiver_id" gorm:"index"`
+	GroupID        *string         `json:"group_id" gorm:"index"`
+	ConversationID *string         `json:"conversation_id" gorm:"index"`
+	Seq            int64           `json:"seq" gorm:"not null;default:0"`
+	Content        string          `json:"content" gorm:"not null"`
+	Type           MessageType     `json:"type" gorm:"default:'text'"`
+	Metadata       MessageMetadata `json:"metadata,omitempty" gorm:"type:jsonb;serializer:json"`
+	IsRead         bool            `json:"is_read" gorm:"default:false"`
+	Timestamp      time.Time       `json:"timestamp"`
+	ExpiresAt      *time.Time      `json:"expires_at" gorm:"index"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	// ChangeTxID is the transaction that last wrote the message, set by a trigger (see MigrateChangeTracking)
+	ChangeTxID int64 `json:"-" gorm:"index;not null;default:0"`
 
 	// Relations
 	Sender   User   `json:"sender" gorm:"foreignKey:SenderID"`
 	Receiver *User  `json:"receiver,omitempty" gorm:"foreignKey:ReceiverID"`
 	Group    *Group `json:"group,omitempty" gorm:"foreignKey:GroupID"`
+
+	// The poll of a poll message is loaded on demand (see attachPolls)
+	Poll *Poll `json:"poll,omitempty" gorm:"-"`
 }
 
 // Group represents a chat group
 type Group struct {
-	ID          string    `json:"id" gorm:"primaryKey"`
-	Name        string    `json:"name" gorm:"not null"`
-	Description *string   `json:"description"`
-	AvatarURL   *string   `json:"avatar_url"`
-	CreatorID   string    `json:"creator_id" gorm:"index;not null"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          string  `json:"id" gorm:"primaryKey"`
+	Name        string  `json:"name" gorm:"not null"`
+	Description *string `json:"description"`
+	// AvatarKey is the storage key of the uploaded avatar, from which the avatar URLs are made
+	AvatarKey  *string           `json:"-"`
+	AvatarURL  *string           `json:"avatar_url" gorm:"-"`
+	AvatarURLs map[string]string `json:"avatar_urls,omitempty" gorm:"-"`
+	CreatorID  string            `json:"creator_id" gorm:"index;not null"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
 
 	// Relations
 	Creator User        `json:"creator" gorm:"foreignKey:CreatorID"`
 	Members []GroupUser `json:"members" gorm:"foreignKey:GroupID"`
+
+	// Pinned messages are loaded on demand (see GetGroup)
+	PinnedMessages []PinnedMessage `json:"pinned_messages,omitempty" gorm:"-"`
 }
 
 // GroupUser represents the many-to-many relationship between users and groups
@@ -76,6 +101,311 @@ type GroupUser struct {
 	User User `json:"user" gorm:"foreignKey:UserID"`
 }
 
+// MessageTombstone records a deleted message so reconnecting clients can sync the deletion
+type MessageTombstone struct {
+	MessageID      string    `json:"message_id" gorm:"primaryKey"`
+	SenderID       string    `json:"sender_id" gorm:"index"`
+	ReceiverID     *string   `json:"receiver_id" gorm:"index"`
+	GroupID        *string   `json:"group_id" gorm:"index"`
+	ConversationID *string   `json:"conversation_id" gorm:"index"`
+	Seq            int64     `json:"seq"`
+	DeletedAt      time.Time `json:"deleted_at" gorm:"index"`
+	ChangeTxID     int64     `json:"-" gorm:"index;not null;default:0"`
+}
+
+// PinnedMessage represents a message pinned to the top of a chat
+type PinnedMessage struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	MessageID  string    `json:"message_id" gorm:"uniqueIndex;not null"`
+	ChatKey    string    `json:"chat_key" gorm:"index;not null"`
+	PinnedByID string    `json:"pinned_by_id" gorm:"not null"`
+	PinnedAt   time.Time `json:"pinned_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// Relations
+	Message  Message `json:"message" gorm:"foreignKey:MessageID"`
+	PinnedBy User    `json:"pinned_by" gorm:"foreignKey:PinnedByID"`
+}
+
+// SavedMessage represents a message bookmarked by a user
+type SavedMessage struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"uniqueIndex:idx_saved_user_message;not null"`
+	MessageID string    `json:"message_id" gorm:"uniqueIndex:idx_saved_user_message;index;not null"`
+	Note      *string   `json:"note"`
+	Tags      []string  `json:"tags" gorm:"type:jsonb;serializer:json"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Relations
+	Message Message `json:"message" gorm:"foreignKey:MessageID"`
+}
+
+// ScheduledMessageStatus represents the delivery state of a scheduled message
+type ScheduledMessageStatus string
+
+const (
+	ScheduledPending   ScheduledMessageStatus = "pending"
+	ScheduledSending   ScheduledMessageStatus = "sending"
+	ScheduledSent      ScheduledMessageStatus = "sent"
+	ScheduledFailed    ScheduledMessageStatus = "failed"
+	ScheduledCancelled ScheduledMessageStatus = "cancelled"
+)
+
+// ScheduledMessage represents a direct or group message to be sent at a future time
+type ScheduledMessage struct {
+	ID         string                 `json:"id" gorm:"primaryKey"`
+	SenderID   string                 `json:"sender_id" gorm:"index;not null"`
+	ReceiverID *string                `json:"receiver_id"`
+	GroupID    *string                `json:"group_id"`
+	Content    string                 `json:"content" gorm:"not null"`
+	Type       MessageType            `json:"type" gorm:"default:'text'"`
+	Metadata   MessageMetadata        `json:"metadata,omitempty" gorm:"type:jsonb;serializer:json"`
+	SendAt     time.Time              `json:"send_at" gorm:"index;not null"`
+	Status     ScheduledMessageStatus `json:"status" gorm:"index;default:'pending'"`
+	MessageID  *string                `json:"message_id"`
+	Error      *string                `json:"error"`
+	ClaimedAt  *time.Time             `json:"-"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// ReadState represents how far a user has read in a chat.
+// LastReadSeq is the sequence number of the last read message, which read pointers are compared by.
+type ReadState struct {
+	ChatKey           string    `json:"chat_key" gorm:"primaryKey"`
+	UserID            string    `json:"user_id" gorm:"primaryKey;index"`
+	LastReadMessageID string    `json:"last_read_message_id" gorm:"not null"`
+	LastReadTimestamp time.Time `json:"last_read_timestamp" gorm:"not null"`
+	LastReadSeq       int64     `json:"last_read_seq" gorm:"not null;default:0"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// PlayedState records that a recipient played a voice note
+type PlayedState struct {
+	MessageID string    `json:"message_id" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"primaryKey;index"`
+	PlayedAt  time.Time `json:"played_at"`
+}
+
+// IdempotencyWindow is how long a client message ID dedupes retried sends
+const IdempotencyWindow = 24 * time.Hour
+
+// MessageIdempotencyKey records the message created for a client message ID, so a
+// retried send returns the original message instead of creating a duplicate
+type MessageIdempotencyKey struct {
+	SenderID  string `json:"sender_id" gorm:"primaryKey"`
+	Key       string `json:"key" gorm:"primaryKey"`
+	MessageID string `json:"message_id" gorm:"not null"`
+	// Fingerprint identifies what was sent (see Message.Fingerprint), so a key reused for a different message is caught
+	Fingerprint string    `json:"-" gorm:"not null;default:''"`
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
+}
+
+// ChatPreference represents a user's personal settings for a chat
+type ChatPreference struct {
+	UserID       string     `json:"user_id" gorm:"primaryKey"`
+	ChatKey      string     `json:"chat_key" gorm:"primaryKey"`
+	MutedUntil   *time.Time `json:"muted_until"`
+	MutedForever bool       `json:"muted_forever" gorm:"default:false"`
+	IsArchived   bool       `json:"is_archived" gorm:"default:false"`
+	IsPinned     bool       `json:"is_pinned" gorm:"default:false"`
+	PinnedAt     *time.Time `json:"pinned_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// MuteDuration represents how long a chat is muted for
+type MuteDuration string
+
+const (
+	MuteOff     MuteDuration = "off"
+	Mute8Hours  MuteDuration = "8h"
+	Mute1Week   MuteDuration = "1w"
+	MuteForever MuteDuration = "forever"
+)
+
+// MuteDurations maps the timed mute durations to their length
+var MuteDurations = map[MuteDuration]time.Duration{
+	Mute8Hours: 8 * time.Hour,
+	Mute1Week:  7 * 24 * time.Hour,
+}
+
+// IsMuted checks if the chat is muted at the given time
+func (p *ChatPreference) IsMuted(at time.Time) bool {
+	return p.MutedForever || (p.MutedUntil != nil && p.MutedUntil.After(at))
+}
+
+// Mute mutes the chat for a duration starting at the given time, or unmutes it for MuteOff
+func (p *ChatPreference) Mute(duration MuteDuration, at time.Time) {
+	p.MutedForever = duration == MuteForever
+	p.MutedUntil = nil
+	if d, ok := MuteDurations[duration]; ok {
+		until := at.Add(d)
+		p.MutedUntil = &until
+	}
+}
+
+// UnarchiveChat moves a chat out of the archive of the given users when a new message arrives.
+// Users who muted the chat keep it archived.
+func UnarchiveChat(db *gorm.DB, chatKey string, userIDs []string, at time.Time) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	return db.Model(&ChatPreference{}).
+		Where("chat_key = ? AND user_id IN ? AND is_archived = ?", chatKey, userIDs, true).
+		Where("NOT muted_forever AND (muted_until IS NULL OR muted_until <= ?)", at).
+		Updates(map[string]interface{}{"is_archived": false, "updated_at": at}).Error
+}
+
+// Mention represents a user being mentioned in a group message
+type Mention struct {
+	ID            string    `json:"id" gorm:"primaryKey"`
+	MessageID     string    `json:"message_id" gorm:"uniqueIndex:idx_mention_message_user;not null"`
+	UserID        string    `json:"user_id" gorm:"uniqueIndex:idx_mention_message_user;index;not null"`
+	GroupID       string    `json:"group_id" gorm:"index;not null"`
+	MentionedByID string    `json:"mentioned_by_id" gorm:"not null"`
+	IsAll         bool      `json:"is_all" gorm:"default:false"`
+	IsRead        bool      `json:"is_read" gorm:"default:false"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	// Relations
+	Message     Message `json:"message" gorm:"foreignKey:MessageID"`
+	MentionedBy User    `json:"mentioned_by" gorm:"foreignKey:MentionedByID"`
+}
+
+// RetentionTimer represents how long messages in a chat are kept before they disappear
+type RetentionTimer string
+
+const (
+	RetentionOff     RetentionTimer = "off"
+	Retention24Hours RetentionTimer = "24h"
+	Retention7Days   RetentionTimer = "7d"
+	Retention90Days  RetentionTimer = "90d"
+)
+
+// RetentionDurations maps each retention timer to the lifetime of new messages
+var RetentionDurations = map[RetentionTimer]time.Duration{
+	RetentionOff:     0,
+	Retention24Hours: 24 * time.Hour,
+	Retention7Days:   7 * 24 * time.Hour,
+	Retention90Days:  90 * 24 * time.Hour,
+}
+
+// RetentionSetting represents the disappearing messages timer of a chat
+type RetentionSetting struct {
+	ChatKey     string         `json:"chat_key" gorm:"primaryKey"`
+	Timer       RetentionTimer `json:"timer" gorm:"not null;default:'off'"`
+	UpdatedByID string         `json:"updated_by_id"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+// GroupChatKey returns the chat key identifying a group chat
+func GroupChatKey(groupID string) string {
+	return "group:" + groupID
+}
+
+// DirectChatKey returns the chat key identifying the direct chat between two users.
+// The key is the same regardless of the order the users are passed in.
+func DirectChatKey(userID, otherUserID string) string {
+	if userID > otherUserID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return "direct:" + userID + ":" + otherUserID
+}
+
+// ChatKey returns the key of the chat the message belongs to
+func (m *Message) ChatKey() string {
+	if m.GroupID != nil {
+		return GroupChatKey(*m.GroupID)
+	}
+	if m.ReceiverID != nil {
+		return DirectChatKey(m.SenderID, *m.ReceiverID)
+	}
+	return ""
+}
+
+// Fingerprint hashes where a message is sent and what it says, as sent by the client
+func (m *Message) Fingerprint() string {
+	raw, _ := json.Marshal(struct {
+		ReceiverID *string         `json:"receiver_id"`
+		GroupID    *string         `json:"group_id"`
+		Type       MessageType     `json:"type"`
+		Content    string          `json:"content"`
+		Metadata   MessageMetadata `json:"metadata"`
+	}{m.ReceiverID, m.GroupID, m.Type, m.Content, m.Metadata})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// BeforeCreate links a new message to its conversation, assigns it the next sequence
+// number of the conversation and stamps its expiry from the retention timer of its chat
+func (m *Message) BeforeCreate(tx *gorm.DB) error {
+	db := tx.Session(&gorm.Session{NewDB: true})
+
+	if m.ConversationID == nil {
+		var conversation *Conversation
+		var err error
+		if m.GroupID != nil {
+			conversation, err = EnsureGroupConversation(db, *m.GroupID)
+		} else if m.ReceiverID != nil {
+			conversation, err = EnsureDirectConversation(db, m.SenderID, *m.ReceiverID)
+		}
+		if err != nil {
+			return err
+		}
+		if conversation != nil {
+			m.ConversationID = &conversation.ID
+		}
+	}
+
+	// Taking the next number locks the conversation row until the message is committed,
+	// so concurrent messages get consecutive numbers and a failed insert leaves no gap
+	if m.ConversationID != nil {
+		if err := db.Raw("UPDATE conversations SET last_seq = last_seq + 1 WHERE id = ? RETURNING last_seq", *m.ConversationID).Scan(&m.Seq).Error; err != nil {
+			return err
+		}
+	}
+
+	if m.ExpiresAt != nil {
+		return nil
+	}
+
+	var setting RetentionSetting
+	result := db.Where("chat_key = ?", m.ChatKey()).Limit(1).Find(&setting)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if duration := RetentionDurations[setting.Timer]; duration > 0 {
+		sentAt := m.Timestamp
+		if sentAt.IsZero() {
+			sentAt = time.Now()
+		}
+		expiresAt := sentAt.Add(duration)
+		m.ExpiresAt = &expiresAt
+	}
+
+	return nil
+}
+
+// AfterCreate moves the last message pointer of the message's conversation
+func (m *Message) AfterCreate(tx *gorm.DB) error {
+	if m.ConversationID == nil {
+		return nil
+	}
+
+	// The message has the highest sequence number of its conversation, so it is always the latest
+	return tx.Session(&gorm.Session{NewDB: true}).Model(&Conversation{}).
+		Where("id = ?", *m.ConversationID).
+		Updates(map[string]interface{}{"last_message_id": m.ID, "last_message_at": m.Timestamp}).Error
+}
+
 // AutoMigrate automatically migrates the database schema
 func AutoMigrate(db *gorm.DB) error {
 	return db.AutoMigrate(
@@ -83,5 +413,28 @@ func AutoMigrate(db *gorm.DB) error {
 		&Message{},
 		&Group{},
 		&GroupUser{},
+		&MessageTombstone{},
+		&GroupTombstone{},
+		&PinnedMessage{},
+		&SavedMessage{},
+		&ScheduledMessage{},
+		&Mention{},
+		&ReadState{},
+		&PlayedState{},
+		&ChatPreference{},
+		&RetentionSetting{},
+		&Conversation{},
+		&ConversationParticipant{},
+		&Poll{},
+		&PollOption{},
+		&PollVote{},
+		&MessageIdempotencyKey{},
+		&Attachment{},
+		&UploadSession{},
+		&UploadChunk{},
+		&GroupStoragePolicy{},
+		&LinkPreview{},
+		&PendingLinkPreview{},
+		&LiveLocation{},
 	)
 }
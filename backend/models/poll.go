@@ -0,0 +1,76 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Poll represents a poll posted as a poll message in a group.
+// The tallies are computed when the poll is loaded and are not stored.
+type Poll struct {
+	ID             string     `json:"id" gorm:"primaryKey"`
+	MessageID      string     `json:"message_id" gorm:"uniqueIndex;not null"`
+	GroupID        string     `json:"group_id" gorm:"index;not null"`
+	CreatorID      string     `json:"creator_id" gorm:"not null"`
+	Question       string     `json:"question" gorm:"not null"`
+	MultipleChoice bool       `json:"multiple_choice" gorm:"default:false"`
+	Anonymous      bool       `json:"anonymous" gorm:"default:false"`
+	ClosesAt       *time.Time `json:"closes_at"`
+	ClosedAt       *time.Time `json:"closed_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relations
+	Options []PollOption `json:"options" gorm:"foreignKey:PollID"`
+
+	// Tallies
+	TotalVoters int64    `json:"total_voters" gorm:"-"`
+	MyVotes     []string `json:"my_votes,omitempty" gorm:"-"`
+}
+
+// PollOption represents one of the answers of a poll
+type PollOption struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	PollID    string    `json:"poll_id" gorm:"index;not null"`
+	Position  int       `json:"position"`
+	Text      string    `json:"text" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Tallies; voters are only listed for public polls
+	VoteCount int64  `json:"vote_count" gorm:"-"`
+	Voters    []User `json:"voters,omitempty" gorm:"-"`
+}
+
+// PollVote represents a user's vote for an option of a poll
+type PollVote struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	PollID    string    `json:"poll_id" gorm:"uniqueIndex:idx_poll_vote;not null"`
+	OptionID  string    `json:"option_id" gorm:"uniqueIndex:idx_poll_vote;not null"`
+	UserID    string    `json:"user_id" gorm:"uniqueIndex:idx_poll_vote;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IsClosed checks if the poll no longer accepts votes at the given time
+func (p *Poll) IsClosed(at time.Time) bool {
+	return p.ClosedAt != nil || (p.ClosesAt != nil && !p.ClosesAt.After(at))
+}
+
+// ClosePoll closes a poll at the given time and bumps the update time of its message so syncing
+// clients pick up the final tallies. It reports whether the poll was still open.
+func ClosePoll(db *gorm.DB, poll *Poll, at time.Time) (bool, error) {
+	closed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Poll{}).
+			Where("id = ? AND closed_at IS NULL", poll.ID).
+			Updates(map[string]interface{}{"closed_at": at, "updated_at": at})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		closed = true
+
+		return tx.Model(&Message{}).Where("id = ?", poll.MessageID).UpdateColumn("updated_at", at).Error
+	})
+	return closed, err
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// QuotaSettings holds the default storage quotas in bytes
+type QuotaSettings struct {
+	UserBytes  int64
+	GroupBytes int64
+}
+
+// Quotas are the storage quotas in effect. They are configured from the environment at startup.
+var Quotas = QuotaSettings{
+	UserBytes:  1 << 30,
+	GroupBytes: 5 << 30,
+}
+
+// QuotaPolicy represents what happens when media sent to a group would exceed its quota
+type QuotaPolicy string
+
+const (
+	// QuotaBlock rejects media that does not fit in the group's quota
+	QuotaBlock QuotaPolicy = "block"
+	// QuotaExpireOldest deletes the group's oldest media to make room
+	QuotaExpireOldest QuotaPolicy = "expire_oldest"
+)
+
+// Codes of quota errors, returned to clients so they can tell the quotas apart
+const (
+	UserQuotaExceeded  = "user_quota_exceeded"
+	GroupQuotaExceeded = "group_quota_exceeded"
+)
+
+// GroupStoragePolicy holds the storage quota settings of a group chosen by its admins
+type GroupStoragePolicy struct {
+	GroupID string `json:"group_id" gorm:"primaryKey"`
+	// QuotaBytes lowers the group's quota below the default; nil uses the default
+	QuotaBytes  *int64      `json:"quota_bytes"`
+	Policy      QuotaPolicy `json:"policy" gorm:"not null;default:'block'"`
+	UpdatedByID string      `json:"updated_by_id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// Quota returns the group's quota in bytes
+func (p *GroupStoragePolicy) Quota() int64 {
+	if p.QuotaBytes != nil && *p.QuotaBytes < Quotas.GroupBytes {
+		return *p.QuotaBytes
+	}
+	return Quotas.GroupBytes
+}
+
+// LoadGroupStoragePolicy loads the storage policy of a group, defaulting to blocking at the default quota
+func LoadGroupStoragePolicy(db *gorm.DB, groupID string) GroupStoragePolicy {
+	policy := GroupStoragePolicy{GroupID: groupID, Policy: QuotaBlock}
+	db.Where("group_id = ?", groupID).Limit(1).Find(&policy)
+	return policy
+}
+
+// QuotaExceededError is returned when storing a file would exceed a quota
+type QuotaExceededError struct {
+	Code  string
+	Used  int64
+	Quota int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Code == GroupQuotaExceeded {
+		return fmt.Sprintf("The group has used %s of its %s of storage", formatBytes(e.Used), formatBytes(e.Quota))
+	}
+	return fmt.Sprintf("You have used %s of your %s of storage", formatBytes(e.Used), formatBytes(e.Quota))
+}
+
+// UserStorageUsage returns the bytes a user stores: their attachments, and the full size
+// of their unfinished resumable uploads, which is reserved when an upload starts
+func UserStorageUsage(db *gorm.DB, userID string) (int64, error) {
+	var attachments, uploads int64
+	err := db.Model(&Attachment{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("uploader_id = ? AND detached_at IS NULL", userID).
+		Scan(&attachments).Error
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.Model(&UploadSession{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("uploader_id = ? AND attachment_id IS NULL AND expires_at > ?", userID, time.Now()).
+		Scan(&uploads).Error
+	return attachments + uploads, err
+}
+
+// GroupStorageUsage returns the bytes of the attachments sent to a group
+func GroupStorageUsage(db *gorm.DB, groupID string) (int64, error) {
+	var used int64
+	err := db.Model(&Attachment{}).
+		Select("COALESCE(SUM(attachments.size), 0)").
+		Joins("JOIN messages ON messages.id = attachments.message_id").
+		Where("messages.group_id = ? AND attachments.detached_at IS NULL", groupID).
+		Scan(&used).Error
+	return used, err
+}
+
+// CheckUserQuota checks that a user can store additional bytes. The user's row is locked so
+// concurrent uploads are checked one at a time; call it in the transaction that records the
+// bytes so the check holds until they are counted.
+func CheckUserQuota(tx *gorm.DB, userID string, additional int64) error {
+	if err := lockRow(tx, &User{}, userID); err != nil {
+		return err
+	}
+
+	used, err := UserStorageUsage(tx, userID)
+	if err != nil {
+		return err
+	}
+	if used+additional > Quotas.UserBytes {
+		return &QuotaExceededError{Code: UserQuotaExceeded, Used: used, Quota: Quotas.UserBytes}
+	}
+	return nil
+}
+
+// MakeGroupRoom checks that additional bytes fit in a group's quota. Under the expire oldest
+// policy the group's oldest attachments are detached from their messages until they fit, and
+// the messages whose media expired are returned so they can be published once committed.
+// The group's row is locked so concurrent sends are checked one at a time; call it in the
+// transaction that sends the media so nothing expires when the send fails.
+func MakeGroupRoom(tx *gorm.DB, groupID string, additional int64) ([]Message, error) {
+	if err := lockRow(tx, &Group{}, groupID); err != nil {
+		return nil, err
+	}
+
+	policy := LoadGroupStoragePolicy(tx, groupID)
+	quota := policy.Quota()
+
+	used, err := GroupStorageUsage(tx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if used+additional <= quota {
+		return nil, nil
+	}
+	if policy.Policy != QuotaExpireOldest || additional > quota {
+		return nil, &QuotaExceededError{Code: GroupQuotaExceeded, Used: used, Quota: quota}
+	}
+
+	var expired []Message
+	for used+additional > quota {
+		var oldest []Attachment
+		err := tx.Model(&Attachment{}).
+			Select("attachments.*").
+			Joins("JOIN messages ON messages.id = attachments.message_id").
+			Where("messages.group_id = ? AND attachments.detached_at IS NULL", groupID).
+			Order("attachments.created_at ASC").
+			Limit(50).
+			Find(&oldest).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(oldest) == 0 {
+			break
+		}
+
+		for _, attachment := range oldest {
+			if used+additional <= quota {
+				break
+			}
+			message, err := expireAttachment(tx, &attachment)
+			if err != nil {
+				return nil, err
+			}
+			used -= attachment.Size
+			if message != nil {
+				expired = append(expired, *message)
+			}
+		}
+	}
+
+	return expired, nil
+}
+
+// lockRow locks the row of a user or group until the end of the transaction
+func lockRow(tx *gorm.DB, model interface{}, id string) error {
+	var ids []string
+	return tx.Model(model).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", id).Pluck("id", &ids).Error
+}
+
+// expireAttachment detaches an attachment so its file gets deleted, and marks the media of
+// its message as expired
+func expireAttachment(tx *gorm.DB, attachment *Attachment) (*Message, error) {
+	now := time.Now()
+	result := tx.Model(&Attachment{}).
+		Where("id = ? AND detached_at IS NULL", attachment.ID).
+		Updates(map[string]interface{}{"message_id": nil, "detached_at": now, "updated_at": now})
+	if result.Error != nil || result.RowsAffected == 0 || attachment.MessageID == nil {
+		return nil, result.Error
+	}
+
+	var found Message
+	if err := tx.Where("id = ?", *attachment.MessageID).Limit(1).Find(&found).Error; err != nil || found.ID == "" {
+		return nil, err
+	}
+
+	metadata := found.Metadata.Clone()
+	delete(metadata, "url")
+	delete(metadata, "thumbnails")
+	metadata["expired"] = true
+	found.Metadata = metadata
+	found.UpdatedAt = now
+	if err := tx.Model(&found).Select("metadata", "updated_at").Updates(&found).Error; err != nil {
+		return nil, err
+	}
+	return &found, nil
+}
+
+// formatBytes formats a byte count for people, e.g. "1.5 GB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// MigrateChangeTracking installs the triggers that stamp messages and tombstones with the
+// transaction that last wrote them, so syncing clients can page through changes in the
+// order they were committed instead of by clock time
+func MigrateChangeTracking(db *gorm.DB) error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION stamp_change_tx_id() RETURNS trigger AS $$
+		BEGIN
+			NEW.change_tx_id := txid_current();
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql`,
+	}
+	for _, table := range []string{"messages", "message_tombstones", "group_tombstones"} {
+		statements = append(statements,
+			`DROP TRIGGER IF EXISTS stamp_change_tx_id ON `+table,
+			`CREATE TRIGGER stamp_change_tx_id BEFORE INSERT OR UPDATE ON `+table+`
+			FOR EACH ROW EXECUTE FUNCTION stamp_change_tx_id()`,
+		)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(strings.TrimSpace(statement)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SyncHorizon returns the ID of the oldest transaction still running. Every change stamped
+// with a lower ID is committed or rolled back, so a sync can read up to the horizon without
+// skipping changes that commit later.
+func SyncHorizon(db *gorm.DB) (int64, error) {
+	var horizon int64
+	err := db.Raw("SELECT txid_snapshot_xmin(txid_current_snapshot())").Scan(&horizon).Error
+	return horizon, err
+}
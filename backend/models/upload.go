@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// UploadSessionTTL is how long an upload session is kept after its last chunk
+const UploadSessionTTL = 24 * time.Hour
+
+// UploadSession represents a resumable upload. The file is sent in chunks appended at the
+// session's offset and becomes an attachment when all of it has arrived.
+type UploadSession struct {
+	ID          string `json:"id" gorm:"primaryKey"`
+	UploaderID  string `json:"uploader_id" gorm:"index;not null"`
+	FileName    string `json:"file_name" gorm:"not null"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size" gorm:"not null"`
+	Offset      int64  `json:"offset" gorm:"column:byte_offset;not null;default:0"`
+	// Checksum is the SHA-256 of the whole file declared by the client, if any
+	Checksum string `json:"checksum,omitempty"`
+	// HashState is the state of the SHA-256 of the chunks received so far
+	HashState    []byte    `json:"-"`
+	AttachmentID *string   `json:"attachment_id"`
+	ExpiresAt    time.Time `json:"expires_at" gorm:"index;not null"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// IsComplete reports whether all of the file has been received
+func (u *UploadSession) IsComplete() bool {
+	return u.Offset == u.Size
+}
+
+// UploadChunk is a stored chunk of a resumable upload
+type UploadChunk struct {
+	UploadID   string    `json:"upload_id" gorm:"primaryKey"`
+	Offset     int64     `json:"offset" gorm:"column:byte_offset;primaryKey"`
+	Size       int64     `json:"size" gorm:"not null"`
+	StorageKey string    `json:"-" gorm:"not null"`
+	CreatedAt  time.Time `json:"created_at"`
+}
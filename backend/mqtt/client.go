@@ -19,15 +19,42 @@ type MQTTClient struct {
 
 // MessagePayload represents the message payload for MQTT
 type MessagePayload struct {
-	ID         string    `json:"id"`
-	SenderID   string    `json:"sender_id"`
-	ReceiverID *string   `json:"receiver_id,omitempty"`
-	GroupID    *string   `json:"group_id,omitempty"`
-	Content    string    `json:"content"`
-	Type       string    `json:"type"`
-	Timestamp  time.Time `json:"timestamp"`
+	ID             string                 `json:"id"`
+	SenderID       string                 `json:"sender_id"`
+	ReceiverID     *string                `json:"receiver_id,omitempty"`
+	GroupID        *string                `json:"group_id,omitempty"`
+	ConversationID *string                `json:"conversation_id,omitempty"`
+	Seq            int64                  `json:"seq"`
+	Content        string                 `json:"content"`
+	Type           string                 `json:"type"`
+	Metadata       models.MessageMetadata `json:"metadata,omitempty"`
+	Timestamp      time.Time              `json:"timestamp"`
 }
 
+// MessageEventPayload represents a non-message event about a message or chat for MQTT
+type MessageEventPayload struct {
+	Event      string      `json:"event"`
+	MessageID  string      `json:"message_id,omitempty"`
+	SenderID   string      `json:"sender_id,omitempty"`
+	ReceiverID *string     `json:"receiver_id,omitempty"`
+	GroupID    *string     `json:"group_id,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+// Event names used in MessageEventPayload
+const (
+	EventMessageDeleted = "message_deleted"
+	EventMention        = "mention"
+	EventRead           = "read"
+	EventNotification   = "notification"
+	EventPollUpdated    = "poll_updated"
+	EventMessageUpdated = "message_updated"
+	EventQuarantined    = "attachment_quarantined"
+	EventPlayed         = "played"
+	EventLocation       = "location_updated"
+)
+
 // NewClient creates a new MQTT client and connects to the broker
 func NewClient() (*MQTTClient, error) {
 	// Get MQTT broker details from environment variables
@@ -70,12 +97,15 @@ func (m *MQTTClient) PublishDirectMessage(message *models.Message) error {
 	}
 
 	payload := MessagePayload{
-		ID:         message.ID,
-		SenderID:   message.SenderID,
-		ReceiverID: message.ReceiverID,
-		Content:    message.Content,
-		Type:       string(message.Type),
-		Timestamp:  message.Timestamp,
+		ID:             message.ID,
+		SenderID:       message.SenderID,
+		ReceiverID:     message.ReceiverID,
+		ConversationID: message.ConversationID,
+		Seq:            message.Seq,
+		Content:        message.Content,
+		Type:           string(message.Type),
+		Metadata:       message.Metadata,
+		Timestamp:      message.Timestamp,
 	}
 
 	return m.publishMessage(fmt.Sprintf("chat/user/%s", *message.ReceiverID), payload)
@@ -88,15 +118,201 @@ func (m *MQTTClient) PublishGroupMessage(message *models.Message) error {
 	}
 
 	payload := MessagePayload{
-		ID:        message.ID,
+		ID:             message.ID,
+		SenderID:       message.SenderID,
+		GroupID:        message.GroupID,
+		ConversationID: message.ConversationID,
+		Seq:            message.Seq,
+		Content:        message.Content,
+		Type:           string(message.Type),
+		Metadata:       message.Metadata,
+		Timestamp:      message.Timestamp,
+	}
+
+	return m.publishMessage(fmt.Sprintf("chat/group/%s", *message.GroupID), payload)
+}
+
+// PublishMessageDeleted notifies the participants of a chat that a message was deleted
+func (m *MQTTClient) PublishMessageDeleted(message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:      EventMessageDeleted,
+		MessageID:  message.ID,
+		SenderID:   message.SenderID,
+		ReceiverID: message.ReceiverID,
+		GroupID:    message.GroupID,
+		Timestamp:  time.Now(),
+	}
+
+	return m.publishToChat(message, payload)
+}
+
+// PublishMessageUpdated notifies the participants of a chat that the server updated a message,
+// e.g. when an image attached to it finished processing
+func (m *MQTTClient) PublishMessageUpdated(message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:      EventMessageUpdated,
+		MessageID:  message.ID,
+		SenderID:   message.SenderID,
+		ReceiverID: message.ReceiverID,
+		GroupID:    message.GroupID,
+		Data: MessagePayload{
+			ID:             message.ID,
+			SenderID:       message.SenderID,
+			ReceiverID:     message.ReceiverID,
+			GroupID:        message.GroupID,
+			ConversationID: message.ConversationID,
+			Seq:            message.Seq,
+			Content:        message.Content,
+			Type:           string(message.Type),
+			Metadata:       message.Metadata,
+			Timestamp:      message.Timestamp,
+		},
+		Timestamp: time.Now(),
+	}
+
+	return m.publishToChat(message, payload)
+}
+
+// PublishMention notifies a user that they were mentioned in a group message
+func (m *MQTTClient) PublishMention(userID string, message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:     EventMention,
+		MessageID: message.ID,
 		SenderID:  message.SenderID,
 		GroupID:   message.GroupID,
-		Content:   message.Content,
-		Type:      string(message.Type),
-		Timestamp: message.Timestamp,
+		Data: MessagePayload{
+			ID:             message.ID,
+			SenderID:       message.SenderID,
+			GroupID:        message.GroupID,
+			ConversationID: message.ConversationID,
+			Seq:            message.Seq,
+			Content:        message.Content,
+			Type:           string(message.Type),
+			Metadata:       message.Metadata,
+			Timestamp:      message.Timestamp,
+		},
+		Timestamp: time.Now(),
 	}
 
-	return m.publishMessage(fmt.Sprintf("chat/group/%s", *message.GroupID), payload)
+	return m.publishMessage(fmt.Sprintf("chat/user/%s", userID), payload)
+}
+
+// PublishNotification notifies a user of a new message in one of their chats that they have not muted
+func (m *MQTTClient) PublishNotification(userID string, message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:      EventNotification,
+		MessageID:  message.ID,
+		SenderID:   message.SenderID,
+		ReceiverID: message.ReceiverID,
+		GroupID:    message.GroupID,
+		Data: MessagePayload{
+			ID:             message.ID,
+			SenderID:       message.SenderID,
+			ReceiverID:     message.ReceiverID,
+			GroupID:        message.GroupID,
+			ConversationID: message.ConversationID,
+			Seq:            message.Seq,
+			Content:        message.Content,
+			Type:           string(message.Type),
+			Metadata:       message.Metadata,
+			Timestamp:      message.Timestamp,
+		},
+		Timestamp: time.Now(),
+	}
+
+	return m.publishMessage(fmt.Sprintf("chat/user/%s", userID), payload)
+}
+
+// PublishPollUpdated notifies the members of a group of the new tallies of a poll
+func (m *MQTTClient) PublishPollUpdated(poll *models.Poll) error {
+	payload := MessageEventPayload{
+		Event:     EventPollUpdated,
+		MessageID: poll.MessageID,
+		GroupID:   &poll.GroupID,
+		Data:      poll,
+		Timestamp: time.Now(),
+	}
+
+	return m.publishMessage(fmt.Sprintf("chat/group/%s", poll.GroupID), payload)
+}
+
+// PublishAttachmentQuarantined notifies the uploader of an attachment that it was quarantined
+// because the malware scanner found malware in it
+func (m *MQTTClient) PublishAttachmentQuarantined(attachment *models.Attachment) error {
+	payload := MessageEventPayload{
+		Event:     EventQuarantined,
+		SenderID:  attachment.UploaderID,
+		Data:      attachment,
+		Timestamp: time.Now(),
+	}
+	if attachment.MessageID != nil {
+		payload.MessageID = *attachment.MessageID
+	}
+
+	return m.publishMessage(fmt.Sprintf("chat/user/%s", attachment.UploaderID), payload)
+}
+
+// PublishRead notifies the participants of a chat that a user has read up to a message
+func (m *MQTTClient) PublishRead(userID string, message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:      EventRead,
+		MessageID:  message.ID,
+		SenderID:   message.SenderID,
+		ReceiverID: message.ReceiverID,
+		GroupID:    message.GroupID,
+		Data:       map[string]string{"user_id": userID},
+		Timestamp:  time.Now(),
+	}
+
+	return m.publishToChat(message, payload)
+}
+
+// PublishPlayed notifies the participants of a chat that a user has played a voice note
+func (m *MQTTClient) PublishPlayed(state *models.PlayedState, message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:      EventPlayed,
+		MessageID:  message.ID,
+		SenderID:   message.SenderID,
+		ReceiverID: message.ReceiverID,
+		GroupID:    message.GroupID,
+		Data:       state,
+		Timestamp:  time.Now(),
+	}
+
+	return m.publishToChat(message, payload)
+}
+
+// PublishLocationUpdated notifies the participants of a chat of the new position of a live location
+func (m *MQTTClient) PublishLocationUpdated(message *models.Message) error {
+	payload := MessageEventPayload{
+		Event:      EventLocation,
+		MessageID:  message.ID,
+		SenderID:   message.SenderID,
+		ReceiverID: message.ReceiverID,
+		GroupID:    message.GroupID,
+		Data:       message.Metadata,
+		Timestamp:  time.Now(),
+	}
+
+	return m.publishToChat(message, payload)
+}
+
+// publishToChat publishes a payload to every topic of the chat a message belongs to.
+// Group chats share one topic, direct chats publish to both participants.
+func (m *MQTTClient) publishToChat(message *models.Message, payload interface{}) error {
+	if message.GroupID != nil {
+		return m.publishMessage(fmt.Sprintf("chat/group/%s", *message.GroupID), payload)
+	}
+
+	if message.ReceiverID == nil {
+		return fmt.Errorf("receiver ID or group ID is required")
+	}
+
+	if err := m.publishMessage(fmt.Sprintf("chat/user/%s", *message.ReceiverID), payload); err != nil {
+		return err
+	}
+
+	return m.publishMessage(fmt.Sprintf("chat/user/%s", message.SenderID), payload)
 }
 
 // publishMessage publishes a message to a topic
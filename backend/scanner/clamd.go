@@ -0,0 +1,123 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks files are streamed to clamd in
+const clamdChunkSize = 64 << 10
+
+// Clamd scans files with a ClamAV daemon using the INSTREAM command of the clamd protocol
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamd creates a scanner for the clamd listening at an address like "tcp://localhost:3310"
+// or "unix:///var/run/clamav/clamd.ctl". The timeout covers a whole scan.
+func NewClamd(address string, timeout time.Duration) (*Clamd, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || addr == "" || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("invalid clamd address %q", address)
+	}
+	return &Clamd{network: network, address: addr, timeout: timeout}, nil
+}
+
+// Scan streams a file to clamd and parses its verdict
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	return scan(conn, r)
+}
+
+// scan streams a file over a connection to clamd and parses its verdict
+func scan(conn net.Conn, r io.Reader) (Result, error) {
+	if err := stream(conn, r); err != nil {
+		// clamd closes the connection when a file exceeds its StreamMaxLength, and
+		// explains why in its reply
+		if reply, replyErr := readReply(conn); replyErr == nil && reply != "" {
+			return parseReply(reply)
+		}
+		return Result{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, fmt.Errorf("read clamd reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// stream sends the INSTREAM command followed by the file in length-prefixed chunks
+func stream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("send clamd command: %w", err)
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("stream file to clamd: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read file: %w", err)
+		}
+	}
+
+	// A zero-length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("stream file to clamd: %w", err)
+	}
+	return nil
+}
+
+// readReply reads the null-terminated reply of clamd
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseReply parses replies like "stream: OK" and "stream: Win.Test.EICAR_HDB-1 FOUND"
+func parseReply(reply string) (Result, error) {
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	case strings.HasSuffix(verdict, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(verdict, " ERROR"))
+	default:
+		return Result{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
@@ -0,0 +1,42 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// EICAR is the standard antivirus test file. Every scanner reports it as malware.
+const EICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// Fake is a scanner for tests and development that reports files containing one of its
+// patterns as infected, without running an antivirus
+type Fake struct {
+	// Patterns maps byte sequences to the signature reported for files containing them
+	Patterns map[string]string
+	// Err is returned by every scan if set, to simulate an unavailable scanner
+	Err error
+}
+
+// NewFake creates a fake scanner that detects the EICAR test file
+func NewFake() *Fake {
+	return &Fake{Patterns: map[string]string{EICAR: "Eicar-Test-Signature"}}
+}
+
+// Scan reads the file and looks for the patterns
+func (f *Fake) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if f.Err != nil {
+		return Result{}, f.Err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Result{}, err
+	}
+	for pattern, signature := range f.Patterns {
+		if bytes.Contains(data, []byte(pattern)) {
+			return Result{Infected: true, Signature: signature}, nil
+		}
+	}
+	return Result{}, nil
+}
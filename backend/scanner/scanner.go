@@ -0,0 +1,21 @@
+package scanner
+
+import (
+	"context"
+	"io"
+)
+
+// Result is the verdict of a malware scan
+type Result struct {
+	// Infected is true if the scanned file contains malware
+	Infected bool
+	// Signature names the malware that was found, e.g. "Win.Test.EICAR_HDB-1"
+	Signature string
+}
+
+// Scanner scans files for malware
+type Scanner interface {
+	// Scan reads a file to the end and reports whether it contains malware. An error means
+	// the file could not be scanned, not that it is infected.
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
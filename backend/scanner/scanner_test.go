@@ -0,0 +1,224 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveClamd answers one INSTREAM command like clamd: it reads the chunks of a file and
+// replies with the verdict for it. Files over maxLength are refused as clamd does with
+// its StreamMaxLength. The received file is returned.
+func serveClamd(t *testing.T, conn net.Conn, maxLength int, verdict func(data []byte) string) []byte {
+	t.Helper()
+	defer conn.Close()
+
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+		t.Errorf("clamd received command %q, %v", command, err)
+		return nil
+	}
+
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			t.Errorf("clamd failed to read a chunk size: %v", err)
+			return nil
+		}
+		if size == 0 {
+			break
+		}
+		if maxLength > 0 && len(data)+int(size) > maxLength {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			// Keep reading so the reply is not lost to a reset connection
+			io.Copy(io.Discard, conn)
+			return data
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			t.Errorf("clamd failed to read a chunk: %v", err)
+			return nil
+		}
+		data = append(data, chunk...)
+	}
+
+	conn.Write([]byte("stream: " + verdict(data) + "\x00"))
+	return data
+}
+
+// eicarVerdict detects the EICAR test file
+func eicarVerdict(data []byte) string {
+	if bytes.Contains(data, []byte(EICAR)) {
+		return "Win.Test.EICAR_HDB-1 FOUND"
+	}
+	return "OK"
+}
+
+func TestScan(t *testing.T) {
+	// Larger than a chunk, so the file is streamed in several
+	large := bytes.Repeat([]byte("clean "), clamdChunkSize/3)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		verdict string
+		want    Result
+		wantErr string
+	}{
+		{"clean", []byte("hello"), "", Result{}, ""},
+		{"clean in several chunks", large, "", Result{}, ""},
+		{"empty", nil, "", Result{}, ""},
+		{"infected", append(large, EICAR...), "", Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, ""},
+		{"scan error", []byte("hello"), "Can't allocate memory ERROR", Result{}, "clamd: Can't allocate memory"},
+		{"unexpected reply", []byte("hello"), "PONG", Result{}, "unexpected clamd reply"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			received := make(chan []byte, 1)
+			go func() {
+				received <- serveClamd(t, server, 0, func(data []byte) string {
+					if tt.verdict != "" {
+						return tt.verdict
+					}
+					return eicarVerdict(data)
+				})
+			}()
+
+			got, err := scan(client, bytes.NewReader(tt.data))
+			client.Close()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("scan() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("scan() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("scan() = %+v, want %+v", got, tt.want)
+			}
+			if data := <-received; !bytes.Equal(data, tt.data) {
+				t.Errorf("clamd received %d bytes, want %d", len(data), len(tt.data))
+			}
+		})
+	}
+}
+
+// refusingConn is a connection whose peer stops reading after limit bytes and explains why in a reply
+type refusingConn struct {
+	net.Conn
+	limit int
+	reply io.Reader
+}
+
+func (c *refusingConn) Write(p []byte) (int, error) {
+	if len(p) > c.limit {
+		return 0, syscall.EPIPE
+	}
+	c.limit -= len(p)
+	return len(p), nil
+}
+
+func (c *refusingConn) Read(p []byte) (int, error) {
+	return c.reply.Read(p)
+}
+
+func TestScanOversize(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*clamdChunkSize)
+
+	// clamd closes the connection in the middle of the stream, so its reply explains the failed write
+	conn := &refusingConn{limit: clamdChunkSize + 20, reply: strings.NewReader("INSTREAM size limit exceeded. ERROR\x00")}
+	_, err := scan(conn, bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("scan() error = %v, want the size limit reply", err)
+	}
+
+	// Without a reply the write error is returned
+	conn = &refusingConn{limit: clamdChunkSize + 20, reply: strings.NewReader("")}
+	_, err = scan(conn, bytes.NewReader(data))
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("scan() error = %v, want the write error", err)
+	}
+}
+
+func TestClamd(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	const maxLength = 2 * clamdChunkSize
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(t, conn, maxLength, eicarVerdict)
+		}
+	}()
+
+	clamd, err := NewClamd("tcp://"+listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewClamd() error = %v", err)
+	}
+	ctx := context.Background()
+
+	if got, err := clamd.Scan(ctx, strings.NewReader("hello")); err != nil || got.Infected {
+		t.Errorf("Scan() of a clean file = %+v, %v", got, err)
+	}
+	if got, err := clamd.Scan(ctx, strings.NewReader("prefix "+EICAR)); err != nil || !got.Infected {
+		t.Errorf("Scan() of the EICAR file = %+v, %v", got, err)
+	}
+	_, err = clamd.Scan(ctx, bytes.NewReader(make([]byte, 2*maxLength)))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("Scan() of an oversize file error = %v, want the size limit reply", err)
+	}
+
+	// A clamd that is down fails the scan instead of passing the file
+	listener.Close()
+	if _, err := clamd.Scan(ctx, strings.NewReader("hello")); err == nil {
+		t.Error("Scan() without clamd succeeded")
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	for _, address := range []string{"tcp://localhost:3310", "unix:///var/run/clamav/clamd.ctl"} {
+		if _, err := NewClamd(address, time.Minute); err != nil {
+			t.Errorf("NewClamd(%q) error = %v", address, err)
+		}
+	}
+	for _, address := range []string{"", "localhost:3310", "udp://localhost:3310", "tcp://"} {
+		if _, err := NewClamd(address, time.Minute); err == nil {
+			t.Errorf("NewClamd(%q) succeeded, want an error", address)
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	fake := NewFake()
+	ctx := context.Background()
+
+	if got, err := fake.Scan(ctx, strings.NewReader("hello")); err != nil || got.Infected {
+		t.Errorf("Scan() of a clean file = %+v, %v", got, err)
+	}
+	got, err := fake.Scan(ctx, strings.NewReader("prefix "+EICAR+" suffix"))
+	if err != nil || !got.Infected || got.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Scan() of the EICAR file = %+v, %v", got, err)
+	}
+
+	fake.Err = errors.New("scanner unavailable")
+	if _, err := fake.Scan(ctx, strings.NewReader(EICAR)); !errors.Is(err, fake.Err) {
+		t.Errorf("Scan() error = %v, want %v", err, fake.Err)
+	}
+}
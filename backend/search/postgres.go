@@ -0,0 +1,132 @@
+package search
+
+import (
+	"context"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// textSearchConfig is the PostgreSQL text search configuration used for messages.
+// "simple" does no stemming, which behaves predictably for chats in any language.
+const textSearchConfig = "simple"
+
+// headlineOptions controls how snippets are highlighted
+const headlineOptions = "StartSel=<mark>, StopSel=</mark>, MinWords=10, MaxWords=30, MaxFragments=2"
+
+// escapedContent is the message content escaped for HTML, so the only markup in snippets is
+// the highlighting. "&" is replaced first so the entities added after it are kept.
+const escapedContent = `replace(replace(replace(replace(replace(m.content,
+	'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+
+// PostgresIndex searches messages using PostgreSQL full-text search.
+// The index is a generated tsvector column on the messages table, so it is
+// always up to date without any extra work when messages change.
+type PostgresIndex struct {
+	db *gorm.DB
+}
+
+// NewPostgresIndex creates a new PostgreSQL message index
+func NewPostgresIndex(db *gorm.DB) *PostgresIndex {
+	return &PostgresIndex{db: db}
+}
+
+// Setup adds the search column and GIN index to the messages table
+func (p *PostgresIndex) Setup() error {
+	statements := []string{
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector('` + textSearchConfig + `', coalesce(content, ''))) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector)`,
+	}
+
+	for _, statement := range statements {
+		if err := p.db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Search searches the messages visible to the query's user, best match first
+func (p *PostgresIndex) Search(ctx context.Context, query Query) (*Result, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	// Only messages in the user's direct chats and groups are searched
+	conditions := []string{
+		"m.search_vector @@ q.query",
+		"m.type <> 'system'",
+		"((m.sender_id = ? AND m.receiver_id IS NOT NULL) OR m.receiver_id = ? OR m.group_id IN (SELECT group_id FROM group_users WHERE user_id = ?))",
+	}
+	// The query text is used twice: for the snippet headline and for matching
+	args := []interface{}{query.Text, query.Text, query.UserID, query.UserID, query.UserID}
+
+	if query.SenderID != "" {
+		conditions = append(conditions, "m.sender_id = ?")
+		args = append(args, query.SenderID)
+	}
+	if query.GroupID != "" {
+		conditions = append(conditions, "m.group_id = ?")
+		args = append(args, query.GroupID)
+	}
+	if query.OtherUserID != "" {
+		conditions = append(conditions, "((m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?))")
+		args = append(args, query.UserID, query.OtherUserID, query.OtherUserID, query.UserID)
+	}
+	if query.Type != "" {
+		conditions = append(conditions, "m.type = ?")
+		args = append(args, query.Type)
+	}
+	if query.From != nil {
+		conditions = append(conditions, "m.timestamp >= ?")
+		args = append(args, *query.From)
+	}
+	if query.To != nil {
+		conditions = append(conditions, "m.timestamp <= ?")
+		args = append(args, *query.To)
+	}
+
+	cursorCondition := ""
+	if query.Cursor != "" {
+		rank, messageID, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		cursorCondition = "WHERE (h.rank, h.message_id) < (?, ?)"
+		args = append(args, rank, messageID)
+	}
+	args = append(args, limit+1)
+
+	sql := `
+		SELECT h.message_id, h.rank,
+			ts_headline('` + textSearchConfig + `', ` + escapedContent + `, websearch_to_tsquery('` + textSearchConfig + `', ?), '` + headlineOptions + `') AS snippet
+		FROM (
+			SELECT m.id AS message_id, ts_rank(m.search_vector, q.query)::float8 AS rank
+			FROM messages m, websearch_to_tsquery('` + textSearchConfig + `', ?) AS q(query)
+			WHERE ` + strings.Join(conditions, " AND ") + `
+		) h
+		JOIN messages m ON m.id = h.message_id
+		` + cursorCondition + `
+		ORDER BY h.rank DESC, h.message_id DESC
+		LIMIT ?`
+
+	var hits []Hit
+	if err := p.db.WithContext(ctx).Raw(sql, args...).Scan(&hits).Error; err != nil {
+		return nil, err
+	}
+
+	result := &Result{Hits: hits}
+	if len(hits) > limit {
+		result.Hits = hits[:limit]
+		next := encodeCursor(result.Hits[limit-1])
+		result.NextCursor = &next
+	}
+	if result.Hits == nil {
+		result.Hits = []Hit{}
+	}
+
+	return result, nil
+}
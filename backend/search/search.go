@@ -0,0 +1,79 @@
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a search cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query represents a message search performed on behalf of a user.
+// Only messages the user can see (their direct chats and groups they are a member of) are searched.
+type Query struct {
+	UserID      string
+	Text        string
+	SenderID    string
+	GroupID     string
+	OtherUserID string
+	Type        string
+	From        *time.Time
+	To          *time.Time
+	Cursor      string
+	Limit       int
+}
+
+// Hit represents a message matching a search. The snippet is HTML: excerpts of the message
+// escaped, with the matching words wrapped in <mark> tags.
+type Hit struct {
+	MessageID string  `json:"message_id"`
+	Rank      float64 `json:"rank"`
+	Snippet   string  `json:"snippet"`
+}
+
+// Result represents a page of search hits, best match first
+type Result struct {
+	Hits       []Hit   `json:"hits"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// Index is a searchable index of messages. Implementations are responsible for
+// keeping themselves up to date with the messages table.
+type Index interface {
+	// Setup prepares the index (e.g. creates database structures)
+	Setup() error
+
+	// Search searches the messages visible to the query's user
+	Search(ctx context.Context, query Query) (*Result, error)
+}
+
+// encodeCursor encodes the position after a hit into an opaque cursor
+func encodeCursor(hit Hit) string {
+	raw := fmt.Sprintf("%s|%s", strconv.FormatFloat(hit.Rank, 'g', -1, 64), hit.MessageID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor decodes a cursor produced by encodeCursor
+func decodeCursor(s string) (float64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", ErrInvalidCursor
+	}
+
+	rank, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+
+	return rank, parts[1], nil
+}
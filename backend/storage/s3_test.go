@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testRegion    = "eu-central-1"
+)
+
+// fakeS3 is an in-memory S3-compatible server that checks the Signature Version 4 of every request
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	hosts   []string
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{bucket: bucket, objects: make(map[string]fakeObject)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verifySignature(r); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>"+err.Error()+"</Message></Error>")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hosts = append(f.hosts, r.Host)
+
+	// Path-style requests name the bucket first, virtual-hosted ones in the host name
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(r.Host, f.bucket+".") {
+		bucket, rest, _ := strings.Cut(key, "/")
+		if bucket != f.bucket {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchBucket</Code></Error>")
+			return
+		}
+		key = rest
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = fakeObject{data: data, contentType: r.Header.Get("Content-Type")}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// has reports whether an object is stored under a key
+func (f *fakeS3) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects[key]
+	return ok
+}
+
+// verifySignature recomputes the signature of a request as S3 does and compares it
+func (f *fakeS3) verifySignature(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	rest, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return errors.New("unsupported authorization")
+	}
+	for _, field := range strings.Split(rest, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return errors.New("invalid date")
+	}
+	scope := requestTime.Format("20060102") + "/" + testRegion + "/s3/aws4_request"
+	if fields["Credential"] != testAccessKey+"/"+scope {
+		return errors.New("invalid credential " + fields["Credential"])
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signedHeaders) {
+		return errors.New("signed headers are not sorted")
+	}
+	var canonicalHeaders string
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders,
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{requestTime.Format("20060102"), testRegion, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(fields["Signature"])) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func newTestS3Storage(t *testing.T, config S3Config) *S3Storage {
+	t.Helper()
+	if config.Bucket == "" {
+		config.Bucket = "media"
+	}
+	config.Region = testRegion
+	config.AccessKey = testAccessKey
+	if config.SecretKey == "" {
+		config.SecretKey = testSecretKey
+	}
+	s, err := NewS3Storage(config)
+	if err != nil {
+		t.Fatalf("NewS3Storage() error = %v", err)
+	}
+	return s
+}
+
+func TestS3StorageRoundTrip(t *testing.T) {
+	fake, server := newFakeS3(t, "media")
+	s := newTestS3Storage(t, S3Config{Endpoint: server.URL, PathStyle: true})
+	ctx := context.Background()
+
+	keys := []string{
+		"attachments/0b6f1c9e",
+		"avatars/users/42/photo of me+1 (ü).jpg",
+	}
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			content := "contents of " + key
+			if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "image/jpeg"); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			if !fake.has(key) {
+				t.Fatalf("Put() stored the object under another key")
+			}
+
+			reader, info, err := s.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			data, _ := io.ReadAll(reader)
+			reader.Close()
+			if string(data) != content {
+				t.Errorf("Get() = %q, want %q", data, content)
+			}
+			if info.Size != int64(len(content)) || info.ContentType != "image/jpeg" {
+				t.Errorf("Get() info = %+v, want size %d and type image/jpeg", info, len(content))
+			}
+
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if _, _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() after Delete() error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+
+	// Deleting an object that does not exist is not an error
+	if err := s.Delete(ctx, "attachments/missing"); err != nil {
+		t.Errorf("Delete() of a missing object error = %v", err)
+	}
+}
+
+func TestS3StorageVirtualHostedStyle(t *testing.T) {
+	fake, server := newFakeS3(t, "media")
+	s := newTestS3Storage(t, S3Config{Endpoint: "http://s3.test"})
+
+	// Every host name resolves to the fake server
+	s.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+
+	ctx := context.Background()
+	if err := s.Put(ctx, "attachments/a", strings.NewReader("a"), 1, ""); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if !fake.has("attachments/a") {
+		t.Error("Put() stored the object under another key")
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.hosts) != 1 || fake.hosts[0] != "media.s3.test" {
+		t.Errorf("requests went to %v, want the bucket host media.s3.test", fake.hosts)
+	}
+}
+
+func TestS3StorageErrors(t *testing.T) {
+	_, server := newFakeS3(t, "media")
+	ctx := context.Background()
+
+	// The fake rejects signatures made with another secret
+	s := newTestS3Storage(t, S3Config{Endpoint: server.URL, PathStyle: true, SecretKey: "not the secret"})
+	err := s.Put(ctx, "attachments/a", strings.NewReader("a"), 1, "")
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Put() with a wrong secret error = %v, want the 403 response", err)
+	}
+	if _, _, err := s.Get(ctx, "attachments/a"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() with a wrong secret error = %v, want the 403 response", err)
+	}
+
+	// A missing bucket is an error, not a missing object
+	s = newTestS3Storage(t, S3Config{Endpoint: server.URL, PathStyle: true, Bucket: "other"})
+	if err := s.Put(ctx, "attachments/a", strings.NewReader("a"), 1, ""); err == nil {
+		t.Error("Put() to a missing bucket succeeded")
+	}
+
+	if err := s.Put(ctx, "", strings.NewReader("a"), 1, ""); err == nil {
+		t.Error("Put() with an empty key succeeded")
+	}
+}
+
+func TestNewS3Storage(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  S3Config
+		wantErr bool
+	}{
+		{"valid", S3Config{Endpoint: "https://s3.eu-west-1.amazonaws.com/", Bucket: "media"}, false},
+		{"no scheme", S3Config{Endpoint: "s3.amazonaws.com", Bucket: "media"}, true},
+		{"no endpoint", S3Config{Bucket: "media"}, true},
+		{"no bucket", S3Config{Endpoint: "http://localhost:9000"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewS3Storage(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewS3Storage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && s.config.Region != "us-east-1" {
+				t.Errorf("NewS3Storage() region = %q, want the default us-east-1", s.config.Region)
+			}
+		})
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	values := url.Values{"prefix": {"a b/c"}, "list-type": {"2"}, "marker": {"z", "a"}}
+	want := "list-type=2&marker=a&marker=z&prefix=a%20b%2Fc"
+	if got := canonicalQuery(values); got != want {
+		t.Errorf("canonicalQuery() = %q, want %q", got, want)
+	}
+}